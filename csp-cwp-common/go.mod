@@ -3,11 +3,12 @@ module github.com/rapid7/csp-cwp-common
 go 1.15
 
 require (
-	github.com/HdrHistogram/hdrhistogram-go v1.1.0 // indirect
+	github.com/HdrHistogram/hdrhistogram-go v1.1.0
 	github.com/elliotchance/orderedmap v1.4.0
 	github.com/getsentry/sentry-go v0.11.0
 	github.com/gogo/protobuf v1.3.2
 	github.com/google/gops v0.3.19
+	github.com/google/uuid v1.3.0
 	github.com/opentracing/opentracing-go v1.2.0
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
 	github.com/stretchr/testify v1.7.0
@@ -15,6 +16,7 @@ require (
 	github.com/uber/jaeger-lib v2.4.1+incompatible // indirect
 	go.uber.org/atomic v1.9.0
 	go.uber.org/zap v1.19.0
+	google.golang.org/grpc v1.39.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/apimachinery v0.21.3
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"time"
 
+	"go.uber.org/atomic"
+
 	"github.com/rapid7/csp-cwp-common/pkg/processor"
 	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
 )
@@ -23,9 +25,19 @@ type badProcessor struct {
 	runError          bool
 	addEventSinkError bool
 	addQuerySinkError bool
+	//Run blocks until the channel is closed, if set
+	runBlock chan struct{}
+	//Shutdown blocks until the channel is closed, if set
+	shutdownBlock chan struct{}
+	//Number of Run calls
+	runs atomic.Int32
 }
 
 func (bp *badProcessor) Run() error {
+	bp.runs.Inc()
+	if bp.runBlock != nil {
+		<-bp.runBlock
+	}
 	if bp.runError {
 		return fmt.Errorf("run error")
 	}
@@ -33,6 +45,9 @@ func (bp *badProcessor) Run() error {
 }
 
 func (bp *badProcessor) Shutdown() error {
+	if bp.shutdownBlock != nil {
+		<-bp.shutdownBlock
+	}
 	if bp.shutdownError {
 		return fmt.Errorf("shutdown error")
 	}
@@ -53,6 +68,10 @@ func (bp *badProcessor) AddEventQuery(queryType proto.QueryType, sink processor.
 	return nil
 }
 
+func (bp *badProcessor) GetTap() processor.TapInterface {
+	return nil
+}
+
 func (bp *badProcessor) PushEvent(event *proto.Event) error {
 	return nil
 }
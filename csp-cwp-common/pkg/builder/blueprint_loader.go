@@ -3,40 +3,111 @@ package builder
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
 	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
-//TODO: support remote instances config
 type blueprintLoader struct {
-	localInstances []map[string]string
-	eventRelations []map[string]string
-	queryRelations []map[string]string
+	localInstances  []map[string]string
+	remoteInstances []map[string]string
+	eventRelations  []map[string]string
+	queryRelations  []map[string]string
 }
 
 //Load the blueprint YAML file into the inner struct maps.
-//File should have 3 main sections of map lists:
+//File should have 4 main sections of map lists:
 //
 //# Listing local Processors and Services instances to create and run.
 //# Instances will be created and run in order of their listing.
 //localInstances:
 // - name: <processor name>
 //   type: <processor type>
+//# Listing Processors and Services instances hosted by other agent processes,
+//# exposed there under the same name.
+//remoteInstances:
+// - name: <processor name>
+//   address: <host:port of the remote transport server>
+//   transport: <optional transport, only grpc (default) is supported>
+//   tls: <optional true or false (default)>
+//   # The following TLS settings are only allowed along with tls: true
+//   caFile: <optional CA certificate file to verify the server with>
+//   certFile: <optional client certificate file, along with keyFile>
+//   keyFile: <optional client key file, along with certFile>
+//   serverName: <optional server name to verify the server certificate with>
+//   insecureSkipVerify: <optional true or false (default)>
 //# Secifiying the event relations between instances
 //eventRelations:
 // - source: <processor name>
 //   destination: <processor name>
 //   eventType: <event type>
+//   timeout: <optional call deadline, as 100ms>
+//   interceptors: <optional comma separated names of the builder event interceptors>
+//   retryAttempts: <optional number of delivery attempts, including the first one, timed out events are not retried>
+//   retryBackoff: <optional delay before the first retry, as 100ms>
+//   retryMaxBackoff: <optional cap of the retries delay, as 10s>
+//   retryMultiplier: <optional factor the retries delay grows by, default 2>
+//   retryJitter: <optional random fraction in [0, 1] the retries delay may vary by>
+//   deadLetter: <optional processor name or file:<path> receiving the undelivered events>
+//   filter: <optional expression over the event fields selecting the events delivered, as Dummy.Info == "disk">
+//   batchSize: <optional number of events delivered together in a batch, default 100>
+//   batchBytes: <optional encoded size of the events delivered together in a batch>
+//   batchLinger: <optional time an event waits for its batch to complete, default 1s>
+//   persistentDir: <optional directory of a write-ahead log the events go through, unique per relation, without batching>
+//   persistentMaxBytes: <optional size limit of the write-ahead log in bytes>
+//   persistentMaxAge: <optional age beyond which undelivered events are dropped, as 24h>
+//   persistentSync: <optional true or false (default), sync the write-ahead log on each event>
+//   rateLimit: <optional average number of events per second delivered, dropping the others>
+//   rateBurst: <optional number of events delivered at once within the rate limit, default a second worth>
+//   sampleRate: <optional fraction in (0, 1] of the events delivered, dropping the others>
+//   sampling: <optional sampling mode, random (default) or deterministic by the event UUID>
 //# Secifiying the query relations between instances
 //queryRelations:
 // - source: <processor name>
 //   destination: <processor name>
 //   queryType: <query type>
+//   timeout: <optional call deadline, as 100ms>
+//   balancing: <optional replicas balancing strategy, as roundRobin>
+//   interceptors: <optional comma separated names of the builder query interceptors>
+//   retryAttempts, retryBackoff, retryMaxBackoff, retryMultiplier, retryJitter:
+//     <optional retries settings, as for the event relations, timed out queries are retried>
+//   circuitFailureRatio: <optional ratio of failed queries in (0, 1] opening the circuit, default 0.5>
+//   circuitMinRequests: <optional number of queries in a period before the circuit may open, default 10>
+//   circuitWindow: <optional period the failure ratio is computed over, default 10s>
+//   circuitLatency: <optional duration beyond which a query is counted as failed, as 500ms>
+//   circuitCoolDown: <optional duration the circuit stays open, default 5s>
+//   circuitProbes: <optional number of successful trial queries closing the circuit, default 1>
+//   cacheTTL: <optional duration the query results are cached for, as 1m>
+//   cacheMaxEntries: <optional number of cached results, evicting the least recently used>
+//   cacheErrorTTL: <optional duration the failures are cached for, not cached by default>
+//   rateLimit, rateBurst: <optional rate limit settings, as for the event relations,
+//     rejecting the queries beyond it>
 //
-//First section is considered mandatory, other two are optional
-//but are most likely to appear as well.
+//First section is considered mandatory, other three are optional
+//but relations are most likely to appear as well.
+//Relations sources must be local instances, destinations may be either local or remote.
+//Multiple event relations of the same source and event type deliver the events to all
+//of their destinations.
+//Multiple event relations of the same source and event type with different filters route
+//subsets of the events to different destinations.
+//Events dropped by the rate limit or the sampling of a relation are counted by its metrics.
+//Event relations with batching settings deliver EventBatch events holding the events of the
+//relation type, which the destinations unpack by processor.UnpackBatch or processor.NewUnpackingTap.
+//Their pending batches are delivered when the mesh is shut down, waiting up to the relation
+//timeout, or 5s if not set.
+//Event relations with a persistentDir deliver their events asynchronously, at least once,
+//replaying the events left undelivered when the mesh is run again. They do not batch their
+//events, as an event is acknowledged in the write-ahead log once its delivery returns.
+//Multiple query relations of the same source and query type balance the queries between
+//their destinations as replicas, using the balancing strategy which should be the same
+//for all of them: roundRobin (default), leastOutstanding or consistentHash.
+//The cache settings should be the same for all of them as well, as the cache is shared.
 func (b *blueprintLoader) load(filepath string) error {
 	content, err := ioutil.ReadFile(filepath)
 	if err != nil {
@@ -49,6 +120,7 @@ func (b *blueprintLoader) load(filepath string) error {
 	}
 
 	b.localInstances = layout["localInstances"]
+	b.remoteInstances = layout["remoteInstances"]
 	b.eventRelations = layout["eventRelations"]
 	b.queryRelations = layout["queryRelations"]
 
@@ -60,8 +132,8 @@ func (b *blueprintLoader) validate() error {
 	if len(b.localInstances) == 0 {
 		return fmt.Errorf("missing localInstances information")
 	}
-	//Tracking of already met instance names
-	instances := make(map[string]struct{})
+	//Tracking of already met instance names, local instances are mapped to true
+	instances := make(map[string]bool)
 	instanceExists := func(name string) bool {
 		_, exists := instances[name]
 		return exists
@@ -78,10 +150,41 @@ func (b *blueprintLoader) validate() error {
 		if instanceExists(name) {
 			return fmt.Errorf("duplicate instance %s in instances map", name)
 		} else {
-			instances[name] = struct{}{}
+			instances[name] = true
 		}
 	}
+	//Check remote instances section
+	for _, instanceInfo := range b.remoteInstances {
+		//Check that each instance entry has name and address entries and their values
+		//are not empty
+		if err := b.checkKeys([]string{"name", "address"}, instanceInfo); err != nil {
+			return err
+		}
+		name := instanceInfo["name"]
+		//Check for duplicate instance declaration, also against the local instances
+		if instanceExists(name) {
+			return fmt.Errorf("duplicate instance %s in instances map", name)
+		} else {
+			instances[name] = false
+		}
+		//Check the transport settings
+		if err := b.checkRemoteTransport(instanceInfo); err != nil {
+			return fmt.Errorf("invalid remote instance %s: %s", name, err)
+		}
+	}
+	//Tracking of already met relations
+	relations := make(map[string]struct{})
+	checkDuplicateRelation := func(relation map[string]string, typeKey string) error {
+		key := relation["source"] + "->" + relation["destination"] + ":" + relation[typeKey]
+		if _, exists := relations[key]; exists {
+			return fmt.Errorf("duplicate relation %s", key)
+		}
+		relations[key] = struct{}{}
+		return nil
+	}
 	//Check event relations
+	//Tracking of write-ahead log directories
+	persistentDirs := make(map[string]struct{})
 	for _, eventRelation := range b.eventRelations {
 		//Check that each eventRelation entry has source, destination and eventType
 		//entries and their values are not empty.
@@ -93,6 +196,10 @@ func (b *blueprintLoader) validate() error {
 		if !instanceExists(source) {
 			return fmt.Errorf("unknown event source instance %s", source)
 		}
+		//Check that source is a local instance, remote instances send from their own process.
+		if !instances[source] {
+			return fmt.Errorf("remote event source instance %s", source)
+		}
 		//Check that destination refers to a defined instance name.
 		dest := eventRelation["destination"]
 		if !instanceExists(dest) {
@@ -103,7 +210,68 @@ func (b *blueprintLoader) validate() error {
 		if _, exists := proto.EventType_value[eventType]; !exists {
 			return fmt.Errorf("invalid event type %s", eventType)
 		}
+		//Check that the same relation is not listed twice, multiple destinations for the
+		//same source and event type are allowed.
+		if err := checkDuplicateRelation(eventRelation, "eventType"); err != nil {
+			return err
+		}
+		//Check that optional timeout is a valid duration.
+		if err := b.checkDuration("timeout", eventRelation); err != nil {
+			return err
+		}
+		//Check that optional interceptors is a valid names list.
+		if err := b.checkNames("interceptors", eventRelation); err != nil {
+			return err
+		}
+		//Check that optional retries settings are valid.
+		if err := b.checkRetry(eventRelation); err != nil {
+			return err
+		}
+		//Check that optional dead letter destination is a file or a defined instance name.
+		if deadLetter, exists := eventRelation["deadLetter"]; exists {
+			if path := strings.TrimPrefix(deadLetter, "file:"); path == "" {
+				return fmt.Errorf("empty dead letter destination")
+			} else if path == deadLetter && !instanceExists(deadLetter) {
+				return fmt.Errorf("unknown dead letter instance %s", deadLetter)
+			}
+		}
+		//Check that optional filter expression compiles.
+		if expression, exists := eventRelation["filter"]; exists {
+			if _, err := processor.CompileFilter(expression); err != nil {
+				return err
+			}
+		}
+		//Check that optional rate limit and sampling settings are valid.
+		if err := b.checkRateLimit(eventRelation); err != nil {
+			return err
+		}
+		if err := b.checkSampling(eventRelation); err != nil {
+			return err
+		}
+		//Check that optional batching settings are valid.
+		if err := b.checkBatching(eventRelation); err != nil {
+			return err
+		}
+		//Check that no circuit breaker is set, as events are not answered.
+		for key := range eventRelation {
+			if strings.HasPrefix(key, "circuit") {
+				return fmt.Errorf("circuit breaker is not supported for event relations")
+			}
+		}
+		//Check that optional persistence settings are valid and the directory is not shared.
+		if err := b.checkPersistence(eventRelation); err != nil {
+			return err
+		}
+		if dir, exists := eventRelation["persistentDir"]; exists {
+			if _, exists := persistentDirs[dir]; exists {
+				return fmt.Errorf("persistent directory %s is shared by multiple relations", dir)
+			}
+			persistentDirs[dir] = struct{}{}
+		}
 	}
+	//Tracking of balancing strategy and cache settings per query source and type
+	balancing := make(map[string]string)
+	caching := make(map[string]string)
 	//Check query relations
 	for _, queryRelation := range b.queryRelations {
 		//Check that each queryRelation entry has source, destination and queryType
@@ -116,6 +284,10 @@ func (b *blueprintLoader) validate() error {
 		if !instanceExists(source) {
 			return fmt.Errorf("unknown query source instance %s", source)
 		}
+		//Check that source is a local instance, remote instances send from their own process.
+		if !instances[source] {
+			return fmt.Errorf("remote query source instance %s", source)
+		}
 		//Check that destination refers to a defined instance name.
 		dest := queryRelation["destination"]
 		if !instanceExists(dest) {
@@ -126,6 +298,102 @@ func (b *blueprintLoader) validate() error {
 		if _, exists := proto.QueryType_value[queryType]; !exists {
 			return fmt.Errorf("invalid query type %s", queryType)
 		}
+		//Check that the same relation is not listed twice, multiple destinations for the
+		//same source and query type are balanced replicas.
+		if err := checkDuplicateRelation(queryRelation, "queryType"); err != nil {
+			return err
+		}
+		//Check that optional timeout is a valid duration.
+		if err := b.checkDuration("timeout", queryRelation); err != nil {
+			return err
+		}
+		//Check that optional interceptors is a valid names list.
+		if err := b.checkNames("interceptors", queryRelation); err != nil {
+			return err
+		}
+		//Check that optional retries settings are valid.
+		if err := b.checkRetry(queryRelation); err != nil {
+			return err
+		}
+		//Check that no dead letter destination is set, as failed queries are returned to the caller.
+		if _, exists := queryRelation["deadLetter"]; exists {
+			return fmt.Errorf("dead letter is not supported for query relations")
+		}
+		//Check that optional circuit breaker settings are valid.
+		if err := b.checkCircuit(queryRelation); err != nil {
+			return err
+		}
+		//Check that no filter or sampling is set, as queries cannot be dropped.
+		if _, exists := queryRelation["filter"]; exists {
+			return fmt.Errorf("filter is not supported for query relations")
+		}
+		for _, key := range []string{"sampleRate", "sampling"} {
+			if _, exists := queryRelation[key]; exists {
+				return fmt.Errorf("sampling is not supported for query relations")
+			}
+		}
+		//Check that optional rate limit settings are valid.
+		if err := b.checkRateLimit(queryRelation); err != nil {
+			return err
+		}
+		//Check that no batching is set, as queries are answered one by one.
+		for key := range queryRelation {
+			if strings.HasPrefix(key, "batch") {
+				return fmt.Errorf("batching is not supported for query relations")
+			}
+		}
+		//Check that no persistence is set, as queries are answered synchronously.
+		if _, exists := queryRelation["persistentDir"]; exists {
+			return fmt.Errorf("persistence is not supported for query relations")
+		}
+		//Check that optional balancing strategy is valid and agrees with the other
+		//replicas of the same source and query type.
+		strategy := queryRelation["balancing"]
+		if strategy != "" {
+			if _, err := processor.ParseBalancingStrategy(strategy); err != nil {
+				return err
+			}
+		}
+		group := source + ":" + queryType
+		if previous, exists := balancing[group]; exists && previous != strategy {
+			return fmt.Errorf("conflicting balancing strategies for %s", group)
+		}
+		balancing[group] = strategy
+		//Check that optional cache settings are valid and agree with the other replicas.
+		if err := b.checkCache(queryRelation); err != nil {
+			return err
+		}
+		cache := queryRelation["cacheTTL"] + "/" + queryRelation["cacheMaxEntries"] + "/" + queryRelation["cacheErrorTTL"]
+		if previous, exists := caching[group]; exists && previous != cache {
+			return fmt.Errorf("conflicting cache settings for %s", group)
+		}
+		caching[group] = cache
+	}
+	return nil
+}
+
+//Check the transport settings of a remote instance.
+func (b *blueprintLoader) checkRemoteTransport(info map[string]string) error {
+	if transport, exists := info["transport"]; exists && transport != "grpc" {
+		return fmt.Errorf("unsupported transport %s", transport)
+	}
+	for _, key := range []string{"tls", "insecureSkipVerify"} {
+		if value, exists := info[key]; exists {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid boolean for key %s: %s", key, err)
+			}
+		}
+	}
+	if (info["certFile"] == "") != (info["keyFile"] == "") {
+		return fmt.Errorf("certFile and keyFile should be set together")
+	}
+	//TLS settings without TLS would silently fall back to plaintext
+	if tls, _ := strconv.ParseBool(info["tls"]); !tls {
+		for _, key := range []string{"caFile", "certFile", "keyFile", "serverName", "insecureSkipVerify"} {
+			if _, exists := info[key]; exists {
+				return fmt.Errorf("key %s is set without tls", key)
+			}
+		}
 	}
 	return nil
 }
@@ -143,6 +411,199 @@ func (b *blueprintLoader) checkKeys(keys []string, info map[string]string) error
 	return nil
 }
 
+//Check that an optional key holds a positive duration value.
+func (b *blueprintLoader) checkDuration(key string, info map[string]string) error {
+	value, exists := info[key]
+	if !exists {
+		return nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration for key %s: %s", key, err)
+	}
+	if duration <= 0 {
+		return fmt.Errorf("non positive duration for key %s", key)
+	}
+	return nil
+}
+
+//Check the optional retries settings of a relation.
+func (b *blueprintLoader) checkRetry(info map[string]string) error {
+	if value, exists := info["retryAttempts"]; exists {
+		if attempts, err := strconv.Atoi(value); err != nil || attempts < 1 {
+			return fmt.Errorf("invalid retry attempts %s", value)
+		}
+	}
+	for _, key := range []string{"retryBackoff", "retryMaxBackoff"} {
+		if err := b.checkDuration(key, info); err != nil {
+			return err
+		}
+	}
+	if value, exists := info["retryMultiplier"]; exists {
+		if multiplier, err := strconv.ParseFloat(value, 64); err != nil || multiplier < 1 {
+			return fmt.Errorf("invalid retry multiplier %s", value)
+		}
+	}
+	if value, exists := info["retryJitter"]; exists {
+		if jitter, err := strconv.ParseFloat(value, 64); err != nil || jitter < 0 || jitter > 1 {
+			return fmt.Errorf("invalid retry jitter %s", value)
+		}
+	}
+	return nil
+}
+
+//Check the optional circuit breaker settings of a query relation.
+func (b *blueprintLoader) checkCircuit(info map[string]string) error {
+	for _, key := range []string{"circuitWindow", "circuitLatency", "circuitCoolDown"} {
+		if err := b.checkDuration(key, info); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{"circuitMinRequests", "circuitProbes"} {
+		if value, exists := info[key]; exists {
+			if number, err := strconv.Atoi(value); err != nil || number < 1 {
+				return fmt.Errorf("invalid number for key %s: %s", key, value)
+			}
+		}
+	}
+	if value, exists := info["circuitFailureRatio"]; exists {
+		if ratio, err := strconv.ParseFloat(value, 64); err != nil || ratio <= 0 || ratio > 1 {
+			return fmt.Errorf("invalid circuit failure ratio %s", value)
+		}
+	}
+	return nil
+}
+
+//Check the optional cache settings of a query relation.
+func (b *blueprintLoader) checkCache(info map[string]string) error {
+	if _, exists := info["cacheTTL"]; !exists {
+		for _, key := range []string{"cacheMaxEntries", "cacheErrorTTL"} {
+			if _, exists := info[key]; exists {
+				return fmt.Errorf("key %s requires cacheTTL", key)
+			}
+		}
+		return nil
+	}
+	for _, key := range []string{"cacheTTL", "cacheErrorTTL"} {
+		if err := b.checkDuration(key, info); err != nil {
+			return err
+		}
+	}
+	if value, exists := info["cacheMaxEntries"]; exists {
+		if entries, err := strconv.Atoi(value); err != nil || entries < 1 {
+			return fmt.Errorf("invalid cache max entries %s", value)
+		}
+	}
+	return nil
+}
+
+//Check the optional batching settings of an event relation.
+func (b *blueprintLoader) checkBatching(info map[string]string) error {
+	for _, key := range []string{"batchSize", "batchBytes"} {
+		if value, exists := info[key]; exists {
+			if number, err := strconv.Atoi(value); err != nil || number < 1 {
+				return fmt.Errorf("invalid number for key %s: %s", key, value)
+			}
+		}
+	}
+	return b.checkDuration("batchLinger", info)
+}
+
+//Check the optional persistence settings of an event relation.
+func (b *blueprintLoader) checkPersistence(info map[string]string) error {
+	if _, exists := info["persistentDir"]; !exists {
+		for _, key := range []string{"persistentMaxBytes", "persistentMaxAge", "persistentSync"} {
+			if _, exists := info[key]; exists {
+				return fmt.Errorf("key %s requires persistentDir", key)
+			}
+		}
+		return nil
+	}
+	//Batched events would be acknowledged before their batch is delivered
+	for key := range info {
+		if strings.HasPrefix(key, "batch") {
+			return fmt.Errorf("batching is not supported for persistent relations")
+		}
+	}
+	if info["persistentDir"] == "" {
+		return fmt.Errorf("empty persistent directory")
+	}
+	if value, exists := info["persistentMaxBytes"]; exists {
+		if maxBytes, err := strconv.ParseInt(value, 10, 64); err != nil || maxBytes < 1 {
+			return fmt.Errorf("invalid persistent max bytes %s", value)
+		}
+	}
+	if err := b.checkDuration("persistentMaxAge", info); err != nil {
+		return err
+	}
+	if value, exists := info["persistentSync"]; exists {
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid boolean for key persistentSync: %s", err)
+		}
+	}
+	return nil
+}
+
+//Check the optional rate limit settings of a relation.
+func (b *blueprintLoader) checkRateLimit(info map[string]string) error {
+	value, exists := info["rateLimit"]
+	if !exists {
+		if _, exists := info["rateBurst"]; exists {
+			return fmt.Errorf("key rateBurst requires rateLimit")
+		}
+		return nil
+	}
+	if rate, err := strconv.ParseFloat(value, 64); err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return fmt.Errorf("invalid rate limit %s", value)
+	}
+	if value, exists := info["rateBurst"]; exists {
+		if burst, err := strconv.Atoi(value); err != nil || burst < 1 {
+			return fmt.Errorf("invalid rate burst %s", value)
+		}
+	}
+	return nil
+}
+
+//Check the optional sampling settings of an event relation.
+func (b *blueprintLoader) checkSampling(info map[string]string) error {
+	value, exists := info["sampleRate"]
+	if !exists {
+		if _, exists := info["sampling"]; exists {
+			return fmt.Errorf("key sampling requires sampleRate")
+		}
+		return nil
+	}
+	if rate, err := strconv.ParseFloat(value, 64); err != nil || rate <= 0 || rate > 1 {
+		return fmt.Errorf("invalid sample rate %s", value)
+	}
+	if name, exists := info["sampling"]; exists {
+		if _, err := processor.ParseSamplingMode(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Check that an optional key holds a comma separated list of unique non empty names.
+func (b *blueprintLoader) checkNames(key string, info map[string]string) error {
+	value, exists := info[key]
+	if !exists {
+		return nil
+	}
+	names := make(map[string]struct{})
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("empty name in key %s", key)
+		}
+		if _, exists := names[name]; exists {
+			return fmt.Errorf("duplicate name %s in key %s", name, key)
+		}
+		names[name] = struct{}{}
+	}
+	return nil
+}
+
 //BlueprintLoader constructor.
 func newBlueprintLoader(filepath string) (*blueprintLoader, error) {
 	loader := &blueprintLoader{}
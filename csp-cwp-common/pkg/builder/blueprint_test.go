@@ -392,6 +392,538 @@ queryRelations:
 	require.Error(suite.T(), err, "loaded blueprint with missing query type")
 }
 
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidRelationTimeout() {
+	for _, timeout := range []string{"soon", "-1s", "0s"} {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  timeout: ` + timeout + `
+`
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with relation timeout %s", timeout)
+	}
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__DuplicateRelation() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	_, err = newBlueprintLoader(file.Name())
+	require.Error(suite.T(), err, "loaded blueprint with duplicate event relation")
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidBalancing() {
+	for _, balancing := range []string{"random", "consistentHash"} {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+- name: Instance3
+  type: Type2
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  balancing: ` + balancing + `
+- source: Instance1
+  destination: Instance3
+  queryType: DummyQueryType
+  balancing: roundRobin
+`
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with balancing %s", balancing)
+	}
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__RemoteInstances() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance2
+  address: localhost:9000
+- name: Instance3
+  address: localhost:9001
+  transport: grpc
+  tls: true
+  serverName: agent
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+queryRelations:
+- source: Instance1
+  destination: Instance3
+  queryType: DummyQueryType
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	loader, err := newBlueprintLoader(file.Name())
+	require.NoError(suite.T(), err, "failed to load blueprint: %s", err)
+	require.Equal(suite.T(), 2, len(loader.remoteInstances))
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidRemoteInstances() {
+	layouts := map[string]string{
+		"missing address": `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance2
+`,
+		"duplicate local name": `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance1
+  address: localhost:9000
+`,
+		"unsupported transport": `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance2
+  address: localhost:9000
+  transport: http
+`,
+		"invalid tls": `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance2
+  address: localhost:9000
+  tls: maybe
+`,
+		"certificate without key": `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance2
+  address: localhost:9000
+  tls: true
+  certFile: client.crt
+`,
+		"tls settings without tls": `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance2
+  address: localhost:9000
+  caFile: ca.crt
+`,
+		"tls settings with disabled tls": `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance2
+  address: localhost:9000
+  tls: false
+  serverName: agent
+`,
+		"remote source": `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance2
+  address: localhost:9000
+eventRelations:
+- source: Instance2
+  destination: Instance1
+  eventType: DummyEventType
+`,
+	}
+	for name, layout := range layouts {
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with %s", name)
+	}
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidInterceptors() {
+	for _, interceptors := range []string{"first,", "first, first"} {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  interceptors: ` + interceptors + `
+`
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with interceptors %s", interceptors)
+	}
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidRetry() {
+	for _, settings := range []string{
+		"retryAttempts: 0",
+		"retryBackoff: soon",
+		"retryMultiplier: 0.5",
+		"retryJitter: 2",
+		"deadLetter: Instance3",
+		"deadLetter: 'file:'",
+	} {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  ` + settings + `
+`
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with %s", settings)
+	}
+
+	//Dead letter is only supported for events
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  deadLetter: Instance1
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	_, err = newBlueprintLoader(file.Name())
+	require.Error(suite.T(), err, "loaded blueprint with query dead letter")
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidPersistence() {
+	for _, settings := range []string{
+		"persistentMaxAge: 1h",
+		"persistentDir: ''",
+		"persistentDir: /tmp/wal\n  persistentMaxBytes: 0",
+		"persistentDir: /tmp/wal\n  persistentMaxAge: soon",
+		"persistentDir: /tmp/wal\n  persistentSync: maybe",
+		"persistentDir: /tmp/wal\n  batchSize: 10",
+		"persistentDir: /tmp/wal\n- source: Instance2\n  destination: Instance1\n  eventType: DummyEventType\n  persistentDir: /tmp/wal",
+	} {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  ` + settings + `
+`
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with %s", settings)
+	}
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidCircuit() {
+	for _, settings := range []string{
+		"circuitFailureRatio: 0",
+		"circuitFailureRatio: 1.5",
+		"circuitMinRequests: 0",
+		"circuitProbes: some",
+		"circuitCoolDown: -1s",
+		"circuitLatency: slow",
+	} {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  ` + settings + `
+`
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with %s", settings)
+	}
+
+	//Circuit breaker is only supported for queries
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  circuitCoolDown: 1s
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	_, err = newBlueprintLoader(file.Name())
+	require.Error(suite.T(), err, "loaded blueprint with event circuit breaker")
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidCache() {
+	layouts := map[string]string{
+		"zero ttl":             "cacheTTL: 0s",
+		"invalid max entries":  "cacheTTL: 1m\n  cacheMaxEntries: none",
+		"invalid error ttl":    "cacheTTL: 1m\n  cacheErrorTTL: never",
+		"max entries only":     "cacheMaxEntries: 10",
+		"conflicting replicas": "cacheTTL: 1m\n- source: Instance1\n  destination: Instance3\n  queryType: DummyQueryType\n  cacheTTL: 2m",
+	}
+	for name, settings := range layouts {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+- name: Instance3
+  type: Type2
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  ` + settings + `
+`
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with %s", name)
+	}
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidRateLimit() {
+	layouts := map[string]string{
+		"zero rate": `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  rateLimit: 0
+`,
+		"burst without rate": `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  rateBurst: 10
+`,
+		"invalid burst": `
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  rateLimit: 100
+  rateBurst: 0
+`,
+		"sample rate above one": `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  sampleRate: 1.5
+`,
+		"unknown sampling": `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  sampleRate: 0.1
+  sampling: sometimes
+`,
+		"query sampling": `
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  sampleRate: 0.1
+`,
+	}
+	for name, relations := range layouts {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+` + relations
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with %s", name)
+	}
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidBatching() {
+	layouts := map[string]string{
+		"zero batch size": `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  batchSize: 0
+`,
+		"invalid batch bytes": `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  batchBytes: 1MB
+`,
+		"invalid linger": `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  batchLinger: -1s
+`,
+		"query batching": `
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  batchSize: 10
+`,
+	}
+	for name, relations := range layouts {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+` + relations
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with %s", name)
+	}
+}
+
+func (suite *BlueprintLoaderTestSuite) TestBlueprintLoader__InvalidFilter() {
+	layouts := map[string]string{
+		"syntax error": `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  filter: Dummy.Info ==
+`,
+		"unknown field": `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  filter: Dummy.Size > 1
+`,
+		"query filter": `
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  filter: Dummy.Info == "disk"
+`,
+	}
+	for name, relations := range layouts {
+		layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+` + relations
+		file, err := createTemporaryFile([]byte(layout))
+		require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+		defer os.Remove(file.Name())
+
+		_, err = newBlueprintLoader(file.Name())
+		require.Error(suite.T(), err, "loaded blueprint with %s", name)
+	}
+}
+
 //Helper function for creating a temporary file with specific contents
 func createTemporaryFile(content []byte) (*os.File, error) {
 	file, err := ioutil.TempFile("", "blueprint_")
@@ -1,20 +1,143 @@
 package builder
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/rapid7/csp-cwp-common/pkg/agent_libraries/logger"
 	"github.com/rapid7/csp-cwp-common/pkg/processor"
 	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+	"github.com/rapid7/csp-cwp-common/pkg/transport"
 
 	omap "github.com/elliotchance/orderedmap"
+	opentracing "github.com/opentracing/opentracing-go"
+	metrics "github.com/rcrowley/go-metrics"
 )
 
 type ProcessorInfo struct {
+	//Instance name and type on the blueprint.
+	name     string
+	typeName string
+	//Guards the instance, which is replaced when it is restarted.
+	lock sync.RWMutex
 	//ServiceInterface extends ProcessorInterface so both can be mapped to base type.
 	instance processor.ProcessorInterface
-	//TODO: keep additional remote information here as well.
+	//Egress sinks added to the instance, added again to the instance replacing it on restart.
+	eventSinks map[proto.EventType]processor.SinkInterface
+	querySinks map[proto.QueryType]processor.SinkInterface
+	//Stamps the envelope header of the instance emitted events.
+	enveloper *processor.EventEnveloper
+	//Tracks the instance state across the Builder Run and Shutdown calls.
+	lifecycle *processor.Lifecycle
 }
 
+//Get the instance name
+func (info *ProcessorInfo) Name() string {
+	return info.name
+}
+
+//Get the processor or service instance
+func (info *ProcessorInfo) Instance() processor.ProcessorInterface {
+	info.lock.RLock()
+	defer info.lock.RUnlock()
+	return info.instance
+}
+
+//Get the instance lifecycle state
+func (info *ProcessorInfo) State() processor.LifecycleState {
+	return info.lifecycle.State()
+}
+
+//Subscribe listener to the instance state changes:
+//Return function for unsubscribing it.
+func (info *ProcessorInfo) Subscribe(listener processor.LifecycleListener) func() {
+	return info.lifecycle.Subscribe(listener)
+}
+
+//Private method for running the instance unless already running:
+//A concurrent run or shutdown of the instance is waited for first.
+func (info *ProcessorInfo) run() error {
+	for {
+		from := info.lifecycle.Settle()
+		if from == processor.LifecycleRunning {
+			return nil
+		}
+		err := info.lifecycle.TransitionFrom(from, processor.LifecycleStarting)
+		if err == nil {
+			break
+		}
+		//Settle again if the state was changed concurrently
+		if info.lifecycle.State() == from {
+			return fmt.Errorf("failed to run instance %s: %s", info.name, err)
+		}
+	}
+	if err := info.Instance().Run(); err != nil {
+		_ = info.lifecycle.Transition(processor.LifecycleFailed)
+		return err
+	}
+	return info.lifecycle.Transition(processor.LifecycleRunning)
+}
+
+//Private method for shutting down the instance if it was run, even if it failed:
+//A concurrent run or shutdown of the instance is waited for first.
+func (info *ProcessorInfo) shutdown() error {
+	for {
+		from := info.lifecycle.Settle()
+		switch from {
+		case processor.LifecycleRunning, processor.LifecycleFailed:
+		default:
+			return nil
+		}
+		err := info.lifecycle.TransitionFrom(from, processor.LifecycleStopping)
+		if err == nil {
+			break
+		}
+		//Settle again if the state was changed concurrently
+		if info.lifecycle.State() == from {
+			return fmt.Errorf("failed to shutdown instance %s: %s", info.name, err)
+		}
+	}
+	if err := info.Instance().Shutdown(); err != nil {
+		_ = info.lifecycle.Transition(processor.LifecycleFailed)
+		return err
+	}
+	return info.lifecycle.Transition(processor.LifecycleStopped)
+}
+
+//Private method for marking the instance failed while running, unless it was already replaced
+func (info *ProcessorInfo) fail(instance processor.ProcessorInterface) {
+	if info.Instance() != instance {
+		return
+	}
+	_ = info.lifecycle.TransitionFrom(processor.LifecycleRunning, processor.LifecycleFailed)
+}
+
+//Private method for adding an egress event sink to the instance
+func (info *ProcessorInfo) addEventSink(eventType proto.EventType, sink processor.SinkInterface) error {
+	if err := info.Instance().AddEventSink(eventType, sink); err != nil {
+		return err
+	}
+	info.eventSinks[eventType] = sink
+	return nil
+}
+
+//Private method for adding an egress query sink to the instance
+func (info *ProcessorInfo) addQuerySink(queryType proto.QueryType, sink processor.SinkInterface) error {
+	if err := info.Instance().AddQuerySink(queryType, sink); err != nil {
+		return err
+	}
+	info.querySinks[queryType] = sink
+	return nil
+}
+
+//Listener of the state changes of all the Builder instances
+type StateListener func(name string, from processor.LifecycleState, to processor.LifecycleState)
+
 //Definition of the main processors builder:
 //This entity should know how to instantiate all the system Processors and Services
 //along with their Event and Query relations given a blueprint mapping.
@@ -25,7 +148,35 @@ type Builder struct {
 	constructors map[string]*constructor
 	//Track instances information in order of creation in case the startup order is important.
 	localInstances *omap.OrderedMap
-	//TODO: support remote instances
+	//Guards the instances map against readers outside the Builder (as for health checks) while the mesh is created.
+	instancesLock sync.RWMutex
+	//Mapping from a remote instance name to its connection information.
+	remoteInstances map[string]*remoteInfo
+	//Interceptors applied on all relations, in order of addition.
+	eventInterceptors []processor.EventInterceptor
+	queryInterceptors []processor.QueryInterceptor
+	//Mapping from an interceptor name to an interceptor applied on the relations listing it.
+	namedEventInterceptors map[string]processor.EventInterceptor
+	namedQueryInterceptors map[string]processor.QueryInterceptor
+	//Mapping from a dead letter file path to the dead letter destination appending to it.
+	deadLetterFiles map[string]*processor.FileDeadLetter
+	//Persistent sinks of the relations, closed before the processors are shut down.
+	persistentSinks []*processor.PersistentSink
+	//Batching sinks of the relations, flushed before the pending calls are abandoned.
+	batchingSinks []*batchingRelation
+	//Tracer of the relations calls, nil for the global tracer.
+	tracer opentracing.Tracer
+	//Logger of the relations components, nil for no logging.
+	logger logger.Logger
+	//Registry of the relations metrics, along with mapping from a relation name to its metrics.
+	metrics         metrics.Registry
+	relationMetrics map[string]*processor.RelationMetrics
+	//Listeners subscribed to the state changes of every instance, in order of subscription.
+	stateListeners []StateListener
+
+	//Base context of all the mesh sinks, cancelled on Shutdown to abandon pending calls.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 //Add processor constructor to builder's constructors map:
@@ -42,10 +193,96 @@ func (b *Builder) AddConstructor(typeName string, creator Creator, params ...Par
 	return nil
 }
 
-//Clear the mesh and constructors map.
+//Add event interceptor applied on all event relations:
+//Global interceptors are called in order of addition, before the relation interceptors.
+func (b *Builder) AddEventInterceptor(interceptor processor.EventInterceptor) {
+	b.eventInterceptors = append(b.eventInterceptors, interceptor)
+}
+
+//Add query interceptor applied on all query relations:
+//Global interceptors are called in order of addition, before the relation interceptors.
+func (b *Builder) AddQueryInterceptor(interceptor processor.QueryInterceptor) {
+	b.queryInterceptors = append(b.queryInterceptors, interceptor)
+}
+
+//Add named event interceptor:
+//It is applied on the event relations listing its name in their interceptors key.
+func (b *Builder) AddNamedEventInterceptor(name string, interceptor processor.EventInterceptor) error {
+	if _, exists := b.namedEventInterceptors[name]; exists {
+		return fmt.Errorf("event interceptor %s already exists", name)
+	}
+	b.namedEventInterceptors[name] = interceptor
+	return nil
+}
+
+//Add named query interceptor:
+//It is applied on the query relations listing its name in their interceptors key.
+func (b *Builder) AddNamedQueryInterceptor(name string, interceptor processor.QueryInterceptor) error {
+	if _, exists := b.namedQueryInterceptors[name]; exists {
+		return fmt.Errorf("query interceptor %s already exists", name)
+	}
+	b.namedQueryInterceptors[name] = interceptor
+	return nil
+}
+
+//Set the tracer of the relations calls:
+//Each call is traced by a span on the source side and on the destination side, with the
+//span context carried by the event header or the query. The global tracer is used by default.
+func (b *Builder) SetTracer(tracer opentracing.Tracer) {
+	b.tracer = tracer
+}
+
+//Set the logger of the relations components, as the circuit breakers state changes.
+func (b *Builder) SetLogger(logger logger.Logger) {
+	b.logger = logger
+}
+
+//Get the registry of the mesh relations metrics:
+//Metrics are registered as <source>-><destination>:<type>.<metric>, and the query caches
+//metrics as <source>:<query type>.<metric>.
+func (b *Builder) GetMetricsRegistry() metrics.Registry {
+	return b.metrics
+}
+
+//Get snapshot of the mesh relations metrics mapped by relation name,
+//as <source>-><destination>:<type>.
+func (b *Builder) GetRelationMetrics() map[string]processor.RelationSnapshot {
+	snapshots := make(map[string]processor.RelationSnapshot, len(b.relationMetrics))
+	for name, relationMetrics := range b.relationMetrics {
+		snapshots[name] = relationMetrics.Snapshot()
+	}
+	return snapshots
+}
+
+//Clear the mesh, constructors map and interceptors.
 func (b *Builder) Clear() {
 	b.clearMesh()
 	b.constructors = make(map[string]*constructor)
+	b.eventInterceptors = nil
+	b.queryInterceptors = nil
+	b.namedEventInterceptors = make(map[string]processor.EventInterceptor)
+	b.namedQueryInterceptors = make(map[string]processor.QueryInterceptor)
+	b.stateListeners = nil
+}
+
+//Subscribe listener to the state changes of all the instances, including those created later:
+//The listener is called with the instance lifecycle lock held, so it should not block.
+func (b *Builder) SubscribeStateChanges(listener StateListener) {
+	b.stateListeners = append(b.stateListeners, listener)
+	for iter := b.GetProcessorsIterator(); iter != nil; iter = iter.Next() {
+		if info, err := iter.Current(); err == nil {
+			info.Subscribe(instanceStateListener(info.name, listener))
+		}
+	}
+}
+
+//Get the lifecycle state of an instance
+func (b *Builder) GetProcessorState(name string) (processor.LifecycleState, error) {
+	info, err := b.getProcessorInfo(name)
+	if err != nil {
+		return processor.LifecycleFailed, err
+	}
+	return info.State(), nil
 }
 
 //Create and run the processors in same order as they were listed on blueprint.
@@ -63,6 +300,7 @@ func (b *Builder) Run() []error {
 	}
 
 	//Create the processors mesh and cleanup on error
+	b.ctx, b.cancel = context.WithCancel(context.Background())
 	if err := b.createProcessorsMesh(); err != nil {
 		b.clearMesh()
 		return []error{
@@ -75,7 +313,7 @@ func (b *Builder) Run() []error {
 	for entry := b.localInstances.Front(); entry != nil; entry = entry.Next() {
 		if info, ok := (entry.Value).(*ProcessorInfo); !ok {
 			errors = append(errors, fmt.Errorf("unexpected processor info entry in instances map"))
-		} else if err := info.instance.Run(); err != nil {
+		} else if err := info.run(); err != nil {
 			errors = append(errors, err)
 		}
 	}
@@ -83,21 +321,70 @@ func (b *Builder) Run() []error {
 }
 
 //Shutdown the processors in their reverse startup order.
+//The pending batches of the batching relations are delivered first, then pending event and
+//query calls between the processors are abandoned, and the persistent relations stop
+//delivering, keeping their undelivered events for the next run.
+//The remote instances connections and dead letter files are closed last.
+//Instances which were not run or were already shut down are skipped, so shutting down
+//the mesh again is a no-op.
 //Return list of encountered errors.
 func (b *Builder) Shutdown() []error {
-	errors := []error{}
+	errors := b.closeBatchingSinks()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	errors = append(errors, b.closePersistentSinks()...)
 	for entry := b.localInstances.Back(); entry != nil; entry = entry.Prev() {
 		if info, ok := (entry.Value).(*ProcessorInfo); !ok {
 			errors = append(errors, fmt.Errorf("unexpected processor info entry in instances map"))
-		} else if err := info.instance.Shutdown(); err != nil {
+		} else if err := info.shutdown(); err != nil {
 			errors = append(errors, err)
 		}
 	}
-	return errors
+	errors = append(errors, b.closeRemoteInstances()...)
+	return append(errors, b.closeDeadLetterFiles()...)
+}
+
+//Run a single instance of the running mesh (as one which failed to run):
+//A no-op for a running instance.
+func (b *Builder) RunProcessor(name string) error {
+	info, err := b.getProcessorInfo(name)
+	if err != nil {
+		return err
+	}
+	if b.ctx.Err() != nil {
+		return fmt.Errorf("mesh was already shut down")
+	}
+	return info.run()
+}
+
+//Shutdown a single instance of the mesh, leaving its relations in place:
+//A no-op for an instance which was not run or was already shut down.
+func (b *Builder) ShutdownProcessor(name string) error {
+	info, err := b.getProcessorInfo(name)
+	if err != nil {
+		return err
+	}
+	return info.shutdown()
+}
+
+//Expose the local processors taps on a transport server under their instance names,
+//so they can be used as remote instances by the blueprints of other agent processes.
+func (b *Builder) RegisterTaps(server *transport.GrpcServer) error {
+	for iter := b.GetProcessorsIterator(); iter != nil; iter = iter.Next() {
+		info, err := iter.Current()
+		if err != nil {
+			return err
+		}
+		name := iter.current.Key.(string)
+		if err := server.AddTap(name, processor.NewTracingTap(b.tracer, name, newInstanceTap(info))); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //Create the processors mesh from the read blueprint.
-//TODO: support remote processors.
 func (b *Builder) createProcessorsMesh() error {
 	//Create the local Processor instances
 	for _, info := range b.loader.localInstances {
@@ -106,18 +393,57 @@ func (b *Builder) createProcessorsMesh() error {
 		}
 	}
 
-	//Create event relations
+	//Connect the remote instances
+	for _, info := range b.loader.remoteInstances {
+		remote, err := dialRemoteInstance(info)
+		if err != nil {
+			return err
+		}
+		b.remoteInstances[info["name"]] = remote
+	}
+
+	//Create event relations:
+	//Relations of the same source and event type are grouped so the source events are
+	//delivered to all of their destinations.
+	groups := omap.NewOrderedMap()
 	for _, relation := range b.loader.eventRelations {
-		eventType := proto.EventType_value[relation["eventType"]]
-		if err := b.addEventRelation(relation["source"], relation["destination"], proto.EventType(eventType)); err != nil {
+		eventType := proto.EventType(proto.EventType_value[relation["eventType"]])
+		key := eventGroupKey{
+			source:    relation["source"],
+			eventType: eventType,
+		}
+		relations, exists := groups.Get(key)
+		if !exists {
+			relations = []map[string]string{}
+		}
+		groups.Set(key, append(relations.([]map[string]string), relation))
+	}
+	for entry := groups.Front(); entry != nil; entry = entry.Next() {
+		key := entry.Key.(eventGroupKey)
+		if err := b.addEventRelations(key.source, key.eventType, entry.Value.([]map[string]string)); err != nil {
 			return err
 		}
 	}
 
-	//Create query relations
+	//Create query relations:
+	//Relations of the same source and query type are grouped so the source queries are
+	//balanced between their destinations.
+	groups = omap.NewOrderedMap()
 	for _, relation := range b.loader.queryRelations {
-		queryType := proto.QueryType_value[relation["queryType"]]
-		if err := b.addQueryRelation(relation["source"], relation["destination"], proto.QueryType(queryType)); err != nil {
+		queryType := proto.QueryType(proto.QueryType_value[relation["queryType"]])
+		key := queryGroupKey{
+			source:    relation["source"],
+			queryType: queryType,
+		}
+		relations, exists := groups.Get(key)
+		if !exists {
+			relations = []map[string]string{}
+		}
+		groups.Set(key, append(relations.([]map[string]string), relation))
+	}
+	for entry := groups.Front(); entry != nil; entry = entry.Next() {
+		key := entry.Key.(queryGroupKey)
+		if err := b.addQueryRelations(key.source, key.queryType, entry.Value.([]map[string]string)); err != nil {
 			return err
 		}
 	}
@@ -139,17 +465,150 @@ func (b *Builder) createProcessor(typeName string, name string) error {
 	if err != nil {
 		return fmt.Errorf("creation of instance (%s, %s) failed: %s", typeName, name, err)
 	}
-	b.localInstances.Set(name, &ProcessorInfo{
-		instance: instance,
-	})
+	info := &ProcessorInfo{
+		name:       name,
+		typeName:   typeName,
+		instance:   instance,
+		eventSinks: make(map[proto.EventType]processor.SinkInterface),
+		querySinks: make(map[proto.QueryType]processor.SinkInterface),
+		enveloper:  processor.NewEventEnveloper(name),
+		lifecycle:  processor.NewLifecycle(),
+	}
+	for _, listener := range b.stateListeners {
+		info.Subscribe(instanceStateListener(name, listener))
+	}
+	b.handlePanics(info, instance)
+	b.instancesLock.Lock()
+	b.localInstances.Set(name, info)
+	b.instancesLock.Unlock()
 	return nil
 }
 
+//Handle the panics recovered by the ingress tap of an instance, if supported:
+//The panic is logged along with its stack trace, reporting it to Sentry if the logger is
+//configured to, and the instance is marked failed.
+func (b *Builder) handlePanics(info *ProcessorInfo, instance processor.ProcessorInterface) {
+	notifier, ok := instance.GetTap().(processor.PanicNotifier)
+	if !ok {
+		return
+	}
+	notifier.SetPanicHandler(func(err *processor.PanicError) {
+		if b.logger != nil {
+			b.logger.Errorf("instance %s failed: %s\n%s", info.name, err, err.Stack)
+		}
+		info.fail(instance)
+	})
+}
+
+//Bind a Builder state listener to an instance
+func instanceStateListener(name string, listener StateListener) processor.LifecycleListener {
+	return func(from processor.LifecycleState, to processor.LifecycleState) {
+		listener(name, from, to)
+	}
+}
+
 //Clear the existing mesh
 func (b *Builder) clearMesh() {
+	_ = b.closeBatchingSinks()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.instancesLock.Lock()
 	for _, key := range b.localInstances.Keys() {
 		b.localInstances.Delete(key)
 	}
+	b.instancesLock.Unlock()
+	_ = b.closePersistentSinks()
+	_ = b.closeRemoteInstances()
+	_ = b.closeDeadLetterFiles()
+	b.metrics.UnregisterAll()
+	b.relationMetrics = make(map[string]*processor.RelationMetrics)
+}
+
+//Close the remote instances connections
+func (b *Builder) closeRemoteInstances() []error {
+	errors := []error{}
+	for name, remote := range b.remoteInstances {
+		if err := remote.conn.Close(); err != nil {
+			errors = append(errors, fmt.Errorf("failed to close remote instance %s: %s", name, err))
+		}
+		delete(b.remoteInstances, name)
+	}
+	return errors
+}
+
+//Close the dead letter files
+func (b *Builder) closeDeadLetterFiles() []error {
+	errors := []error{}
+	for path, deadLetter := range b.deadLetterFiles {
+		if err := deadLetter.Close(); err != nil {
+			errors = append(errors, fmt.Errorf("failed to close dead letter file %s: %s", path, err))
+		}
+		delete(b.deadLetterFiles, path)
+	}
+	return errors
+}
+
+//Close the persistent sinks
+func (b *Builder) closePersistentSinks() []error {
+	errors := []error{}
+	for _, sink := range b.persistentSinks {
+		if err := sink.Close(); err != nil {
+			errors = append(errors, fmt.Errorf("failed to close persistent sink: %s", err))
+		}
+	}
+	b.persistentSinks = nil
+	return errors
+}
+
+//Time the pending batch of a relation with no timeout is delivered for on shutdown
+const defaultFlushTimeout = 5 * time.Second
+
+//Batching sink of a relation, along with the relation timeout bounding its last delivery
+type batchingRelation struct {
+	sink    *processor.BatchingSink
+	timeout time.Duration
+}
+
+//Deliver the pending batches of the batching sinks and close them:
+//Each delivery is bounded by the relation timeout, or by defaultFlushTimeout if not set, so
+//a hanging destination does not hold up the shutdown.
+func (b *Builder) closeBatchingSinks() []error {
+	errors := []error{}
+	for _, batching := range b.batchingSinks {
+		timeout := batching.timeout
+		if timeout == 0 {
+			timeout = defaultFlushTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := batching.sink.Close(ctx); err != nil {
+			errors = append(errors, fmt.Errorf("failed to close batching sink: %s", err))
+		}
+		cancel()
+	}
+	b.batchingSinks = nil
+	return errors
+}
+
+//Create a sink to a relation destination, either local or remote:
+//ctx is the base context of the calls, the mesh context unless the calls are bounded otherwise.
+//Return the sink along with the destination readiness check.
+func (b *Builder) createSink(ctx context.Context, srcName string, dstName string, typeName string, timeout time.Duration) (processor.SinkInterface, func() bool, error) {
+	var sink processor.SinkInterface
+	var isReady func() bool
+	if remote, exists := b.remoteInstances[dstName]; exists {
+		sink, isReady = transport.NewGrpcSinkWithContext(ctx, remote.conn, dstName, timeout), remote.isReady
+	} else {
+		dstInfo, err := b.getProcessorInfo(dstName)
+		if err != nil {
+			return nil, nil, err
+		}
+		//The tap and readiness follow the destination instance across its restarts
+		tap := processor.NewTracingTap(b.tracer, dstName, newInstanceTap(dstInfo))
+		sink = processor.NewSinkWithContext(ctx, tap, timeout)
+		isReady = func() bool { return dstInfo.Instance().IsReady() }
+	}
+	return processor.NewTracingSink(b.tracer, processor.RelationName(srcName, dstName, typeName), sink), isReady, nil
 }
 
 //Get entry from instances map
@@ -165,51 +624,550 @@ func (b *Builder) getProcessorInfo(name string) (*ProcessorInfo, error) {
 	return info, nil
 }
 
-//Add event relation:
-//A sink for a tap of dest processor is added to event types map of source processor
-func (b *Builder) addEventRelation(srcName string, dstName string, eventType proto.EventType) error {
+//Key of event relations group of the same source and event type
+type eventGroupKey struct {
+	source    string
+	eventType proto.EventType
+}
+
+//Add event relations of a source processor for a single event type:
+//A sink for a tap of each dest processor is added to event types map of source processor.
+//Multiple destinations are added through a single multicast sink, each receiving the events
+//matching its relation filter, if any.
+//The added sink stamps the envelope header of the events before they are delivered.
+func (b *Builder) addEventRelations(srcName string, eventType proto.EventType, relations []map[string]string) error {
 	srcInfo, err := b.getProcessorInfo(srcName)
 	if err != nil {
 		return err
 	}
-	dstInfo, err := b.getProcessorInfo(dstName)
-	if err != nil {
-		return err
+	multicast := processor.NewMulticastSink()
+	for _, relation := range relations {
+		dstName := relation["destination"]
+		timeout, err := relationTimeout(relation)
+		if err != nil {
+			return err
+		}
+		sink, _, err := b.createSink(b.ctx, srcName, dstName, eventType.String(), timeout)
+		if err != nil {
+			return err
+		}
+		if sink, err = b.interceptEvents(relation, sink); err != nil {
+			return err
+		}
+		if sink, err = b.measure(processor.RelationName(srcName, dstName, eventType.String()), sink); err != nil {
+			return err
+		}
+		if sink, err = b.retry(srcName, processor.RelationName(srcName, dstName, eventType.String()), relation, sink); err != nil {
+			return err
+		}
+		if sink, err = b.batch(relation, sink); err != nil {
+			return err
+		}
+		if sink, err = b.persist(relation, sink); err != nil {
+			return err
+		}
+		if sink, err = b.limitRate(processor.RelationName(srcName, dstName, eventType.String()), relation, sink); err != nil {
+			return err
+		}
+		if sink, err = b.sample(processor.RelationName(srcName, dstName, eventType.String()), relation, sink); err != nil {
+			return err
+		}
+		if expression, exists := relation["filter"]; exists {
+			filter, err := processor.CompileFilter(expression)
+			if err != nil {
+				return err
+			}
+			sink = processor.NewFilterSink(filter, sink)
+		}
+		if len(relations) == 1 {
+			return srcInfo.addEventSink(eventType, processor.NewEnvelopeSink(srcInfo.enveloper, sink))
+		}
+		if err := multicast.AddDestination(dstName, sink); err != nil {
+			return err
+		}
 	}
-	sink := processor.NewSink(dstInfo.instance.GetTap())
-	err = srcInfo.instance.AddEventSink(eventType, sink)
-	return err
+	return srcInfo.addEventSink(eventType, processor.NewEnvelopeSink(srcInfo.enveloper, multicast))
 }
 
-//Add query relation:
-//A sink for a tap of dest service is added to query types map of source processor
-func (b *Builder) addQueryRelation(srcName string, dstName string, queryType proto.QueryType) error {
+//Key of query relations group of the same source and query type
+type queryGroupKey struct {
+	source    string
+	queryType proto.QueryType
+}
+
+//Add query relations of a source processor for a single query type:
+//A sink for a tap of dest service is added to query types map of source processor.
+//Multiple destinations are added as replicas of a single balanced sink, skipping
+//the replicas which are not ready.
+func (b *Builder) addQueryRelations(srcName string, queryType proto.QueryType, relations []map[string]string) error {
 	srcInfo, err := b.getProcessorInfo(srcName)
 	if err != nil {
 		return err
 	}
-	dstInfo, err := b.getProcessorInfo(dstName)
+	strategy := processor.BalanceRoundRobin
+	if name := relations[0]["balancing"]; name != "" {
+		if strategy, err = processor.ParseBalancingStrategy(name); err != nil {
+			return err
+		}
+	}
+	balanced := processor.NewBalancedSink(strategy)
+	for _, relation := range relations {
+		dstName := relation["destination"]
+		//Local destinations are checked to be services, remote ones are checked by their host
+		if dstInfo, err := b.getProcessorInfo(dstName); err == nil {
+			if _, ok := (dstInfo.Instance()).(processor.ServiceInterface); !ok {
+				return fmt.Errorf("destination must implement ServiceInterface in order to serve queries")
+			}
+		}
+		timeout, err := relationTimeout(relation)
+		if err != nil {
+			return err
+		}
+		sink, isReady, err := b.createSink(b.ctx, srcName, dstName, queryType.String(), timeout)
+		if err != nil {
+			return err
+		}
+		if sink, err = b.interceptQueries(relation, sink); err != nil {
+			return err
+		}
+		if sink, err = b.measure(processor.RelationName(srcName, dstName, queryType.String()), sink); err != nil {
+			return err
+		}
+		if sink, isReady, err = b.breakCircuit(srcInfo, processor.RelationName(srcName, dstName, queryType.String()), relation, sink, isReady); err != nil {
+			return err
+		}
+		if sink, err = b.retry(srcName, processor.RelationName(srcName, dstName, queryType.String()), relation, sink); err != nil {
+			return err
+		}
+		if sink, err = b.limitRate(processor.RelationName(srcName, dstName, queryType.String()), relation, sink); err != nil {
+			return err
+		}
+		if len(relations) == 1 {
+			return b.addQuerySink(srcInfo, srcName, queryType, relation, sink)
+		}
+		if err := balanced.AddReplica(dstName, sink, isReady); err != nil {
+			return err
+		}
+	}
+	return b.addQuerySink(srcInfo, srcName, queryType, relations[0], balanced)
+}
+
+//Add the query sink of a source processor for a single query type, answering the queries
+//from a cache shared by all the destinations if set by the relations
+func (b *Builder) addQuerySink(srcInfo *ProcessorInfo, srcName string, queryType proto.QueryType, relation map[string]string, sink processor.SinkInterface) error {
+	params, err := relationCacheParams(relation)
 	if err != nil {
 		return err
 	}
-	if _, ok := (dstInfo.instance).(processor.ServiceInterface); !ok {
-		return fmt.Errorf("destination must implement ServiceInterface in order to serve queries")
+	if params != nil {
+		params.Metrics = processor.GetOrRegisterQueryCacheMetrics(b.metrics, srcName+":"+queryType.String())
+		cache, err := processor.NewQueryCache(*params)
+		if err != nil {
+			return err
+		}
+		sink = processor.NewCachingSink(cache, sink)
+	}
+	return srcInfo.addQuerySink(queryType, sink)
+}
+
+//Wrap event relation sink with the global and relation interceptors
+func (b *Builder) interceptEvents(relation map[string]string, sink processor.SinkInterface) (processor.SinkInterface, error) {
+	interceptors := append([]processor.EventInterceptor{}, b.eventInterceptors...)
+	for _, name := range relationInterceptors(relation) {
+		interceptor, exists := b.namedEventInterceptors[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown event interceptor %s", name)
+		}
+		interceptors = append(interceptors, interceptor)
+	}
+	if len(interceptors) == 0 {
+		return sink, nil
+	}
+	return processor.NewInterceptedSink(sink, interceptors, nil), nil
+}
+
+//Wrap query relation sink with the global and relation interceptors
+func (b *Builder) interceptQueries(relation map[string]string, sink processor.SinkInterface) (processor.SinkInterface, error) {
+	interceptors := append([]processor.QueryInterceptor{}, b.queryInterceptors...)
+	for _, name := range relationInterceptors(relation) {
+		interceptor, exists := b.namedQueryInterceptors[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown query interceptor %s", name)
+		}
+		interceptors = append(interceptors, interceptor)
+	}
+	if len(interceptors) == 0 {
+		return sink, nil
+	}
+	return processor.NewInterceptedSink(sink, nil, interceptors), nil
+}
+
+//Wrap relation sink with recording of the relation metrics
+func (b *Builder) measure(relationName string, sink processor.SinkInterface) (processor.SinkInterface, error) {
+	relationMetrics, err := processor.GetOrRegisterRelationMetrics(b.metrics, relationName)
+	if err != nil {
+		return nil, err
+	}
+	b.relationMetrics[relationName] = relationMetrics
+	return processor.NewMetricsSink(relationMetrics, sink), nil
+}
+
+//Wrap relation sink with retries of the failed calls, if set by the relation:
+//Events which exhausted their attempts are passed to the relation dead letter destination.
+func (b *Builder) retry(srcName string, relationName string, relation map[string]string, sink processor.SinkInterface) (processor.SinkInterface, error) {
+	params, err := relationRetryParams(relation)
+	if err != nil || params == nil {
+		return sink, err
+	}
+	var deadLetter processor.DeadLetterInterface
+	if name, exists := relation["deadLetter"]; exists {
+		if deadLetter, err = b.createDeadLetter(srcName, name); err != nil {
+			return nil, err
+		}
+	}
+	return processor.NewRetrySink(sink, relationName, *params, deadLetter)
+}
+
+//Wrap query relation sink with a circuit breaker, if set by the relation:
+//The breaker state is reported on the source processor heartbeat, if supported, and the destination
+//is not considered ready by the balanced sink while its circuit is open.
+func (b *Builder) breakCircuit(srcInfo *ProcessorInfo, relationName string, relation map[string]string,
+	sink processor.SinkInterface, isReady func() bool) (processor.SinkInterface, func() bool, error) {
+	params, err := relationCircuitParams(relation)
+	if err != nil || params == nil {
+		return sink, isReady, err
+	}
+	params.Logger = b.logger
+	if _, ok := srcInfo.Instance().(processor.StatusReporter); ok {
+		params.Reporter = srcInfo
+	}
+	breaker, err := processor.NewCircuitBreakerSink(sink, relationName, *params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return breaker, func() bool { return isReady() && breaker.IsAvailable() }, nil
+}
+
+//Wrap event relation sink with batching of the events, if set by the relation
+func (b *Builder) batch(relation map[string]string, sink processor.SinkInterface) (processor.SinkInterface, error) {
+	params, err := relationBatchingParams(relation)
+	if err != nil || params == nil {
+		return sink, err
+	}
+	timeout, err := relationTimeout(relation)
+	if err != nil {
+		return nil, err
 	}
-	sink := processor.NewSink(dstInfo.instance.GetTap())
-	err = srcInfo.instance.AddQuerySink(queryType, sink)
-	return err
+	batching, err := processor.NewBatchingSink(sink, *params)
+	if err != nil {
+		return nil, err
+	}
+	b.batchingSinks = append(b.batchingSinks, &batchingRelation{
+		sink:    batching,
+		timeout: timeout,
+	})
+	return batching, nil
+}
+
+//Wrap relation sink with a write-ahead log, if set by the relation
+func (b *Builder) persist(relation map[string]string, sink processor.SinkInterface) (processor.SinkInterface, error) {
+	params, err := relationPersistentParams(relation)
+	if err != nil || params == nil {
+		return sink, err
+	}
+	persistent, err := processor.NewPersistentSink(sink, *params)
+	if err != nil {
+		return nil, err
+	}
+	b.persistentSinks = append(b.persistentSinks, persistent)
+	return persistent, nil
+}
+
+//Wrap relation sink with a token bucket rate limit, if set by the relation:
+//The calls beyond the limit are counted by the relation metrics.
+func (b *Builder) limitRate(relationName string, relation map[string]string, sink processor.SinkInterface) (processor.SinkInterface, error) {
+	value, exists := relation["rateLimit"]
+	if !exists {
+		return sink, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	//Burst defaults to a second worth of calls
+	burst := int(math.Ceil(rate))
+	if value, exists := relation["rateBurst"]; exists {
+		if burst, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	bucket, err := processor.NewTokenBucket(rate, burst)
+	if err != nil {
+		return nil, err
+	}
+	return processor.NewRateLimitSink(bucket, sink, b.relationMetrics[relationName].RateLimited), nil
+}
+
+//Wrap event relation sink with sampling of the events, if set by the relation:
+//The events left out of the sample are counted by the relation metrics.
+func (b *Builder) sample(relationName string, relation map[string]string, sink processor.SinkInterface) (processor.SinkInterface, error) {
+	value, exists := relation["sampleRate"]
+	if !exists {
+		return sink, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	mode := processor.SampleRandom
+	if name, exists := relation["sampling"]; exists {
+		if mode, err = processor.ParseSamplingMode(name); err != nil {
+			return nil, err
+		}
+	}
+	return processor.NewSamplingSink(rate, mode, sink, b.relationMetrics[relationName].SampledOut)
+}
+
+//Create dead letter destination, either a file:<path> or an instance name:
+//The dead letters pushed to an instance are stamped with the envelope header of the source,
+//as its other emitted events are.
+func (b *Builder) createDeadLetter(srcName string, name string) (processor.DeadLetterInterface, error) {
+	if path := strings.TrimPrefix(name, "file:"); path != name {
+		//Relations sharing a file share its dead letter destination
+		if deadLetter, exists := b.deadLetterFiles[path]; exists {
+			return deadLetter, nil
+		}
+		deadLetter, err := processor.NewFileDeadLetter(path)
+		if err != nil {
+			return nil, err
+		}
+		b.deadLetterFiles[path] = deadLetter
+		return deadLetter, nil
+	}
+	//Dead letters are bounded by the retry sink instead of the mesh context, so the events
+	//failing on shutdown are kept as well
+	srcInfo, err := b.getProcessorInfo(srcName)
+	if err != nil {
+		return nil, err
+	}
+	eventType := proto.EventType_DeadLetterEventType.String()
+	sink, _, err := b.createSink(context.Background(), srcName, name, eventType, 0)
+	if err != nil {
+		return nil, err
+	}
+	if sink, err = b.measure(processor.RelationName(srcName, name, eventType), sink); err != nil {
+		return nil, err
+	}
+	return processor.NewSinkDeadLetter(processor.NewEnvelopeSink(srcInfo.enveloper, sink)), nil
+}
+
+//Get the optional retries params of a relation, nil if the relation has no retries settings
+func relationRetryParams(relation map[string]string) (*processor.RetryParams, error) {
+	params := &processor.RetryParams{
+		Attempts: 1,
+	}
+	found := false
+	var err error
+	if value, exists := relation["retryAttempts"]; exists {
+		found = true
+		if params.Attempts, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["retryBackoff"]; exists {
+		found = true
+		if params.Backoff, err = time.ParseDuration(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["retryMaxBackoff"]; exists {
+		found = true
+		if params.MaxBackoff, err = time.ParseDuration(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["retryMultiplier"]; exists {
+		found = true
+		if params.Multiplier, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["retryJitter"]; exists {
+		found = true
+		if params.Jitter, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, err
+		}
+	}
+	if _, exists := relation["deadLetter"]; exists {
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	return params, nil
+}
+
+//Get the optional query cache params of a relation, nil if the relation results are not cached
+func relationCacheParams(relation map[string]string) (*processor.QueryCacheParams, error) {
+	value, exists := relation["cacheTTL"]
+	if !exists {
+		return nil, nil
+	}
+	params := &processor.QueryCacheParams{}
+	var err error
+	if params.TTL, err = time.ParseDuration(value); err != nil {
+		return nil, err
+	}
+	if value, exists := relation["cacheMaxEntries"]; exists {
+		if params.MaxEntries, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["cacheErrorTTL"]; exists {
+		if params.ErrorTTL, err = time.ParseDuration(value); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+//Get the optional circuit breaker params of a relation, nil if the relation has no circuit breaker settings
+func relationCircuitParams(relation map[string]string) (*processor.CircuitBreakerParams, error) {
+	params := &processor.CircuitBreakerParams{}
+	found := false
+	var err error
+	for key, duration := range map[string]*time.Duration{
+		"circuitWindow":   &params.Window,
+		"circuitLatency":  &params.LatencyThreshold,
+		"circuitCoolDown": &params.CoolDown,
+	} {
+		if value, exists := relation[key]; exists {
+			found = true
+			if *duration, err = time.ParseDuration(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if value, exists := relation["circuitMinRequests"]; exists {
+		found = true
+		if params.MinRequests, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["circuitProbes"]; exists {
+		found = true
+		if params.Probes, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["circuitFailureRatio"]; exists {
+		found = true
+		if params.FailureRatio, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return params, nil
+}
+
+//Get the optional batching params of a relation, nil if the relation does not batch its events
+func relationBatchingParams(relation map[string]string) (*processor.BatchingSinkParams, error) {
+	params := &processor.BatchingSinkParams{}
+	found := false
+	var err error
+	if value, exists := relation["batchSize"]; exists {
+		found = true
+		if params.MaxEvents, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["batchBytes"]; exists {
+		found = true
+		if params.MaxBytes, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["batchLinger"]; exists {
+		found = true
+		if params.Linger, err = time.ParseDuration(value); err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return params, nil
+}
+
+//Get the optional persistence params of a relation, nil if the relation is not persistent
+func relationPersistentParams(relation map[string]string) (*processor.PersistentSinkParams, error) {
+	dir, exists := relation["persistentDir"]
+	if !exists {
+		return nil, nil
+	}
+	params := &processor.PersistentSinkParams{
+		Dir: dir,
+	}
+	var err error
+	if value, exists := relation["persistentMaxBytes"]; exists {
+		if params.MaxBytes, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["persistentMaxAge"]; exists {
+		if params.MaxAge, err = time.ParseDuration(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, exists := relation["persistentSync"]; exists {
+		if params.SyncWrites, err = strconv.ParseBool(value); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+//Get the names of the optional interceptors of a relation
+func relationInterceptors(relation map[string]string) []string {
+	value, exists := relation["interceptors"]
+	if !exists {
+		return nil
+	}
+	names := strings.Split(value, ",")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	return names
+}
+
+//Get the optional call timeout of a relation, zero if not set
+func relationTimeout(relation map[string]string) (time.Duration, error) {
+	value, exists := relation["timeout"]
+	if !exists {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
 }
 
 //The builder constructor gets a yaml file as a blueprint.
-//TODO: support remote instances information.
 func NewBuilder(blueprintFile string) (*Builder, error) {
 	loader, err := newBlueprintLoader(blueprintFile)
 	if err != nil {
 		return nil, err
 	}
 	return &Builder{
-		loader:         loader,
-		constructors:   make(map[string]*constructor),
-		localInstances: omap.NewOrderedMap(),
+		loader:          loader,
+		constructors:    make(map[string]*constructor),
+		localInstances:  omap.NewOrderedMap(),
+		remoteInstances: make(map[string]*remoteInfo),
+
+		namedEventInterceptors: make(map[string]processor.EventInterceptor),
+		namedQueryInterceptors: make(map[string]processor.QueryInterceptor),
+
+		deadLetterFiles: make(map[string]*processor.FileDeadLetter),
+		metrics:         metrics.NewRegistry(),
+		relationMetrics: make(map[string]*processor.RelationMetrics),
 	}, nil
 }
@@ -1,15 +1,27 @@
 package builder
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/rapid7/csp-cwp-common/pkg/processor"
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+	"github.com/rapid7/csp-cwp-common/pkg/transport"
 
+	"github.com/opentracing/opentracing-go/mocktracer"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
@@ -423,7 +435,1324 @@ queryRelations:
 	require.NotZero(suite.T(), len(errors), "builder duplicate run call did not fail")
 }
 
+func (suite *BuilderTestSuite) TestBuilder__EventFanOut() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+- name: Instance3
+  type: Type3
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+- source: Instance1
+  destination: Instance3
+  eventType: DummyEventType
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+
+	//Instance1 sends the events to both Instance2 and Instance3
+	senderParams := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+		SendEvents:       prepareEvents(5),
+	}
+	receiver1Params := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	receiver2Params := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, senderParams)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestProcessor, receiver1Params)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type3", processor.NewTestProcessor, receiver2Params)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	//Build and run the mesh.
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	//Both destinations should get all the events
+	err = wait.Poll(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return len(receiver1Params.Processed()) == 5 && len(receiver2Params.Processed()) == 5, nil
+	})
+	require.NoError(suite.T(), err, "events were not delivered to all destinations: %s", err)
+
+	//Both destinations get the same envelope stamped by the source
+	received1, received2 := receiver1Params.Processed(), receiver2Params.Processed()
+	for i := range received1 {
+		header := received1[i].Header
+		require.NotNil(suite.T(), header, "event was not stamped")
+		require.Equal(suite.T(), "Instance1", header.Source)
+		require.Equal(suite.T(), uint64(i+1), header.Sequence)
+		require.Equal(suite.T(), header, received2[i].Header)
+	}
+}
+
+func (suite *BuilderTestSuite) TestBuilder__QueryBalancing() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+- name: Instance3
+  type: Type2
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  balancing: leastOutstanding
+- source: Instance1
+  destination: Instance3
+  queryType: DummyQueryType
+  balancing: leastOutstanding
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestService, &processor.TestServiceParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	//Build and run the mesh.
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	//Instance1 queries are balanced between the replicas
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	sink, err := source.GetQuerySink(proto.QueryType_DummyQueryType)
+	require.NoError(suite.T(), err, "failed to get query sink: %s", err)
+	require.IsType(suite.T(), &processor.BalancedSink{}, sink)
+
+	query := &proto.Query{
+		Type: proto.QueryType_DummyQueryType,
+		UUID: "query-uuid",
+		Info: &proto.Query_Dummy{
+			Dummy: &proto.DummyQuery{
+				Info: "Query",
+			},
+		},
+	}
+	result, err := sink.RunQuery(query)
+	require.NoError(suite.T(), err, "failed to run balanced query: %s", err)
+	require.Equal(suite.T(), query.UUID, result.UUID)
+
+	//No replica is ready after shutdown
+	builder.Shutdown()
+	_, err = sink.RunQuery(query)
+	require.Equal(suite.T(), processor.ErrNoReadyReplica, err)
+}
+
+func (suite *BuilderTestSuite) TestBuilder__RemoteInstance() {
+	//The remote agent process hosts Instance2 service
+	remoteLayout := `
+localInstances:
+- name: Instance2
+  type: Type2
+`
+	remoteFile, err := createTemporaryFile([]byte(remoteLayout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(remoteFile.Name())
+
+	remoteBuilder, err := NewBuilder(remoteFile.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	remoteParams := &processor.TestServiceParams{
+		LivenessInterval: time.Second,
+	}
+	err = remoteBuilder.AddConstructor("Type2", processor.NewTestService, remoteParams)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	errors := remoteBuilder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer remoteBuilder.Shutdown()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(suite.T(), err, "failed to listen: %s", err)
+	server := grpc.NewServer()
+	transportServer := transport.NewGrpcServer()
+	transportServer.Register(server)
+	require.NoError(suite.T(), remoteBuilder.RegisterTaps(transportServer), "failed to register taps")
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	//The local agent process sends events and queries to the remote Instance2
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+remoteInstances:
+- name: Instance2
+  address: ` + listener.Addr().String() + `
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	errors = builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+
+	querySink, err := source.GetQuerySink(proto.QueryType_DummyQueryType)
+	require.NoError(suite.T(), err, "failed to get query sink: %s", err)
+	query := &proto.Query{
+		Type: proto.QueryType_DummyQueryType,
+		UUID: "query-uuid",
+		Info: &proto.Query_Dummy{
+			Dummy: &proto.DummyQuery{
+				Info: "Query",
+			},
+		},
+	}
+	result, err := querySink.RunQuery(query)
+	require.NoError(suite.T(), err, "failed to run remote query: %s", err)
+	require.Equal(suite.T(), query.UUID, result.UUID)
+
+	eventSink, err := source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	require.NoError(suite.T(), eventSink.PushEvent(prepareEvents(1)[0]), "failed to push remote event")
+	err = wait.Poll(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return len(remoteParams.Processed()) == 1, nil
+	})
+	require.NoError(suite.T(), err, "remote event was not processed: %s", err)
+
+	//Remote connections are closed on shutdown
+	errors = builder.Shutdown()
+	require.Zero(suite.T(), len(errors), "builder shutdown failed: %v", errors)
+	require.Zero(suite.T(), len(builder.remoteInstances))
+	_, err = querySink.RunQuery(query)
+	require.Error(suite.T(), err, "query ran after shutdown")
+}
+
+func (suite *BuilderTestSuite) TestBuilder__Interceptors() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+- name: Instance3
+  type: Type3
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  interceptors: reject
+- source: Instance1
+  destination: Instance3
+  eventType: DummyEventType
+queryRelations:
+- source: Instance1
+  destination: Instance3
+  queryType: DummyQueryType
+  interceptors: answer
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type3", processor.NewTestService, &processor.TestServiceParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	//Global interceptor counts the events of all relations
+	events := atomic.NewInt32(0)
+	builder.AddEventInterceptor(func(ctx context.Context, event *proto.Event, next processor.EventHandler) error {
+		events.Inc()
+		return next(ctx, event)
+	})
+	err = builder.AddNamedEventInterceptor("reject", func(ctx context.Context, event *proto.Event, next processor.EventHandler) error {
+		return fmt.Errorf("rejected")
+	})
+	require.NoError(suite.T(), err, "failed to add interceptor: %s", err)
+	err = builder.AddNamedEventInterceptor("reject", nil)
+	require.Error(suite.T(), err, "added same interceptor twice")
+	err = builder.AddNamedQueryInterceptor("answer", func(ctx context.Context, query *proto.Query, next processor.QueryHandler) (*proto.QueryResult, error) {
+		return &proto.QueryResult{Type: query.Type, UUID: "answered"}, nil
+	})
+	require.NoError(suite.T(), err, "failed to add interceptor: %s", err)
+
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+
+	//The event is rejected only on the relation listing the interceptor
+	eventSink, err := source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	err = eventSink.PushEvent(prepareEvents(1)[0])
+	multicastErr, ok := err.(*processor.MulticastError)
+	require.True(suite.T(), ok, "unexpected error %v", err)
+	require.Contains(suite.T(), multicastErr.Errors, "Instance2")
+	require.Equal(suite.T(), 1, len(multicastErr.Errors))
+	require.Equal(suite.T(), int32(2), events.Load())
+
+	querySink, err := source.GetQuerySink(proto.QueryType_DummyQueryType)
+	require.NoError(suite.T(), err, "failed to get query sink: %s", err)
+	result, err := querySink.RunQuery(&proto.Query{Type: proto.QueryType_DummyQueryType})
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.Equal(suite.T(), "answered", result.UUID)
+}
+
+func (suite *BuilderTestSuite) TestBuilder__UnknownInterceptor() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type1
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  interceptors: missing
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	errors := builder.Run()
+	require.Equal(suite.T(), 1, len(errors), "builder run with unknown interceptor")
+}
+
+func (suite *BuilderTestSuite) TestBuilder__RelationMetrics() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestService, &processor.TestServiceParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+
+	eventSink, err := source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	for _, event := range prepareEvents(3) {
+		require.NoError(suite.T(), eventSink.PushEvent(event), "failed to push event")
+	}
+	querySink, err := source.GetQuerySink(proto.QueryType_DummyQueryType)
+	require.NoError(suite.T(), err, "failed to get query sink: %s", err)
+	for i := 0; i < 2; i++ {
+		_, err := querySink.RunQuery(&proto.Query{
+			Type: proto.QueryType_DummyQueryType,
+			Info: &proto.Query_Dummy{
+				Dummy: &proto.DummyQuery{},
+			},
+		})
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+	}
+
+	snapshots := builder.GetRelationMetrics()
+	require.Equal(suite.T(), 2, len(snapshots))
+	require.Equal(suite.T(), int64(3), snapshots["Instance1->Instance2:DummyEventType"].EventsPushed)
+	require.Equal(suite.T(), int64(2), snapshots["Instance1->Instance2:DummyQueryType"].Queries)
+	require.Equal(suite.T(), int64(2), snapshots["Instance1->Instance2:DummyQueryType"].QueryLatency.Count)
+	require.NotNil(suite.T(), builder.GetMetricsRegistry().Get("Instance1->Instance2:DummyQueryType.queryLatency"))
+
+	//Metrics are cleared along with the mesh
+	builder.Shutdown()
+	builder.Clear()
+	require.Zero(suite.T(), len(builder.GetRelationMetrics()))
+	require.Nil(suite.T(), builder.GetMetricsRegistry().Get("Instance1->Instance2:DummyQueryType.queryLatency"))
+}
+
+func (suite *BuilderTestSuite) TestBuilder__Tracing() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestService, &processor.TestServiceParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	tracer := mocktracer.New()
+	builder.SetTracer(tracer)
+
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	querySink, err := source.GetQuerySink(proto.QueryType_DummyQueryType)
+	require.NoError(suite.T(), err, "failed to get query sink: %s", err)
+	_, err = querySink.RunQuery(&proto.Query{
+		Type: proto.QueryType_DummyQueryType,
+		Info: &proto.Query_Dummy{
+			Dummy: &proto.DummyQuery{},
+		},
+	})
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+
+	//Both sides of the relation are traced in the same trace
+	spans := tracer.FinishedSpans()
+	require.Equal(suite.T(), 2, len(spans))
+	require.Equal(suite.T(), "Instance2", spans[0].Tag("instance"))
+	require.Equal(suite.T(), "Instance1->Instance2:DummyQueryType", spans[1].Tag("relation"))
+	require.Equal(suite.T(), spans[1].SpanContext.SpanID, spans[0].ParentID)
+}
+
+func (suite *BuilderTestSuite) TestBuilder__RetryDeadLetter() {
+	dir, err := ioutil.TempDir("", "dead_letter_")
+	require.NoError(suite.T(), err, "failed to create directory: %s", err)
+	defer os.RemoveAll(dir)
+	deadLetterFile := filepath.Join(dir, "dead_letters.jsonl")
+
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+- name: Instance3
+  type: Type3
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  interceptors: fail
+  retryAttempts: 3
+  retryBackoff: 1ms
+  deadLetter: Instance3
+- source: Instance3
+  destination: Instance2
+  eventType: DummyEventType
+  interceptors: fail
+  deadLetter: file:` + deadLetterFile + `
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	deadLetterParams := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	err = builder.AddConstructor("Type3", processor.NewTestProcessor, deadLetterParams)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddNamedEventInterceptor("fail", func(ctx context.Context, event *proto.Event, next processor.EventHandler) error {
+		return fmt.Errorf("unavailable")
+	})
+	require.NoError(suite.T(), err, "failed to add interceptor: %s", err)
+
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	//Undelivered event of Instance1 reaches Instance3 after all attempts
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	eventSink, err := source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	require.NoError(suite.T(), eventSink.PushEvent(prepareEvents(1)[0]), "failed to dead letter event")
+	err = wait.Poll(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return len(deadLetterParams.Processed()) == 1, nil
+	})
+	require.NoError(suite.T(), err, "dead letter was not delivered: %s", err)
+	deadLetterEvent := deadLetterParams.Processed()[0]
+	require.NotNil(suite.T(), deadLetterEvent.Header, "dead letter was not stamped")
+	require.Equal(suite.T(), "Instance1", deadLetterEvent.Header.Source)
+	letter := deadLetterEvent.GetDeadLetter()
+	require.Equal(suite.T(), uint32(3), letter.Attempts)
+	require.Equal(suite.T(), "Instance1->Instance2:DummyEventType", letter.Relation)
+	require.Equal(suite.T(), int64(3), builder.GetRelationMetrics()["Instance1->Instance2:DummyEventType"].EventErrors)
+
+	//Undelivered event of Instance3 is written to the dead letter file
+	info, err = builder.getProcessorInfo("Instance3")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok = info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	eventSink, err = source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	require.NoError(suite.T(), eventSink.PushEvent(prepareEvents(1)[0]), "failed to dead letter event")
+
+	errors = builder.Shutdown()
+	require.Zero(suite.T(), len(errors), "builder shutdown failed: %v", errors)
+	content, err := ioutil.ReadFile(deadLetterFile)
+	require.NoError(suite.T(), err, "failed to read dead letters: %s", err)
+	require.Equal(suite.T(), 1, strings.Count(string(content), "\n"))
+}
+
+func (suite *BuilderTestSuite) TestBuilder__PersistentRelation() {
+	dir, err := ioutil.TempDir("", "persistent_")
+	require.NoError(suite.T(), err, "failed to create directory: %s", err)
+	defer os.RemoveAll(dir)
+
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  interceptors: gate
+  persistentDir: ` + filepath.Join(dir, "Instance2") + `
+  persistentMaxAge: 1h
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	//Destination is unavailable while the gate is closed
+	var closed atomic.Bool
+	closed.Store(true)
+	runBuilder := func(params *processor.TestProcessorParams) *Builder {
+		builder, err := NewBuilder(file.Name())
+		require.NoError(suite.T(), err, "failed to create builder: %s", err)
+		err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+			LivenessInterval: time.Second,
+		})
+		require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+		err = builder.AddConstructor("Type2", processor.NewTestProcessor, params)
+		require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+		err = builder.AddNamedEventInterceptor("gate", func(ctx context.Context, event *proto.Event, next processor.EventHandler) error {
+			if closed.Load() {
+				return fmt.Errorf("unavailable")
+			}
+			return next(ctx, event)
+		})
+		require.NoError(suite.T(), err, "failed to add interceptor: %s", err)
+		errors := builder.Run()
+		require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+		return builder
+	}
+
+	//Events are accepted although they cannot be delivered yet
+	builder := runBuilder(&processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	eventSink, err := source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	events := prepareEvents(3)
+	for _, event := range events {
+		require.NoError(suite.T(), eventSink.PushEvent(event), "failed to push event")
+	}
+	errors := builder.Shutdown()
+	require.Zero(suite.T(), len(errors), "builder shutdown failed: %v", errors)
+
+	//Next run replays the undelivered events
+	closed.Store(false)
+	params := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	builder = runBuilder(params)
+	defer builder.Shutdown()
+	err = wait.Poll(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return len(params.Processed()) == len(events), nil
+	})
+	require.NoError(suite.T(), err, "events were not replayed: %s", err)
+	for i, event := range params.Processed() {
+		require.Equal(suite.T(), events[i].GetDummy().Info, event.GetDummy().Info)
+		require.Equal(suite.T(), "Instance1", event.Header.Source)
+	}
+}
+
+func (suite *BuilderTestSuite) TestBuilder__CircuitBreaker() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+- name: Instance3
+  type: Type2
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  interceptors: down
+  circuitMinRequests: 1
+  circuitCoolDown: 1h
+- source: Instance1
+  destination: Instance3
+  queryType: DummyQueryType
+  circuitMinRequests: 1
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestService, &processor.TestServiceParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddNamedQueryInterceptor("down", func(ctx context.Context, query *proto.Query, next processor.QueryHandler) (*proto.QueryResult, error) {
+		return nil, fmt.Errorf("unavailable")
+	})
+	require.NoError(suite.T(), err, "failed to add interceptor: %s", err)
+
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	//Failing replica is skipped once its circuit opens
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	sink, err := source.GetQuerySink(proto.QueryType_DummyQueryType)
+	require.NoError(suite.T(), err, "failed to get query sink: %s", err)
+	failures := 0
+	for i := 0; i < 4; i++ {
+		query := &proto.Query{
+			Type: proto.QueryType_DummyQueryType,
+			UUID: strconv.Itoa(i),
+			Info: &proto.Query_Dummy{
+				Dummy: &proto.DummyQuery{
+					Info: "Query",
+				},
+			},
+		}
+		if _, err := sink.RunQuery(query); err != nil {
+			failures++
+		}
+	}
+	require.Equal(suite.T(), 1, failures)
+
+	//Circuits state is reported on the source heartbeat
+	require.Equal(suite.T(), "circuit Instance1->Instance2:DummyQueryType: open, circuit Instance1->Instance3:DummyQueryType: closed",
+		source.GetHeartbeat().Status)
+}
+
+func (suite *BuilderTestSuite) TestBuilder__QueryCache() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+queryRelations:
+- source: Instance1
+  destination: Instance2
+  queryType: DummyQueryType
+  cacheTTL: 1h
+  cacheMaxEntries: 10
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestService, &processor.TestServiceParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	//Repeated query is answered from the cache
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	sink, err := source.GetQuerySink(proto.QueryType_DummyQueryType)
+	require.NoError(suite.T(), err, "failed to get query sink: %s", err)
+	for _, uuid := range []string{"first", "second"} {
+		query := &proto.Query{
+			Type: proto.QueryType_DummyQueryType,
+			UUID: uuid,
+			Info: &proto.Query_Dummy{
+				Dummy: &proto.DummyQuery{
+					Info: "Query",
+				},
+			},
+		}
+		result, err := sink.RunQuery(query)
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+		require.Equal(suite.T(), uuid, result.UUID)
+	}
+	require.Equal(suite.T(), int64(1), builder.GetRelationMetrics()["Instance1->Instance2:DummyQueryType"].Queries)
+	hits, ok := builder.GetMetricsRegistry().Get("Instance1:DummyQueryType.cacheHits").(metrics.Counter)
+	require.True(suite.T(), ok, "missing cache hits metric")
+	require.Equal(suite.T(), int64(1), hits.Count())
+}
+
+func (suite *BuilderTestSuite) TestBuilder__EventFilter() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+- name: Instance3
+  type: Type3
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  filter: Dummy.Info == "Event 0"
+- source: Instance1
+  destination: Instance3
+  eventType: DummyEventType
+  filter: Dummy.Info != "Event 0" && Header.Source == "Instance1"
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	receiver1Params := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	receiver2Params := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestProcessor, receiver1Params)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type3", processor.NewTestProcessor, receiver2Params)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	//Each destination gets the events matching its filter
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	eventSink, err := source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	for _, event := range prepareEvents(3) {
+		require.NoError(suite.T(), eventSink.PushEvent(event), "failed to push event")
+	}
+	err = wait.Poll(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return len(receiver1Params.Processed()) == 1 && len(receiver2Params.Processed()) == 2, nil
+	})
+	require.NoError(suite.T(), err, "events were not routed by the filters: %s", err)
+	require.Equal(suite.T(), "Event 0", receiver1Params.Processed()[0].GetDummy().Info)
+}
+
+func (suite *BuilderTestSuite) TestBuilder__RateLimitAndSampling() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+- name: Instance3
+  type: Type3
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  rateLimit: 0.001
+  rateBurst: 2
+- source: Instance1
+  destination: Instance3
+  eventType: DummyEventType
+  sampleRate: 0.5
+  sampling: deterministic
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	receiver1Params := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	receiver2Params := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestProcessor, receiver1Params)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type3", processor.NewTestProcessor, receiver2Params)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	eventSink, err := source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	for _, event := range prepareEvents(20) {
+		require.NoError(suite.T(), eventSink.PushEvent(event), "failed to push event")
+	}
+
+	//The rate limited destination gets the burst only, the sampled one a part of the events
+	snapshots := builder.GetRelationMetrics()
+	limited := snapshots["Instance1->Instance2:DummyEventType"]
+	require.Equal(suite.T(), int64(18), limited.RateLimited)
+	require.Equal(suite.T(), int64(2), limited.EventsPushed)
+	sampled := snapshots["Instance1->Instance3:DummyEventType"]
+	require.NotZero(suite.T(), sampled.SampledOut)
+	require.Equal(suite.T(), int64(20), sampled.SampledOut+sampled.EventsPushed)
+	require.Zero(suite.T(), sampled.RateLimited)
+	err = wait.Poll(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return len(receiver1Params.Processed()) == 2 && int64(len(receiver2Params.Processed())) == sampled.EventsPushed, nil
+	})
+	require.NoError(suite.T(), err, "events were not delivered: %s", err)
+	counter, ok := builder.GetMetricsRegistry().Get("Instance1->Instance3:DummyEventType.sampledOut").(metrics.Counter)
+	require.True(suite.T(), ok, "sampled out counter not registered")
+	require.Equal(suite.T(), sampled.SampledOut, counter.Count())
+}
+
+func (suite *BuilderTestSuite) TestBuilder__BatchingRelation() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  batchSize: 3
+  batchLinger: 1h
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	receiverParams := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", processor.NewTestProcessor, receiverParams)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	source, ok := info.instance.(*processor.TestProcessor)
+	require.True(suite.T(), ok, "unexpected instance type %T", info.instance)
+	eventSink, err := source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	events := prepareEvents(7)
+	for _, event := range events {
+		require.NoError(suite.T(), eventSink.PushEvent(event), "failed to push event")
+	}
+	err = wait.Poll(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return len(receiverParams.Processed()) == 2, nil
+	})
+	require.NoError(suite.T(), err, "batches were not delivered: %s", err)
+
+	//The pending batch is delivered on shutdown
+	errors = builder.Shutdown()
+	require.Zero(suite.T(), len(errors), "builder shutdown failed: %v", errors)
+	require.Equal(suite.T(), 3, len(receiverParams.Processed()))
+	unpacked := []*proto.Event{}
+	for _, batch := range receiverParams.Processed() {
+		require.Equal(suite.T(), proto.EventType_DummyEventType, batch.Type)
+		require.NotNil(suite.T(), batch.GetBatch(), "received event is not a batch")
+		unpacked = append(unpacked, processor.UnpackBatch(batch)...)
+	}
+	require.Equal(suite.T(), len(events), len(unpacked))
+	for i, event := range unpacked {
+		require.Equal(suite.T(), events[i].GetDummy().Info, event.GetDummy().Info)
+	}
+}
+
+func (suite *BuilderTestSuite) TestBuilder__Lifecycle() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	params := &badProcessorParams{
+		runError: true,
+	}
+	err = builder.AddConstructor("Type2", newBadProcessor, params)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+
+	changes := []string{}
+	builder.SubscribeStateChanges(func(name string, from processor.LifecycleState, to processor.LifecycleState) {
+		changes = append(changes, name+": "+from.String()+" -> "+to.String())
+	})
+
+	//The instance failing to run is marked as failed
+	errors := builder.Run()
+	require.Equal(suite.T(), 1, len(errors), "unexpected run errors: %v", errors)
+	state, err := builder.GetProcessorState("Instance1")
+	require.NoError(suite.T(), err, "failed to get state: %s", err)
+	require.Equal(suite.T(), processor.LifecycleRunning, state)
+	state, err = builder.GetProcessorState("Instance2")
+	require.NoError(suite.T(), err, "failed to get state: %s", err)
+	require.Equal(suite.T(), processor.LifecycleFailed, state)
+	_, err = builder.GetProcessorState("Instance3")
+	require.Error(suite.T(), err, "got state of missing instance")
+
+	//The failed instance is run again, and running a running instance is a no-op
+	info, err := builder.getProcessorInfo("Instance2")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	info.instance.(*badProcessor).runError = false
+	require.NoError(suite.T(), builder.RunProcessor("Instance2"))
+	require.Equal(suite.T(), processor.LifecycleRunning, info.State())
+	require.NoError(suite.T(), builder.RunProcessor("Instance1"))
+	require.Error(suite.T(), builder.RunProcessor("Instance3"), "ran missing instance")
+
+	//Shutdown is idempotent, and a shut down mesh is not run again
+	require.NoError(suite.T(), builder.ShutdownProcessor("Instance2"))
+	require.NoError(suite.T(), builder.ShutdownProcessor("Instance2"))
+	errors = builder.Shutdown()
+	require.Zero(suite.T(), len(errors), "builder shutdown failed: %v", errors)
+	errors = builder.Shutdown()
+	require.Zero(suite.T(), len(errors), "builder shutdown failed: %v", errors)
+	for iter := builder.GetProcessorsIterator(); iter != nil; iter = iter.Next() {
+		current, err := iter.Current()
+		require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+		require.Equal(suite.T(), processor.LifecycleStopped, current.State(), "instance %s", current.Name())
+	}
+	require.Error(suite.T(), builder.RunProcessor("Instance1"), "ran instance of shut down mesh")
+
+	require.Equal(suite.T(), []string{
+		"Instance1: Created -> Starting",
+		"Instance1: Starting -> Running",
+		"Instance2: Created -> Starting",
+		"Instance2: Starting -> Failed",
+		"Instance2: Failed -> Starting",
+		"Instance2: Starting -> Running",
+		"Instance2: Running -> Stopping",
+		"Instance2: Stopping -> Stopped",
+		"Instance1: Running -> Stopping",
+		"Instance1: Stopping -> Stopped",
+	}, changes)
+}
+
+func (suite *BuilderTestSuite) TestBuilder__ConcurrentLifecycle() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", newBadProcessor, &badProcessorParams{})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	instance := info.Instance().(*badProcessor)
+	require.NoError(suite.T(), builder.ShutdownProcessor("Instance1"))
+
+	//Running an instance while it is starting waits for it to run, with no run of its own
+	instance.runBlock = make(chan struct{})
+	runErrors := make(chan error, 2)
+	go func() {
+		runErrors <- builder.RunProcessor("Instance1")
+	}()
+	waitForState(suite.T(), info, processor.LifecycleStarting)
+	go func() {
+		runErrors <- builder.RunProcessor("Instance1")
+	}()
+	select {
+	case err := <-runErrors:
+		require.Fail(suite.T(), "ran instance while starting", "error: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(instance.runBlock)
+	require.NoError(suite.T(), <-runErrors, "failed to run instance")
+	require.NoError(suite.T(), <-runErrors, "failed to run instance while starting")
+	require.Equal(suite.T(), processor.LifecycleRunning, info.State())
+	require.Equal(suite.T(), int32(2), instance.runs.Load())
+
+	//Shutting down an instance while it is starting waits for it to run, then shuts it down
+	require.NoError(suite.T(), builder.ShutdownProcessor("Instance1"))
+	instance.runBlock = make(chan struct{})
+	go func() {
+		runErrors <- builder.RunProcessor("Instance1")
+	}()
+	waitForState(suite.T(), info, processor.LifecycleStarting)
+	shutdownErrors := make(chan []error, 1)
+	go func() {
+		shutdownErrors <- builder.Shutdown()
+	}()
+	select {
+	case errors := <-shutdownErrors:
+		require.Fail(suite.T(), "shut down instance while starting", "errors: %v", errors)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(instance.runBlock)
+	require.NoError(suite.T(), <-runErrors, "failed to run instance")
+	errors = <-shutdownErrors
+	require.Zero(suite.T(), len(errors), "builder shutdown failed: %v", errors)
+	require.Equal(suite.T(), processor.LifecycleStopped, info.State())
+}
+
+func (suite *BuilderTestSuite) TestBuilder__RestartProcessor() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type1
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+  timeout: 1s
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	params := &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	}
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, params)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+
+	//Both the source and the destination of the relation are replaced and re-wired
+	sourceInfo, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	destinationInfo, err := builder.getProcessorInfo("Instance2")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	replaced := destinationInfo.Instance()
+	require.NoError(suite.T(), builder.RestartProcessor("Instance2", time.Second))
+	require.NoError(suite.T(), builder.RestartProcessor("Instance1", time.Second))
+	require.NotEqual(suite.T(), replaced, destinationInfo.Instance(), "instance was not replaced")
+	require.False(suite.T(), replaced.IsReady(), "replaced instance is still running")
+	require.Equal(suite.T(), processor.LifecycleRunning, destinationInfo.State())
+
+	//The replaced destination no longer handles events, so they are delivered to the new one
+	source := sourceInfo.Instance().(*processor.TestProcessor)
+	eventSink, err := source.GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "restarted instance is missing its event sink: %s", err)
+	require.NoError(suite.T(), eventSink.PushEvent(prepareEvents(1)[0]), "failed to push event")
+	err = wait.Poll(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return len(params.Processed()) == 1, nil
+	})
+	require.NoError(suite.T(), err, "event was not delivered: %s", err)
+
+	//Instances of a shut down mesh are not restarted
+	errors = builder.Shutdown()
+	require.Zero(suite.T(), len(errors), "builder shutdown failed: %v", errors)
+	require.Error(suite.T(), builder.RestartProcessor("Instance1", time.Second), "restarted instance of shut down mesh")
+	require.Error(suite.T(), builder.RestartProcessor("Instance3", time.Second), "restarted missing instance")
+}
+
+func (suite *BuilderTestSuite) TestBuilder__RestartTransitioningProcessor() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", newBadProcessor, &badProcessorParams{})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	instance := info.Instance().(*badProcessor)
+
+	//An instance being shut down is not restarted
+	instance.shutdownBlock = make(chan struct{})
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- builder.ShutdownProcessor("Instance1")
+	}()
+	waitForState(suite.T(), info, processor.LifecycleStopping)
+	require.Error(suite.T(), builder.RestartProcessor("Instance1", time.Second), "restarted instance while stopping")
+	require.Equal(suite.T(), instance, info.Instance(), "instance was replaced while stopping")
+	close(instance.shutdownBlock)
+	require.NoError(suite.T(), <-shutdownErr, "failed to shut down instance")
+	require.Equal(suite.T(), processor.LifecycleStopped, info.State())
+
+	//An instance being run is not restarted
+	instance.runBlock = make(chan struct{})
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- builder.RunProcessor("Instance1")
+	}()
+	waitForState(suite.T(), info, processor.LifecycleStarting)
+	require.Error(suite.T(), builder.RestartProcessor("Instance1", time.Second), "restarted instance while starting")
+	require.Equal(suite.T(), instance, info.Instance(), "instance was replaced while starting")
+	close(instance.runBlock)
+	require.NoError(suite.T(), <-runErr, "failed to run instance")
+
+	//The settled instance is restarted
+	require.NoError(suite.T(), builder.RestartProcessor("Instance1", time.Second))
+	require.NotEqual(suite.T(), instance, info.Instance(), "instance was not replaced")
+	require.Equal(suite.T(), processor.LifecycleRunning, info.State())
+	errors = builder.Shutdown()
+	require.Zero(suite.T(), len(errors), "builder shutdown failed: %v", errors)
+}
+
+func (suite *BuilderTestSuite) TestBuilder__PanickingProcessor() {
+	layout := `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+eventRelations:
+- source: Instance1
+  destination: Instance2
+  eventType: DummyEventType
+`
+	file, err := createTemporaryFile([]byte(layout))
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	defer os.Remove(file.Name())
+
+	builder, err := NewBuilder(file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	err = builder.AddConstructor("Type2", newPanickingProcessor)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	errors := builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	defer builder.Shutdown()
+
+	//The panic is returned to the source, and the destination is marked failed
+	info, err := builder.getProcessorInfo("Instance1")
+	require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+	eventSink, err := info.instance.(*processor.TestProcessor).GetEventSink(proto.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "failed to get event sink: %s", err)
+	err = eventSink.PushEvent(prepareEvents(1)[0])
+	require.True(suite.T(), processor.IsPanicError(err), "unexpected error %v", err)
+	state, err := builder.GetProcessorState("Instance2")
+	require.NoError(suite.T(), err, "failed to get state: %s", err)
+	require.Equal(suite.T(), processor.LifecycleFailed, state)
+	state, err = builder.GetProcessorState("Instance1")
+	require.NoError(suite.T(), err, "failed to get state: %s", err)
+	require.Equal(suite.T(), processor.LifecycleRunning, state)
+
+	//The restarted instance is running again
+	require.NoError(suite.T(), builder.RestartProcessor("Instance2", time.Second))
+	state, err = builder.GetProcessorState("Instance2")
+	require.NoError(suite.T(), err, "failed to get state: %s", err)
+	require.Equal(suite.T(), processor.LifecycleRunning, state)
+}
+
 func TestBuilder__RUN(t *testing.T) {
 	crt := new(BuilderTestSuite)
 	suite.Run(t, crt)
 }
+
+//Helper function for creating dummy events
+func prepareEvents(num int) []*proto.Event {
+	events := make([]*proto.Event, 0)
+	for i := 0; i < num; i++ {
+		events = append(events, &proto.Event{
+			Type: proto.EventType_DummyEventType,
+			Info: &proto.Event_Dummy{
+				Dummy: &proto.DummyEvent{
+					Info: "Event " + strconv.Itoa(i),
+				},
+			},
+		})
+	}
+	return events
+}
+
+//Helper function for waiting for an instance to reach a lifecycle state
+func waitForState(t *testing.T, info *ProcessorInfo, state processor.LifecycleState) {
+	err := wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return info.State() == state, nil
+	})
+	require.NoError(t, err, "instance %s did not reach state %s: %s", info.Name(), state, err)
+}
+
+//Processor panicking on every event
+type panickingProcessor struct {
+	*processor.BaseProcessor
+}
+
+func newPanickingProcessor() processor.ProcessorInterface {
+	p := &panickingProcessor{}
+	p.BaseProcessor = processor.NewBaseProcessor(p, processor.BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	return p
+}
+
+func (p *panickingProcessor) PushEvent(event *proto.Event) error {
+	panic("event handler bug")
+}
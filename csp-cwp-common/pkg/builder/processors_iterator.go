@@ -23,6 +23,21 @@ func (b *Builder) GetProcessorsIterator() *ProcessorsIterator {
 	}
 }
 
+//Get the existing processors in order of creation:
+//Unlike the iterator, the returned list is a snapshot which is safe to get at any time,
+//including while the mesh is run or cleared.
+func (b *Builder) GetProcessors() []*ProcessorInfo {
+	b.instancesLock.RLock()
+	defer b.instancesLock.RUnlock()
+	processors := make([]*ProcessorInfo, 0, b.localInstances.Len())
+	for entry := b.localInstances.Front(); entry != nil; entry = entry.Next() {
+		if info, ok := (entry.Value).(*ProcessorInfo); ok {
+			processors = append(processors, info)
+		}
+	}
+	return processors
+}
+
 //Get next entry iterator or nil if finished all entries.
 func (iter *ProcessorsIterator) Next() *ProcessorsIterator {
 	if iter.current == nil || iter.current.Next() == nil {
@@ -0,0 +1,74 @@
+package builder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+)
+
+//Information of an instance hosted by another agent process
+type remoteInfo struct {
+	//Connection to the transport server of the hosting process
+	conn *grpc.ClientConn
+}
+
+//Check if the remote instance connection is usable, the connection is not
+//considered ready while failing to connect so balanced queries skip it.
+func (r *remoteInfo) isReady() bool {
+	state := r.conn.GetState()
+	return state != connectivity.TransientFailure && state != connectivity.Shutdown
+}
+
+//Connect to a remote instance according to its blueprint information:
+//The connection is established lazily, so the remote process does not have to be up
+//when the mesh is built.
+func dialRemoteInstance(info map[string]string) (*remoteInfo, error) {
+	credentialsOption := grpc.WithInsecure()
+	if enabled, _ := strconv.ParseBool(info["tls"]); enabled {
+		config, err := remoteTLSConfig(info)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS settings of remote instance %s: %s", info["name"], err)
+		}
+		credentialsOption = grpc.WithTransportCredentials(credentials.NewTLS(config))
+	}
+	conn, err := grpc.Dial(info["address"], credentialsOption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect remote instance %s: %s", info["name"], err)
+	}
+	return &remoteInfo{
+		conn: conn,
+	}, nil
+}
+
+//Create the TLS configuration of a remote instance connection
+func remoteTLSConfig(info map[string]string) (*tls.Config, error) {
+	insecureSkipVerify, _ := strconv.ParseBool(info["insecureSkipVerify"])
+	config := &tls.Config{
+		ServerName:         info["serverName"],
+		InsecureSkipVerify: insecureSkipVerify, //nolint - explicitly set by the blueprint
+	}
+	if caFile := info["caFile"]; caFile != "" {
+		content, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if info["certFile"] != "" {
+		certificate, err := tls.LoadX509KeyPair(info["certFile"], info["keyFile"])
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
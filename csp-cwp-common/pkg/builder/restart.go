@@ -0,0 +1,151 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Restart an instance of the running mesh, replacing it with a new instance of its type:
+//The new instance is given the egress sinks of the replaced one, and the relations to the
+//replaced one deliver to it from then on. The replaced instance is shut down if it was run,
+//waiting for it up to timeout (zero for no limit) and abandoning it after that, as a wedged
+//instance may never return. The new instance is then run.
+//The replaced instance is kept if the new one could not be created, or if it is being run or
+//shut down concurrently, in which case the restart fails.
+func (b *Builder) RestartProcessor(name string, timeout time.Duration) error {
+	info, err := b.getProcessorInfo(name)
+	if err != nil {
+		return err
+	}
+	if b.ctx.Err() != nil {
+		return fmt.Errorf("mesh was already shut down")
+	}
+	if state := info.State(); state == processor.LifecycleStarting || state == processor.LifecycleStopping {
+		return fmt.Errorf("failed to restart instance %s: instance is %s", name, state)
+	}
+
+	//Create and wire the new instance before touching the replaced one
+	ctor, exists := b.constructors[info.typeName]
+	if !exists {
+		return fmt.Errorf("failed to find constructor for instance type %s", info.typeName)
+	}
+	instance, err := ctor.call()
+	if err != nil {
+		return fmt.Errorf("creation of instance (%s, %s) failed: %s", info.typeName, name, err)
+	}
+	for eventType, sink := range info.eventSinks {
+		if err := instance.AddEventSink(eventType, sink); err != nil {
+			return fmt.Errorf("failed to restart instance %s: %s", name, err)
+		}
+	}
+	for queryType, sink := range info.querySinks {
+		if err := instance.AddQuerySink(queryType, sink); err != nil {
+			return fmt.Errorf("failed to restart instance %s: %s", name, err)
+		}
+	}
+	b.handlePanics(info, instance)
+
+	replaceable, err := info.stop(timeout)
+	if !replaceable {
+		return fmt.Errorf("failed to restart instance %s: %s", name, err)
+	}
+	if err != nil && b.logger != nil {
+		b.logger.Warnf("replacing instance %s which failed to shut down: %s", name, err)
+	}
+	info.lock.Lock()
+	info.instance = instance
+	info.lock.Unlock()
+	return info.run()
+}
+
+//Private method for shutting down the instance on restart if it was run:
+//The instance is marked failed if its shutdown failed or was abandoned after timeout.
+//Return whether the instance may be replaced, which is not the case if it is being run or
+//shut down concurrently, along with the shutdown error.
+func (info *ProcessorInfo) stop(timeout time.Duration) (bool, error) {
+	from := info.lifecycle.State()
+	switch from {
+	case processor.LifecycleRunning, processor.LifecycleFailed:
+	case processor.LifecycleCreated, processor.LifecycleStopped:
+		return true, nil
+	default:
+		return false, fmt.Errorf("instance is %s", from)
+	}
+	if err := info.lifecycle.TransitionFrom(from, processor.LifecycleStopping); err != nil {
+		return false, err
+	}
+	instance := info.Instance()
+	done := make(chan error, 1)
+	go func() {
+		done <- instance.Shutdown()
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			_ = info.lifecycle.TransitionFrom(processor.LifecycleStopping, processor.LifecycleFailed)
+			return true, err
+		}
+		return true, info.lifecycle.TransitionFrom(processor.LifecycleStopping, processor.LifecycleStopped)
+	case <-expired:
+		_ = info.lifecycle.TransitionFrom(processor.LifecycleStopping, processor.LifecycleFailed)
+		return true, fmt.Errorf("shutdown abandoned after %s", timeout)
+	}
+}
+
+//Report a relation component status on the heartbeat of the current instance, if supported
+func (info *ProcessorInfo) ReportStatus(component string, status string) {
+	if reporter, ok := info.Instance().(processor.StatusReporter); ok {
+		reporter.ReportStatus(component, status)
+	}
+}
+
+//Ingress tap of the current instance of a processor info:
+//Used by the relations to local destinations, so they deliver to the instance replacing
+//a restarted one.
+type instanceTap struct {
+	info *ProcessorInfo
+}
+
+func newInstanceTap(info *ProcessorInfo) processor.TapInterface {
+	return &instanceTap{
+		info: info,
+	}
+}
+
+func (t *instanceTap) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return t.info.Instance().GetTap().RunQuery(query)
+}
+
+func (t *instanceTap) PushEvent(event *proto.Event) error {
+	return t.info.Instance().GetTap().PushEvent(event)
+}
+
+func (t *instanceTap) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return processor.RunQueryWithContext(ctx, t.info.Instance().GetTap(), query)
+}
+
+func (t *instanceTap) PushEventContext(ctx context.Context, event *proto.Event) error {
+	return processor.PushEventWithContext(ctx, t.info.Instance().GetTap(), event)
+}
+
+func (t *instanceTap) RunStreamingQuery(ctx context.Context, query *proto.Query, stream processor.ResultStream) error {
+	return processor.RunStreamingQuery(ctx, t.info.Instance().GetTap(), query, stream)
+}
+
+func (t *instanceTap) SetQueryHandler(queryHandler processor.ServiceInterface) {
+	t.info.Instance().GetTap().SetQueryHandler(queryHandler)
+}
+
+func (t *instanceTap) SetEventHandler(eventHandler processor.ProcessorInterface) {
+	t.info.Instance().GetTap().SetEventHandler(eventHandler)
+}
@@ -0,0 +1,190 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rapid7/csp-cwp-common/pkg/builder"
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+)
+
+const (
+	//Path of the liveness probe
+	LivenessPath = "/healthz"
+	//Path of the readiness probe
+	ReadinessPath = "/readyz"
+
+	statusOK     = "ok"
+	statusFailed = "failed"
+)
+
+//Parameters of the health endpoints
+type HealthParams struct {
+	//Grace period passed as is to the liveness checks of the instances
+	GracePeriod time.Duration
+	//Mapping from an instance name to its own grace period
+	GracePeriods map[string]time.Duration
+	//Names of the instances which do not fail the readiness check when they are not ready
+	NonCritical []string
+}
+
+//Check health params validity
+func (p *HealthParams) validate() error {
+	if p.GracePeriod < 0 {
+		return fmt.Errorf("grace period should not be negative")
+	}
+	for name, gracePeriod := range p.GracePeriods {
+		if gracePeriod < 0 {
+			return fmt.Errorf("grace period of instance %s should not be negative", name)
+		}
+	}
+	return nil
+}
+
+//Health detail of an instance
+type ProcessorStatus struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Alive    bool   `json:"alive"`
+	Ready    bool   `json:"ready"`
+	Critical bool   `json:"critical"`
+
+	state processor.LifecycleState
+}
+
+//Outcome of a probe, along with the detail of all the instances
+type Report struct {
+	Status     string            `json:"status"`
+	Reason     string            `json:"reason,omitempty"`
+	Processors []ProcessorStatus `json:"processors"`
+}
+
+//Check if the probe succeeded
+func (r *Report) OK() bool {
+	return r.Status == statusOK
+}
+
+//HTTP handler of the liveness and readiness probes of a Builder mesh:
+//The liveness probe fails while any instance failed, or is running and fails its liveness check.
+//The readiness probe fails before the mesh is run, and while any critical instance is not running
+//or not ready. Both respond with the detail of all the instances in JSON, with status 200 when
+//the probe succeeded and 503 otherwise.
+type Handler struct {
+	builder     *builder.Builder
+	params      HealthParams
+	nonCritical map[string]struct{}
+	mux         *http.ServeMux
+}
+
+//Create the health endpoints handler of a Builder
+func NewHandler(b *builder.Builder, params HealthParams) (*Handler, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	h := &Handler{
+		builder:     b,
+		params:      params,
+		nonCritical: make(map[string]struct{}),
+		mux:         http.NewServeMux(),
+	}
+	for _, name := range params.NonCritical {
+		h.nonCritical[name] = struct{}{}
+	}
+	h.mux.HandleFunc(LivenessPath, h.probe(h.Liveness))
+	h.mux.HandleFunc(ReadinessPath, h.probe(h.Readiness))
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+//Check the liveness of the mesh
+func (h *Handler) Liveness() Report {
+	report := h.report()
+	for _, status := range report.Processors {
+		failed := status.state == processor.LifecycleFailed
+		dead := status.state == processor.LifecycleRunning && !status.Alive
+		if failed || dead {
+			report.Status = statusFailed
+			report.Reason = fmt.Sprintf("instance %s is not alive", status.Name)
+			break
+		}
+	}
+	return report
+}
+
+//Check the readiness of the mesh
+func (h *Handler) Readiness() Report {
+	report := h.report()
+	if len(report.Processors) == 0 {
+		report.Status = statusFailed
+		report.Reason = "mesh is not running"
+		return report
+	}
+	for _, status := range report.Processors {
+		running := status.state == processor.LifecycleRunning
+		if status.Critical && (!running || !status.Ready) {
+			report.Status = statusFailed
+			report.Reason = fmt.Sprintf("instance %s is not ready", status.Name)
+			break
+		}
+	}
+	return report
+}
+
+//Private method for collecting the detail of all the instances
+func (h *Handler) report() Report {
+	report := Report{
+		Status:     statusOK,
+		Processors: []ProcessorStatus{},
+	}
+	for _, info := range h.builder.GetProcessors() {
+		instance := info.Instance()
+		state := info.State()
+		_, nonCritical := h.nonCritical[info.Name()]
+		report.Processors = append(report.Processors, ProcessorStatus{
+			Name:     info.Name(),
+			State:    state.String(),
+			state:    state,
+			Alive:    instance.IsAlive(h.gracePeriod(info.Name())),
+			Ready:    instance.IsReady(),
+			Critical: !nonCritical,
+		})
+	}
+	return report
+}
+
+//Private method for getting the grace period of an instance
+func (h *Handler) gracePeriod(name string) time.Duration {
+	if gracePeriod, exists := h.params.GracePeriods[name]; exists {
+		return gracePeriod
+	}
+	return h.params.GracePeriod
+}
+
+//Private method for serving a probe report
+func (h *Handler) probe(check func() Report) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report := check()
+		body, err := json.Marshal(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.OK() {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write(body)
+	}
+}
@@ -0,0 +1,183 @@
+package health
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/atomic"
+
+	"github.com/rapid7/csp-cwp-common/pkg/builder"
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+const layout = `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type2
+`
+
+type HealthTestSuite struct {
+	suite.Suite
+	file    *os.File
+	builder *builder.Builder
+	probed  *probedProcessor
+}
+
+func (suite *HealthTestSuite) SetupTest() {
+	var err error
+	suite.file, err = ioutil.TempFile("", "blueprint")
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	_, err = suite.file.Write([]byte(layout))
+	require.NoError(suite.T(), err, "failed to write layout file: %s", err)
+
+	suite.builder, err = builder.NewBuilder(suite.file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = suite.builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	suite.probed = newProbedProcessor()
+	err = suite.builder.AddConstructor("Type2", func() processor.ProcessorInterface { return suite.probed })
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+}
+
+func (suite *HealthTestSuite) TearDownTest() {
+	suite.builder.Shutdown()
+	os.Remove(suite.file.Name())
+}
+
+func (suite *HealthTestSuite) TestHealth__Probes() {
+	handler, err := NewHandler(suite.builder, HealthParams{
+		GracePeriod: 10,
+		GracePeriods: map[string]time.Duration{
+			"Instance2": 20,
+		},
+		NonCritical: []string{"Instance2"},
+	})
+	require.NoError(suite.T(), err, "failed to create handler: %s", err)
+
+	//The mesh is alive but not ready before it is run
+	suite.probe(handler, LivenessPath, http.StatusOK)
+	report := suite.probe(handler, ReadinessPath, http.StatusServiceUnavailable)
+	require.Empty(suite.T(), report.Processors)
+
+	errors := suite.builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	report = suite.probe(handler, ReadinessPath, http.StatusOK)
+	require.Equal(suite.T(), []ProcessorStatus{
+		{Name: "Instance1", State: "Running", Alive: true, Ready: true, Critical: true},
+		{Name: "Instance2", State: "Running", Alive: true, Ready: true, Critical: false},
+	}, report.Processors)
+	require.Equal(suite.T(), time.Duration(20), suite.probed.gracePeriod.Load())
+
+	//Non critical instances do not fail readiness, but do fail liveness
+	suite.probed.ready.Store(false)
+	suite.probe(handler, ReadinessPath, http.StatusOK)
+	suite.probed.alive.Store(false)
+	report = suite.probe(handler, LivenessPath, http.StatusServiceUnavailable)
+	require.Equal(suite.T(), "instance Instance2 is not alive", report.Reason)
+	suite.probed.alive.Store(true)
+
+	//Critical instances which are shut down fail readiness only
+	require.NoError(suite.T(), suite.builder.ShutdownProcessor("Instance1"))
+	report = suite.probe(handler, ReadinessPath, http.StatusServiceUnavailable)
+	require.Equal(suite.T(), "instance Instance1 is not ready", report.Reason)
+	suite.probe(handler, LivenessPath, http.StatusOK)
+
+	request := httptest.NewRequest(http.MethodPost, LivenessPath, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	require.Equal(suite.T(), http.StatusMethodNotAllowed, recorder.Code)
+
+	_, err = NewHandler(suite.builder, HealthParams{GracePeriod: -1})
+	require.Error(suite.T(), err, "created handler with negative grace period")
+}
+
+func (suite *HealthTestSuite) TestHealth__ProbesDuringRun() {
+	handler, err := NewHandler(suite.builder, HealthParams{})
+	require.NoError(suite.T(), err, "failed to create handler: %s", err)
+
+	//Probe while the mesh is created, run and shut down
+	done := make(chan struct{})
+	probed := make(chan struct{})
+	go func() {
+		defer close(probed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				handler.Liveness()
+				handler.Readiness()
+			}
+		}
+	}()
+	errors := suite.builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	require.Zero(suite.T(), len(suite.builder.Shutdown()), "builder shutdown failed")
+	close(done)
+	<-probed
+
+	report := suite.probe(handler, ReadinessPath, http.StatusServiceUnavailable)
+	require.Len(suite.T(), report.Processors, 2)
+}
+
+func TestHealth__RUN(t *testing.T) {
+	crt := new(HealthTestSuite)
+	suite.Run(t, crt)
+}
+
+//Helper method for probing the handler, checking the response status code
+func (suite *HealthTestSuite) probe(handler http.Handler, path string, code int) Report {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	require.Equal(suite.T(), code, recorder.Code, "unexpected status of %s: %s", path, recorder.Body.String())
+	require.Equal(suite.T(), "application/json", recorder.Header().Get("Content-Type"))
+
+	report := Report{}
+	require.NoError(suite.T(), json.Unmarshal(recorder.Body.Bytes(), &report), "failed to decode report")
+	require.Equal(suite.T(), code == http.StatusOK, report.OK())
+	return report
+}
+
+//Processor with controllable liveness and readiness
+type probedProcessor struct {
+	*processor.BaseProcessor
+	alive       atomic.Bool
+	ready       atomic.Bool
+	gracePeriod atomic.Duration
+}
+
+func newProbedProcessor() *probedProcessor {
+	p := &probedProcessor{}
+	p.BaseProcessor = processor.NewBaseProcessor(p, processor.BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	p.alive.Store(true)
+	p.ready.Store(true)
+	return p
+}
+
+func (p *probedProcessor) PushEvent(event *pb.Event) error {
+	return nil
+}
+
+func (p *probedProcessor) IsAlive(gracePeriod time.Duration) bool {
+	p.gracePeriod.Store(gracePeriod)
+	return p.alive.Load()
+}
+
+func (p *probedProcessor) IsReady() bool {
+	return p.ready.Load()
+}
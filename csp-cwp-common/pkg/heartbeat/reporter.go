@@ -0,0 +1,178 @@
+package heartbeat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rapid7/csp-cwp-common/pkg/agent_libraries/logger"
+	"github.com/rapid7/csp-cwp-common/pkg/builder"
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+	"github.com/rapid7/csp-cwp-common/pkg/version"
+)
+
+const defaultInterval = 30 * time.Second
+
+//Parameters of a heartbeat reporter
+type ReporterParams struct {
+	//Interval between the reports (default 30s)
+	Interval time.Duration
+	//Timeout of pushing each report, zero for none
+	Timeout time.Duration
+	//Logger of the failed reports, nil for no logging
+	Logger logger.Logger
+}
+
+//Check reporter params validity and fill in defaults
+func (p *ReporterParams) validate() error {
+	if p.Interval < 0 || p.Timeout < 0 {
+		return fmt.Errorf("heartbeat reporter params should not be negative")
+	}
+	if p.Interval == 0 {
+		p.Interval = defaultInterval
+	}
+	return nil
+}
+
+//Reporter of the agent heartbeat:
+//Periodically collects the heartbeats of all the instances of a Builder mesh into an agent
+//heartbeat, along with the agent version, and pushes it to a sink as an AgentHeartbeatEventType
+//event. The agent heartbeat is flagged with configuration drift when the configured instances
+//report different configurations, so the backend can detect instances left behind by a
+//configuration update. Instances which were never configured are not considered drifting.
+//The sink may be wrapped with an envelope sink for stamping the events headers.
+type Reporter struct {
+	builder *builder.Builder
+	sink    processor.SinkInterface
+	params  ReporterParams
+
+	//For signaling the report goroutine to stop and waiting for it to finish
+	runLock sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+//Create heartbeat reporter of the instances of a Builder pushing to sink
+func NewReporter(b *builder.Builder, sink processor.SinkInterface, params ReporterParams) (*Reporter, error) {
+	if sink == nil {
+		return nil, fmt.Errorf("missing heartbeat sink")
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &Reporter{
+		builder: b,
+		sink:    sink,
+		params:  params,
+	}, nil
+}
+
+//Start reporting from a new goroutine, right away and then on every interval
+func (r *Reporter) Run() error {
+	r.runLock.Lock()
+	defer r.runLock.Unlock()
+
+	if r.stop != nil {
+		return fmt.Errorf("heartbeat reporter is already running")
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(r.stop, r.done)
+	return nil
+}
+
+//Stop reporting, abandoning a pending report
+func (r *Reporter) Shutdown() {
+	r.runLock.Lock()
+	defer r.runLock.Unlock()
+
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
+
+//Collect the agent heartbeat from the heartbeats of all the instances
+func (r *Reporter) Collect() *proto.AgentHeartbeat {
+	agentVersion := version.GetVersion()
+	heartbeat := &proto.AgentHeartbeat{
+		AgentVersion: agentVersion,
+		Timestamp:    time.Now().UnixNano(),
+		Processors:   []*proto.ProcessorHeartbeat{},
+	}
+	var configured *proto.Heartbeat
+	for iter := r.builder.GetProcessorsIterator(); iter != nil; iter = iter.Next() {
+		info, err := iter.Current()
+		if err != nil || info == nil {
+			continue
+		}
+		instanceHeartbeat := info.Instance().GetHeartbeat()
+		if instanceHeartbeat.AgentVersion == "" {
+			instanceHeartbeat.AgentVersion = agentVersion
+		}
+		heartbeat.Processors = append(heartbeat.Processors, &proto.ProcessorHeartbeat{
+			Name:      info.Name(),
+			State:     info.State().String(),
+			Heartbeat: &instanceHeartbeat,
+		})
+
+		if instanceHeartbeat.ConfigurationUUID == "" && instanceHeartbeat.ConfigurationVersion == 0 {
+			continue
+		}
+		if configured == nil {
+			configured = &instanceHeartbeat
+		} else if configured.ConfigurationUUID != instanceHeartbeat.ConfigurationUUID ||
+			configured.ConfigurationVersion != instanceHeartbeat.ConfigurationVersion {
+			heartbeat.ConfigurationDrift = true
+		}
+	}
+	return heartbeat
+}
+
+//Collect the agent heartbeat and push it to the sink
+func (r *Reporter) Report(ctx context.Context) error {
+	if r.params.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.params.Timeout)
+		defer cancel()
+	}
+	return processor.PushEventWithContext(ctx, r.sink, &proto.Event{
+		Type: proto.EventType_AgentHeartbeatEventType,
+		Info: &proto.Event_AgentHeartbeat{
+			AgentHeartbeat: r.Collect(),
+		},
+	})
+}
+
+//Private report goroutine
+func (r *Reporter) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	//The pending report is abandoned on stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(r.params.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Report(ctx); err != nil && ctx.Err() == nil && r.params.Logger != nil {
+			r.params.Logger.Warnf("failed to report agent heartbeat: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package heartbeat
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/rapid7/csp-cwp-common/pkg/builder"
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+	"github.com/rapid7/csp-cwp-common/pkg/version"
+)
+
+const layout = `
+localInstances:
+- name: Instance1
+  type: Type1
+- name: Instance2
+  type: Type1
+`
+
+type ReporterTestSuite struct {
+	suite.Suite
+	file    *os.File
+	builder *builder.Builder
+	sink    *recordingSink
+}
+
+func (suite *ReporterTestSuite) SetupTest() {
+	var err error
+	suite.file, err = ioutil.TempFile("", "blueprint")
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	_, err = suite.file.Write([]byte(layout))
+	require.NoError(suite.T(), err, "failed to write layout file: %s", err)
+
+	suite.builder, err = builder.NewBuilder(suite.file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	err = suite.builder.AddConstructor("Type1", processor.NewTestProcessor, &processor.TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	errors := suite.builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+	suite.sink = &recordingSink{}
+}
+
+func (suite *ReporterTestSuite) TearDownTest() {
+	suite.builder.Shutdown()
+	os.Remove(suite.file.Name())
+}
+
+func (suite *ReporterTestSuite) TestReporter__Collect() {
+	reporter, err := NewReporter(suite.builder, suite.sink, ReporterParams{})
+	require.NoError(suite.T(), err, "failed to create reporter: %s", err)
+
+	//Unconfigured instances are not drifting
+	heartbeat := reporter.Collect()
+	require.Equal(suite.T(), version.GetVersion(), heartbeat.AgentVersion)
+	require.NotZero(suite.T(), heartbeat.Timestamp)
+	require.False(suite.T(), heartbeat.ConfigurationDrift)
+	require.Equal(suite.T(), 2, len(heartbeat.Processors))
+	require.Equal(suite.T(), "Instance1", heartbeat.Processors[0].Name)
+	require.Equal(suite.T(), "Running", heartbeat.Processors[0].State)
+	require.Equal(suite.T(), "Instance2", heartbeat.Processors[1].Name)
+
+	//Instances configured differently are drifting
+	suite.configure("Instance1", "uuid1", 1)
+	require.False(suite.T(), reporter.Collect().ConfigurationDrift)
+	suite.configure("Instance2", "uuid1", 2)
+	heartbeat = reporter.Collect()
+	require.True(suite.T(), heartbeat.ConfigurationDrift)
+	require.Equal(suite.T(), "uuid1", heartbeat.Processors[0].Heartbeat.ConfigurationUUID)
+	require.Equal(suite.T(), uint64(1), heartbeat.Processors[0].Heartbeat.ConfigurationVersion)
+	require.Equal(suite.T(), uint64(2), heartbeat.Processors[1].Heartbeat.ConfigurationVersion)
+	suite.configure("Instance1", "uuid1", 2)
+	require.False(suite.T(), reporter.Collect().ConfigurationDrift)
+
+	//The state of shut down instances is reported
+	require.NoError(suite.T(), suite.builder.ShutdownProcessor("Instance2"))
+	heartbeat = reporter.Collect()
+	require.Equal(suite.T(), "Stopped", heartbeat.Processors[1].State)
+
+	_, err = NewReporter(suite.builder, nil, ReporterParams{})
+	require.Error(suite.T(), err, "created reporter without sink")
+	_, err = NewReporter(suite.builder, suite.sink, ReporterParams{Interval: -1})
+	require.Error(suite.T(), err, "created reporter with negative interval")
+}
+
+func (suite *ReporterTestSuite) TestReporter__Run() {
+	reporter, err := NewReporter(suite.builder, suite.sink, ReporterParams{
+		Interval: 10 * time.Millisecond,
+		Timeout:  time.Second,
+	})
+	require.NoError(suite.T(), err, "failed to create reporter: %s", err)
+	require.NoError(suite.T(), reporter.Run(), "failed to run reporter")
+	require.Error(suite.T(), reporter.Run(), "reporter was run twice")
+
+	err = wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(suite.sink.Events()) >= 3, nil
+	})
+	require.NoError(suite.T(), err, "heartbeats were not reported: %s", err)
+	reporter.Shutdown()
+	reporter.Shutdown()
+
+	reported := len(suite.sink.Events())
+	time.Sleep(50 * time.Millisecond)
+	events := suite.sink.Events()
+	require.Equal(suite.T(), reported, len(events), "reported after shutdown")
+	require.Equal(suite.T(), pb.EventType_AgentHeartbeatEventType, events[0].Type)
+	require.Equal(suite.T(), 2, len(events[0].GetAgentHeartbeat().Processors))
+
+	//The reporter can be run again after shutdown
+	require.NoError(suite.T(), reporter.Run(), "failed to rerun reporter")
+	reporter.Shutdown()
+}
+
+func TestReporter__RUN(t *testing.T) {
+	crt := new(ReporterTestSuite)
+	suite.Run(t, crt)
+}
+
+//Helper method for updating the configuration of an instance
+func (suite *ReporterTestSuite) configure(name string, uuid string, version uint64) {
+	iter := suite.builder.GetProcessorsIterator()
+	for ; iter != nil; iter = iter.Next() {
+		info, err := iter.Current()
+		require.NoError(suite.T(), err, "failed to iterate instances: %s", err)
+		if info.Name() == name {
+			err = info.Instance().UpdateConfiguration(&pb.Configuration{UUID: uuid, Version: version})
+			require.NoError(suite.T(), err, "failed to configure instance %s: %s", name, err)
+			return
+		}
+	}
+	require.Fail(suite.T(), "missing instance", name)
+}
+
+//Sink recording the pushed events
+type recordingSink struct {
+	lock   sync.Mutex
+	events []*pb.Event
+}
+
+func (s *recordingSink) RunQuery(query *pb.Query) (*pb.QueryResult, error) {
+	return nil, nil
+}
+
+func (s *recordingSink) PushEvent(event *pb.Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *recordingSink) RunQueryContext(ctx context.Context, query *pb.Query) (*pb.QueryResult, error) {
+	return s.RunQuery(query)
+}
+
+func (s *recordingSink) PushEventContext(ctx context.Context, event *pb.Event) error {
+	return s.PushEvent(event)
+}
+
+func (s *recordingSink) Events() []*pb.Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*pb.Event{}, s.events...)
+}
@@ -0,0 +1,283 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Returned by an async querier for queries submitted while all of its workers are busy
+//and its queue is full
+var ErrQueryQueueFull = errors.New("async query queue is full")
+
+const (
+	defaultAsyncWorkers   = 4
+	defaultAsyncQueueSize = 1000
+)
+
+//Provider of the egress query sinks, as BaseProcessor
+type QuerySinkProvider interface {
+	GetQuerySink(queryType proto.QueryType) (SinkInterface, error)
+}
+
+//Callback invoked with the outcome of an async query:
+//Invoked from the querier goroutines, so it should not block.
+type QueryCallback func(result *proto.QueryResult, err error)
+
+//Parameters of an async querier
+type AsyncQuerierParams struct {
+	//Number of queries run concurrently (default 4)
+	Workers int
+	//Number of queries waiting for a worker, beyond which queries are rejected (default 1000)
+	QueueSize int
+	//Deadline of each query from its submission, zero for none
+	Timeout time.Duration
+}
+
+//Check async querier params validity and fill in defaults
+func (p *AsyncQuerierParams) validate() error {
+	if p.Workers < 0 || p.QueueSize < 0 || p.Timeout < 0 {
+		return fmt.Errorf("async querier params should not be negative")
+	}
+	if p.Workers == 0 {
+		p.Workers = defaultAsyncWorkers
+	}
+	if p.QueueSize == 0 {
+		p.QueueSize = defaultAsyncQueueSize
+	}
+	return nil
+}
+
+//The pending outcome of an async query
+type QueryFuture struct {
+	querier  *AsyncQuerier
+	query    *proto.Query
+	callback QueryCallback
+
+	//Context of the query call, cancelled once the query is completed in any way
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+
+	once   sync.Once
+	done   chan struct{}
+	result *proto.QueryResult
+	err    error
+}
+
+//Get the UUID the query result is correlated by
+func (f *QueryFuture) UUID() string {
+	return f.query.UUID
+}
+
+//Get a channel closed once the query is completed
+func (f *QueryFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+//Wait for the query outcome
+func (f *QueryFuture) Result() (*proto.QueryResult, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+//Wait for the query outcome until the context is done:
+//The query itself is not cancelled when the wait is abandoned.
+func (f *QueryFuture) Wait(ctx context.Context) (*proto.QueryResult, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, contextError(ctx.Err(), "wait for query", 0)
+	}
+}
+
+//Cancel the query, completing it with a cancellation error unless already completed
+func (f *QueryFuture) Cancel() {
+	f.querier.complete(f, nil, contextError(context.Canceled, "run query", 0))
+}
+
+//This is an egress object running queries asynchronously through the sinks of a processor:
+//Queries are queued to a fixed pool of workers, so any number of queries may be outstanding
+//without a goroutine per call. Each query outcome is correlated with its query by UUID and
+//delivered through a future or a callback, and a query not answered within the timeout is
+//completed with a TimeoutError, abandoning its call.
+type AsyncQuerier struct {
+	sinks  QuerySinkProvider
+	params AsyncQuerierParams
+	queue  chan *QueryFuture
+
+	//Guards the outstanding queries and the closed state
+	lock        sync.Mutex
+	outstanding map[string]*QueryFuture
+	closed      bool
+
+	//For waiting for the workers to return on Close
+	wg sync.WaitGroup
+}
+
+//Create async querier and start its workers:
+//sinks provides the query sinks by query type, usually the processor owning the querier.
+func NewAsyncQuerier(sinks QuerySinkProvider, params AsyncQuerierParams) (*AsyncQuerier, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	a := &AsyncQuerier{
+		sinks:       sinks,
+		params:      params,
+		queue:       make(chan *QueryFuture, params.QueueSize),
+		outstanding: make(map[string]*QueryFuture),
+	}
+	a.wg.Add(params.Workers)
+	for i := 0; i < params.Workers; i++ {
+		go a.work()
+	}
+	return a, nil
+}
+
+//Submit query returning a future of its outcome:
+//A query with no UUID is assigned a new one, while a query with the UUID of an outstanding
+//query is rejected. ctx is the context of the query call, cancelling it abandons the query.
+func (a *AsyncQuerier) RunQueryAsync(ctx context.Context, query *proto.Query) (*QueryFuture, error) {
+	return a.submit(ctx, query, nil)
+}
+
+//Submit query invoking callback with its outcome, as RunQueryAsync
+func (a *AsyncQuerier) RunQueryCallback(ctx context.Context, query *proto.Query, callback QueryCallback) error {
+	_, err := a.submit(ctx, query, callback)
+	return err
+}
+
+//Get the number of submitted queries not completed yet
+func (a *AsyncQuerier) Outstanding() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.outstanding)
+}
+
+//Stop the workers, completing the outstanding queries with an error
+func (a *AsyncQuerier) Close() {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.queue)
+	outstanding := make([]*QueryFuture, 0, len(a.outstanding))
+	for _, future := range a.outstanding {
+		outstanding = append(outstanding, future)
+	}
+	a.lock.Unlock()
+
+	for _, future := range outstanding {
+		a.complete(future, nil, fmt.Errorf("async querier is closed"))
+	}
+	a.wg.Wait()
+}
+
+//Private method for queueing a query
+func (a *AsyncQuerier) submit(ctx context.Context, query *proto.Query, callback QueryCallback) (*QueryFuture, error) {
+	if query.UUID == "" {
+		query.UUID = uuid.New().String()
+	}
+	future := &QueryFuture{
+		querier:  a,
+		query:    query,
+		callback: callback,
+		done:     make(chan struct{}),
+	}
+	future.ctx, future.cancel = context.WithCancel(ctx)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		future.cancel()
+		return nil, fmt.Errorf("async querier is closed")
+	}
+	if _, exists := a.outstanding[query.UUID]; exists {
+		future.cancel()
+		return nil, fmt.Errorf("query %s is already outstanding", query.UUID)
+	}
+	a.outstanding[query.UUID] = future
+	if a.params.Timeout > 0 {
+		future.timer = time.AfterFunc(a.params.Timeout, func() {
+			a.complete(future, nil, contextError(context.DeadlineExceeded, "run query", a.params.Timeout))
+		})
+	}
+	select {
+	case a.queue <- future:
+	default:
+		delete(a.outstanding, query.UUID)
+		if future.timer != nil {
+			future.timer.Stop()
+		}
+		future.cancel()
+		return nil, ErrQueryQueueFull
+	}
+	return future, nil
+}
+
+//Private run loop of a worker
+func (a *AsyncQuerier) work() {
+	defer a.wg.Done()
+	for future := range a.queue {
+		select {
+		case <-future.done:
+			//Completed while queued
+			continue
+		default:
+		}
+		result, err := a.run(future)
+		a.correlate(future, result, err)
+	}
+}
+
+//Private method for running a query through the sink of its type
+func (a *AsyncQuerier) run(future *QueryFuture) (*proto.QueryResult, error) {
+	if err := future.ctx.Err(); err != nil {
+		return nil, contextError(err, "run query", 0)
+	}
+	sink, err := a.sinks.GetQuerySink(future.query.Type)
+	if err != nil {
+		return nil, err
+	}
+	return RunQueryWithContext(future.ctx, sink, future.query)
+}
+
+//Private method for completing a query with its outcome, verifying the result correlates with it by UUID
+func (a *AsyncQuerier) correlate(future *QueryFuture, result *proto.QueryResult, err error) {
+	if err == nil && result != nil && result.UUID != "" && result.UUID != future.query.UUID {
+		err = fmt.Errorf("query %s was answered with result %s", future.query.UUID, result.UUID)
+		result = nil
+	}
+	a.complete(future, result, err)
+}
+
+//Private method for completing a query once, releasing its resources
+func (a *AsyncQuerier) complete(future *QueryFuture, result *proto.QueryResult, err error) {
+	completed := false
+	future.once.Do(func() {
+		completed = true
+		a.lock.Lock()
+		if a.outstanding[future.query.UUID] == future {
+			delete(a.outstanding, future.query.UUID)
+		}
+		a.lock.Unlock()
+		if future.timer != nil {
+			future.timer.Stop()
+		}
+		future.cancel()
+		future.result, future.err = result, err
+		close(future.done)
+	})
+	if completed && future.callback != nil {
+		future.callback(result, err)
+	}
+}
@@ -0,0 +1,163 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type AsyncQuerierTestSuite struct {
+	suite.Suite
+}
+
+func (suite *AsyncQuerierTestSuite) SetupTest() {
+}
+
+func (suite *AsyncQuerierTestSuite) TearDownTest() {
+}
+
+func (suite *AsyncQuerierTestSuite) TestAsyncQuerier__Futures() {
+	replica := &replicaSink{block: make(chan struct{})}
+	querier, err := NewAsyncQuerier(newQuerierProcessor(replica), AsyncQuerierParams{Workers: 2})
+	require.NoError(suite.T(), err, "failed to create querier: %s", err)
+	defer querier.Close()
+
+	//Many queries are outstanding at once over few workers
+	futures := make([]*QueryFuture, 10)
+	for i := range futures {
+		query := &pb.Query{Type: pb.QueryType_DummyQueryType, UUID: "query-" + strconv.Itoa(i)}
+		futures[i], err = querier.RunQueryAsync(context.Background(), query)
+		require.NoError(suite.T(), err, "failed to submit query: %s", err)
+	}
+	require.Equal(suite.T(), 10, querier.Outstanding())
+	_, err = querier.RunQueryAsync(context.Background(), &pb.Query{UUID: "query-0"})
+	require.Error(suite.T(), err, "submitted query with outstanding UUID")
+
+	//Queries with no UUID are assigned one
+	anonymous, err := querier.RunQueryAsync(context.Background(), &pb.Query{})
+	require.NoError(suite.T(), err, "failed to submit query: %s", err)
+	require.NotEmpty(suite.T(), anonymous.UUID())
+
+	close(replica.block)
+	for i, future := range futures {
+		result, err := future.Result()
+		require.NoError(suite.T(), err, "query failed: %s", err)
+		require.Equal(suite.T(), "query-"+strconv.Itoa(i), result.UUID)
+	}
+	result, err := anonymous.Wait(context.Background())
+	require.NoError(suite.T(), err, "query failed: %s", err)
+	require.Equal(suite.T(), anonymous.UUID(), result.UUID)
+	require.Zero(suite.T(), querier.Outstanding())
+	require.Equal(suite.T(), int64(11), replica.queries.Load())
+}
+
+func (suite *AsyncQuerierTestSuite) TestAsyncQuerier__TimeoutAndCallback() {
+	replica := &replicaSink{block: make(chan struct{})}
+	querier, err := NewAsyncQuerier(newQuerierProcessor(replica), AsyncQuerierParams{
+		Workers:   1,
+		QueueSize: 1,
+		Timeout:   50 * time.Millisecond,
+	})
+	require.NoError(suite.T(), err, "failed to create querier: %s", err)
+
+	outcomes := make(chan error, 2)
+	callback := func(result *pb.QueryResult, err error) {
+		outcomes <- err
+	}
+	require.NoError(suite.T(), querier.RunQueryCallback(context.Background(), &pb.Query{UUID: "first"}, callback))
+	err = wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return replica.queries.Load() == 1, nil
+	})
+	require.NoError(suite.T(), err, "query was not run: %s", err)
+	require.NoError(suite.T(), querier.RunQueryCallback(context.Background(), &pb.Query{UUID: "second"}, callback))
+	_, err = querier.RunQueryAsync(context.Background(), &pb.Query{UUID: "third"})
+	require.Equal(suite.T(), ErrQueryQueueFull, err)
+
+	//Both the running and the queued queries time out
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-outcomes:
+			var timeoutErr *TimeoutError
+			require.True(suite.T(), errors.As(err, &timeoutErr), "unexpected error %v", err)
+		case <-time.After(5 * time.Second):
+			require.Fail(suite.T(), "query did not time out")
+		}
+	}
+	require.Zero(suite.T(), querier.Outstanding())
+	close(replica.block)
+	querier.Close()
+	require.Equal(suite.T(), int64(1), replica.queries.Load())
+}
+
+func (suite *AsyncQuerierTestSuite) TestAsyncQuerier__Failures() {
+	//Queries with no sink fail
+	querier, err := NewAsyncQuerier(newQuerierProcessor(nil), AsyncQuerierParams{})
+	require.NoError(suite.T(), err, "failed to create querier: %s", err)
+	future, err := querier.RunQueryAsync(context.Background(), &pb.Query{})
+	require.NoError(suite.T(), err, "failed to submit query: %s", err)
+	_, err = future.Result()
+	require.Error(suite.T(), err, "ran query with no sink")
+	querier.Close()
+	_, err = querier.RunQueryAsync(context.Background(), &pb.Query{})
+	require.Error(suite.T(), err, "submitted query to closed querier")
+
+	//Results of other queries are rejected
+	querier, err = NewAsyncQuerier(newQuerierProcessor(&uuidSink{}), AsyncQuerierParams{})
+	require.NoError(suite.T(), err, "failed to create querier: %s", err)
+	future, err = querier.RunQueryAsync(context.Background(), &pb.Query{UUID: "query"})
+	require.NoError(suite.T(), err, "failed to submit query: %s", err)
+	_, err = future.Result()
+	require.Error(suite.T(), err, "accepted result of another query")
+	querier.Close()
+
+	//Cancelled and closed queries complete with an error
+	replica := &replicaSink{block: make(chan struct{})}
+	defer close(replica.block)
+	querier, err = NewAsyncQuerier(newQuerierProcessor(replica), AsyncQuerierParams{Workers: 1})
+	require.NoError(suite.T(), err, "failed to create querier: %s", err)
+	first, err := querier.RunQueryAsync(context.Background(), &pb.Query{})
+	require.NoError(suite.T(), err, "failed to submit query: %s", err)
+	second, err := querier.RunQueryAsync(context.Background(), &pb.Query{})
+	require.NoError(suite.T(), err, "failed to submit query: %s", err)
+	second.Cancel()
+	_, err = second.Result()
+	require.True(suite.T(), errors.Is(err, context.Canceled), "unexpected error %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = first.Wait(ctx)
+	require.Error(suite.T(), err, "waited for blocked query")
+	go querier.Close()
+	_, err = first.Result()
+	require.Error(suite.T(), err, "blocked query completed on close")
+}
+
+func TestAsyncQuerier__RUN(t *testing.T) {
+	crt := new(AsyncQuerierTestSuite)
+	suite.Run(t, crt)
+}
+
+//Helper function for creating a processor with a dummy query sink
+func newQuerierProcessor(sink SinkInterface) *BaseProcessor {
+	p := newBaseProcessor(BaseProcessorParams{LivenessInterval: time.Second})
+	if sink != nil {
+		_ = p.AddQuerySink(pb.QueryType_DummyQueryType, sink)
+	}
+	return p
+}
+
+//Sink answering queries with results of another UUID
+type uuidSink struct {
+	SinkInterface
+}
+
+func (u *uuidSink) RunQueryContext(ctx context.Context, query *pb.Query) (*pb.QueryResult, error) {
+	return &pb.QueryResult{Type: query.Type, UUID: query.UUID + "-other"}, nil
+}
@@ -0,0 +1,201 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"go.uber.org/atomic"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Strategy used by a balanced sink for selecting the replica to run a query on
+type BalancingStrategy int
+
+const (
+	//Select the ready replicas in turns
+	BalanceRoundRobin BalancingStrategy = iota
+	//Select the ready replica with the least queries currently running on it
+	BalanceLeastOutstanding
+	//Select the replica by a consistent hash of the query key, so the same query
+	//keeps going to the same replica as long as it is ready
+	BalanceConsistentHash
+)
+
+var balancingStrategyNames = map[BalancingStrategy]string{
+	BalanceRoundRobin:       "roundRobin",
+	BalanceLeastOutstanding: "leastOutstanding",
+	BalanceConsistentHash:   "consistentHash",
+}
+
+func (s BalancingStrategy) String() string {
+	if name, exists := balancingStrategyNames[s]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+//Get balancing strategy by its name
+func ParseBalancingStrategy(name string) (BalancingStrategy, error) {
+	for strategy, strategyName := range balancingStrategyNames {
+		if strategyName == name {
+			return strategy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown balancing strategy %s", name)
+}
+
+//Returned when none of the balanced sink replicas is ready
+var ErrNoReadyReplica = errors.New("no ready replica")
+
+//Number of points each replica has on the consistent hash ring
+const ringPointsPerReplica = 64
+
+type balancedReplica struct {
+	name        string
+	sink        SinkInterface
+	isReady     func() bool
+	outstanding atomic.Int64
+}
+
+type ringPoint struct {
+	hash    uint64
+	replica int
+}
+
+//This is a queries egress object balancing the queries between replicated services:
+//Replicas which are not ready are skipped.
+type BalancedSink struct {
+	SinkInterface
+	strategy BalancingStrategy
+	replicas []*balancedReplica
+
+	//Next replica index for round robin strategy
+	next atomic.Uint64
+	//Sorted points for consistent hash strategy
+	ring []ringPoint
+}
+
+//Create balanced sink with no replicas
+func NewBalancedSink(strategy BalancingStrategy) *BalancedSink {
+	return &BalancedSink{
+		strategy: strategy,
+	}
+}
+
+//Add replica sink:
+//isReady is the replica readiness check, nil for a replica which is always ready.
+//Should be called during bootstrap when building the processors and relations from a single thread.
+func (b *BalancedSink) AddReplica(name string, sink SinkInterface, isReady func() bool) error {
+	for _, replica := range b.replicas {
+		if replica.name == name {
+			return fmt.Errorf("replica %s already exists", name)
+		}
+	}
+	if isReady == nil {
+		isReady = func() bool { return true }
+	}
+	b.replicas = append(b.replicas, &balancedReplica{
+		name:    name,
+		sink:    sink,
+		isReady: isReady,
+	})
+
+	//Add the replica points to the hash ring
+	index := len(b.replicas) - 1
+	for i := 0; i < ringPointsPerReplica; i++ {
+		b.ring = append(b.ring, ringPoint{
+			hash:    hashString(name + "#" + strconv.Itoa(i)),
+			replica: index,
+		})
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	return nil
+}
+
+func (b *BalancedSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return b.RunQueryContext(context.Background(), query)
+}
+
+func (b *BalancedSink) PushEvent(event *proto.Event) error {
+	return b.PushEventContext(context.Background(), event)
+}
+
+func (b *BalancedSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	replica, err := b.selectReplica(query)
+	if err != nil {
+		return nil, err
+	}
+	replica.outstanding.Inc()
+	defer replica.outstanding.Dec()
+	return RunQueryWithContext(ctx, replica.sink, query)
+}
+
+func (b *BalancedSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	return fmt.Errorf("events are not supported by balanced sink")
+}
+
+//Private method for selecting a ready replica according to the strategy
+func (b *BalancedSink) selectReplica(query *proto.Query) (*balancedReplica, error) {
+	if len(b.replicas) == 0 {
+		return nil, fmt.Errorf("no replicas for balanced sink")
+	}
+
+	switch b.strategy {
+	case BalanceLeastOutstanding:
+		var selected *balancedReplica
+		for _, replica := range b.replicas {
+			if !replica.isReady() {
+				continue
+			}
+			if selected == nil || replica.outstanding.Load() < selected.outstanding.Load() {
+				selected = replica
+			}
+		}
+		if selected != nil {
+			return selected, nil
+		}
+	case BalanceConsistentHash:
+		key, err := QueryKey(query)
+		if err != nil {
+			return nil, err
+		}
+		hash := hashString(key)
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+		//Walk the ring clockwise until meeting a ready replica
+		for i := 0; i < len(b.ring); i++ {
+			replica := b.replicas[b.ring[(start+i)%len(b.ring)].replica]
+			if replica.isReady() {
+				return replica, nil
+			}
+		}
+	default:
+		start := b.next.Inc() - 1
+		for i := uint64(0); i < uint64(len(b.replicas)); i++ {
+			replica := b.replicas[(start+i)%uint64(len(b.replicas))]
+			if replica.isReady() {
+				return replica, nil
+			}
+		}
+	}
+	return nil, ErrNoReadyReplica
+}
+
+//Hash a string for the consistent hash ring:
+//FNV alone hardly changes the high bits for keys differing only in their last bytes,
+//so its result is mixed further for spreading similar keys over the ring.
+func hashString(value string) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(value))
+	sum := hash.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	return sum
+}
@@ -0,0 +1,177 @@
+package processor
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/atomic"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type BalancedSinkTestSuite struct {
+	suite.Suite
+}
+
+func (suite *BalancedSinkTestSuite) SetupTest() {
+}
+
+func (suite *BalancedSinkTestSuite) TearDownTest() {
+}
+
+func (suite *BalancedSinkTestSuite) TestBalancedSink__RoundRobin() {
+	balanced, replicas := newBalancedSinkWithReplicas(suite.T(), BalanceRoundRobin, 3)
+	err := balanced.AddReplica("replica0", replicas[0], nil)
+	require.Error(suite.T(), err, "added same replica twice")
+
+	//Queries go to the replicas in order of addition, starting from the first one
+	queries, _ := prepareQueries(9)
+	for i, query := range queries {
+		result, err := balanced.RunQuery(query)
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+		require.Equal(suite.T(), query.UUID, result.UUID)
+		require.Equal(suite.T(), int64(i/3+1), replicas[i%3].queries.Load(), "query %d went to unexpected replica", i)
+	}
+	for _, replica := range replicas {
+		require.Equal(suite.T(), int64(3), replica.queries.Load())
+	}
+
+	err = balanced.PushEvent(prepareEvents(1)[0])
+	require.Error(suite.T(), err, "balanced sink pushed an event")
+}
+
+func (suite *BalancedSinkTestSuite) TestBalancedSink__SkipUnready() {
+	for _, strategy := range []BalancingStrategy{BalanceRoundRobin, BalanceLeastOutstanding, BalanceConsistentHash} {
+		balanced, replicas := newBalancedSinkWithReplicas(suite.T(), strategy, 3)
+		replicas[0].ready.Store(false)
+		replicas[2].ready.Store(false)
+
+		queries, _ := prepareQueries(7)
+		for _, query := range queries[:6] {
+			_, err := balanced.RunQuery(query)
+			require.NoError(suite.T(), err, "failed to run query with %s: %s", strategy, err)
+		}
+		require.Equal(suite.T(), int64(6), replicas[1].queries.Load(), "queries ran on unready replica with %s", strategy)
+
+		replicas[1].ready.Store(false)
+		_, err := balanced.RunQuery(queries[6])
+		require.Equal(suite.T(), ErrNoReadyReplica, err, "unexpected error with %s", strategy)
+	}
+}
+
+func (suite *BalancedSinkTestSuite) TestBalancedSink__LeastOutstanding() {
+	balanced, replicas := newBalancedSinkWithReplicas(suite.T(), BalanceLeastOutstanding, 2)
+
+	//Keep a query running on the first selected replica
+	replicas[0].block = make(chan struct{})
+	queries, _ := prepareQueries(5)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = balanced.RunQuery(queries[0])
+	}()
+	err := wait.Poll(time.Millisecond, time.Second, func() (bool, error) { return replicas[0].queries.Load() == 1, nil })
+	require.NoError(suite.T(), err, "query did not reach the first replica")
+
+	//Other queries go to the idle replica
+	for _, query := range queries[1:] {
+		_, err := balanced.RunQuery(query)
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+	}
+	require.Equal(suite.T(), int64(4), replicas[1].queries.Load())
+	close(replicas[0].block)
+	wg.Wait()
+}
+
+func (suite *BalancedSinkTestSuite) TestBalancedSink__ConsistentHash() {
+	balanced, replicas := newBalancedSinkWithReplicas(suite.T(), BalanceConsistentHash, 3)
+
+	//Same query with different UUIDs goes to the same replica
+	queries, _ := prepareQueries(100)
+	for i := 0; i < 5; i++ {
+		query := *queries[0]
+		query.UUID = strconv.Itoa(i)
+		_, err := balanced.RunQuery(&query)
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+	}
+	used := 0
+	for _, replica := range replicas {
+		if replica.queries.Load() > 0 {
+			require.Equal(suite.T(), int64(5), replica.queries.Load())
+			used++
+		}
+	}
+	require.Equal(suite.T(), 1, used)
+
+	//Different queries spread over the replicas
+	for _, query := range queries {
+		_, err := balanced.RunQuery(query)
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+	}
+	for i, replica := range replicas {
+		require.NotZero(suite.T(), replica.queries.Load(), "replica %d got no queries", i)
+	}
+}
+
+func (suite *BalancedSinkTestSuite) TestBalancedSink__ParseStrategy() {
+	for _, strategy := range []BalancingStrategy{BalanceRoundRobin, BalanceLeastOutstanding, BalanceConsistentHash} {
+		parsed, err := ParseBalancingStrategy(strategy.String())
+		require.NoError(suite.T(), err, "failed to parse strategy: %s", err)
+		require.Equal(suite.T(), strategy, parsed)
+	}
+	_, err := ParseBalancingStrategy("random")
+	require.Error(suite.T(), err, "parsed unknown strategy")
+
+	queries, _ := prepareQueries(1)
+	_, err = NewBalancedSink(BalanceRoundRobin).RunQuery(queries[0])
+	require.Error(suite.T(), err, "balanced sink with no replicas ran a query")
+}
+
+func TestBalancedSink__RUN(t *testing.T) {
+	crt := new(BalancedSinkTestSuite)
+	suite.Run(t, crt)
+}
+
+//Replica stub counting its queries
+type replicaSink struct {
+	SinkInterface
+	queries atomic.Int64
+	ready   atomic.Bool
+	block   chan struct{}
+}
+
+func (r *replicaSink) RunQuery(query *pb.Query) (*pb.QueryResult, error) {
+	return r.RunQueryContext(context.Background(), query)
+}
+
+func (r *replicaSink) RunQueryContext(ctx context.Context, query *pb.Query) (*pb.QueryResult, error) {
+	r.queries.Inc()
+	if r.block != nil {
+		<-r.block
+	}
+	return &pb.QueryResult{
+		Type: query.Type,
+		UUID: query.UUID,
+	}, nil
+}
+
+//Helper function for creating balanced sink with ready replicas
+func newBalancedSinkWithReplicas(t *testing.T, strategy BalancingStrategy, num int) (*BalancedSink, []*replicaSink) {
+	balanced := NewBalancedSink(strategy)
+	replicas := make([]*replicaSink, num)
+	for i := range replicas {
+		replica := &replicaSink{}
+		replica.ready.Store(true)
+		err := balanced.AddReplica("replica"+strconv.Itoa(i), replica, replica.ready.Load)
+		require.NoError(t, err, "failed to add replica: %s", err)
+		replicas[i] = replica
+	}
+	return balanced, replicas
+}
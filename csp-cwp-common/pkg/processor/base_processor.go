@@ -0,0 +1,304 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Run loop of a processor embedding BaseProcessor:
+//Called from the processor goroutine on Run and should return once stop channel is closed.
+//Returning before that (as on error) stops the processor liveness and readiness indications.
+type RunLoop func(stop <-chan struct{}) error
+
+type BaseProcessorParams struct {
+	//Liveness update interval
+	LivenessInterval time.Duration
+	//The processor run loop, optional for processors which only react to received events
+	RunLoop RunLoop
+}
+
+//Reusable implementation of the ProcessorInterface boilerplate:
+//Owns the ingress tap, the egress sinks registries, readiness and liveness indications
+//and the heartbeat configuration tracking.
+//A concrete processor embeds it and only supplies its event handling and run loop:
+//
+//type MyProcessor struct {
+//	*processor.BaseProcessor
+//}
+//
+//func NewMyProcessor() processor.ProcessorInterface {
+//	p := &MyProcessor{}
+//	p.BaseProcessor = processor.NewBaseProcessor(p, processor.BaseProcessorParams{
+//		LivenessInterval: time.Second,
+//		RunLoop:          p.loop,
+//	})
+//	return p
+//}
+type BaseProcessor struct {
+	livenessLock  sync.RWMutex //For protecting liveness
+	readinessLock sync.RWMutex //For protecting readiness
+	heartbeatLock sync.RWMutex //For protecting config updates while getting heartbeat.
+	runLock       sync.Mutex   //For protecting Run and Shutdown calls
+
+	//Local ingress Tap
+	tap TapInterface
+
+	//Mapping of sinks to events and query types
+	eventSinks map[proto.EventType]SinkInterface
+	querySinks map[proto.QueryType]SinkInterface
+
+	//For liveness check
+	livenessTimestamp time.Time
+
+	//For readiness
+	isReady bool
+
+	//For heartbeat and configuration update information
+	heartbeatMsg proto.Heartbeat
+	//Mapping from a component name to its status, reported on the heartbeat
+	statuses map[string]string
+
+	params BaseProcessorParams
+
+	//For signaling the run goroutine to stop from Shutdown call and waiting for it to finish
+	stop chan struct{}
+	done chan struct{}
+	//Error returned by the last run loop
+	loopErr error
+}
+
+//Create the base of a processor:
+//handler is the embedding processor, used as the event handler of the ingress tap.
+func NewBaseProcessor(handler ProcessorInterface, params BaseProcessorParams) *BaseProcessor {
+	bp := newBaseProcessor(params)
+	bp.tap = NewProcessorTap(handler)
+	return bp
+}
+
+func newBaseProcessor(params BaseProcessorParams) *BaseProcessor {
+	return &BaseProcessor{
+		eventSinks: make(map[proto.EventType]SinkInterface),
+		querySinks: make(map[proto.QueryType]SinkInterface),
+		statuses:   make(map[string]string),
+		params:     params,
+	}
+}
+
+//Get ingress tap
+func (bp *BaseProcessor) GetTap() TapInterface {
+	return bp.tap
+}
+
+//Replace the default ingress tap (as with a queued tap):
+//Should be called from the embedding processor constructor.
+func (bp *BaseProcessor) SetTap(tap TapInterface) {
+	bp.tap = tap
+}
+
+//Run the processor:
+//Starts the liveness updates and the run loop from a new goroutine.
+func (bp *BaseProcessor) Run() error {
+	if bp.params.LivenessInterval == 0 {
+		return fmt.Errorf("provided zero liveness interval")
+	}
+
+	bp.runLock.Lock()
+	defer bp.runLock.Unlock()
+
+	if bp.isRunning() {
+		return fmt.Errorf("processor is already running")
+	}
+	bp.stop = make(chan struct{})
+	bp.done = make(chan struct{})
+	bp.loopErr = nil
+
+	//Mark ready before returning so callers can rely on it once Run succeeded
+	bp.setLiveness()
+	bp.setReadiness(true)
+	go bp.run(bp.stop, bp.done)
+	return nil
+}
+
+//Shutdown the processor:
+//Signals the run loop to stop and waits for it to return.
+//Return the error the run loop returned, if any.
+func (bp *BaseProcessor) Shutdown() error {
+	bp.runLock.Lock()
+	defer bp.runLock.Unlock()
+
+	if bp.stop == nil {
+		return nil
+	}
+	close(bp.stop)
+	<-bp.done
+	bp.stop = nil
+	return bp.loopErr
+}
+
+//Check if the run loop returned by itself since the last Run, along with the error it returned
+func (bp *BaseProcessor) Exited() (bool, error) {
+	bp.runLock.Lock()
+	defer bp.runLock.Unlock()
+
+	if bp.stop == nil || bp.isRunning() {
+		return false, nil
+	}
+	return true, bp.loopErr
+}
+
+//Add sink for Event:
+//Should be called during bootstrap when building the processors and relations from a single thread.
+func (bp *BaseProcessor) AddEventSink(eventType proto.EventType, sink SinkInterface) error {
+	if _, exists := bp.eventSinks[eventType]; exists {
+		return fmt.Errorf("sink already exists for event type %s", eventType)
+	}
+	bp.eventSinks[eventType] = sink
+	return nil
+}
+
+//Add sink for Query:
+//Should be called during bootstrap when building the processors and relations from a single thread.
+func (bp *BaseProcessor) AddQuerySink(queryType proto.QueryType, sink SinkInterface) error {
+	if _, exists := bp.querySinks[queryType]; exists {
+		return fmt.Errorf("sink already exists for query type %s", queryType)
+	}
+	bp.querySinks[queryType] = sink
+	return nil
+}
+
+//Get egress event sink
+func (bp *BaseProcessor) GetEventSink(eventType proto.EventType) (SinkInterface, error) {
+	sink, exists := bp.eventSinks[eventType]
+	if !exists {
+		return nil, fmt.Errorf("missing sink for event type %s", eventType)
+	}
+	return sink, nil
+}
+
+//Get egress query sink
+func (bp *BaseProcessor) GetQuerySink(queryType proto.QueryType) (SinkInterface, error) {
+	sink, exists := bp.querySinks[queryType]
+	if !exists {
+		return nil, fmt.Errorf("missing sink for query type %s", queryType)
+	}
+	return sink, nil
+}
+
+//Readiness check
+func (bp *BaseProcessor) IsReady() bool {
+	bp.readinessLock.RLock()
+	defer bp.readinessLock.RUnlock()
+
+	return bp.isReady
+}
+
+//Liveness check
+func (bp *BaseProcessor) IsAlive(gracePeriod time.Duration) bool {
+	bp.livenessLock.RLock()
+	defer bp.livenessLock.RUnlock()
+
+	return time.Now().Before(bp.livenessTimestamp.Add(gracePeriod * time.Second))
+}
+
+//Heartbeat message:
+//The composing struct should add the other information based on the implementation and call
+//this method for tracking the config updates and the reported components status.
+func (bp *BaseProcessor) GetHeartbeat() proto.Heartbeat {
+	bp.heartbeatLock.RLock()
+	defer bp.heartbeatLock.RUnlock()
+
+	heartbeat := bp.heartbeatMsg
+	components := make([]string, 0, len(bp.statuses))
+	for component, status := range bp.statuses {
+		components = append(components, component+": "+status)
+	}
+	sort.Strings(components)
+	heartbeat.Status = strings.Join(components, ", ")
+	return heartbeat
+}
+
+//Set the status of a processor component (as a relation circuit breaker) reported on the heartbeat:
+//An empty status removes the component.
+func (bp *BaseProcessor) ReportStatus(component string, status string) {
+	bp.heartbeatLock.Lock()
+	defer bp.heartbeatLock.Unlock()
+
+	if status == "" {
+		delete(bp.statuses, component)
+		return
+	}
+	bp.statuses[component] = status
+}
+
+//Update configuration and heartbeat message
+func (bp *BaseProcessor) UpdateConfiguration(conf *proto.Configuration) error {
+	bp.heartbeatLock.Lock()
+	defer bp.heartbeatLock.Unlock()
+
+	bp.heartbeatMsg.ConfigurationUUID = conf.UUID
+	bp.heartbeatMsg.ConfigurationVersion = conf.Version
+	return nil
+}
+
+//Private method for checking if the run goroutine is still running, called under runLock
+func (bp *BaseProcessor) isRunning() bool {
+	if bp.stop == nil {
+		return false
+	}
+	select {
+	case <-bp.done:
+		//Run loop returned by itself
+		return false
+	default:
+		return true
+	}
+}
+
+//Private run goroutine, updates liveness as long as the run loop did not return
+func (bp *BaseProcessor) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	defer bp.setReadiness(false)
+
+	loopDone := make(chan error, 1)
+	go func() {
+		if bp.params.RunLoop == nil {
+			<-stop
+			loopDone <- nil
+			return
+		}
+		loopDone <- bp.params.RunLoop(stop)
+	}()
+
+	ticker := time.NewTicker(bp.params.LivenessInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			bp.setLiveness()
+		case err := <-loopDone:
+			bp.loopErr = err
+			return
+		}
+	}
+}
+
+//Private method for setting readiness indication internally
+func (bp *BaseProcessor) setReadiness(ready bool) {
+	bp.readinessLock.Lock()
+	defer bp.readinessLock.Unlock()
+
+	bp.isReady = ready
+}
+
+//Private method for updating the livness timestamp internally
+func (bp *BaseProcessor) setLiveness() {
+	bp.livenessLock.Lock()
+	defer bp.livenessLock.Unlock()
+
+	bp.livenessTimestamp = time.Now()
+}
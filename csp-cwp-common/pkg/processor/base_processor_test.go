@@ -0,0 +1,110 @@
+package processor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type BaseProcessorTestSuite struct {
+	suite.Suite
+}
+
+func (suite *BaseProcessorTestSuite) SetupTest() {
+}
+
+func (suite *BaseProcessorTestSuite) TearDownTest() {
+}
+
+func (suite *BaseProcessorTestSuite) TestBaseProcessor__RunShutdown() {
+	p := NewTestProcessor(&TestProcessorParams{
+		LivenessInterval: time.Second,
+	})
+
+	//Shutdown before Run has nothing to stop
+	require.NoError(suite.T(), p.Shutdown(), "failed to shutdown processor before run")
+
+	require.NoError(suite.T(), p.Run(), "failed to run processor")
+	require.True(suite.T(), p.IsReady(), "processor is not ready after run")
+	require.Error(suite.T(), p.Run(), "processor was run twice")
+
+	require.NoError(suite.T(), p.Shutdown(), "failed to shutdown processor")
+	require.False(suite.T(), p.IsReady(), "processor is ready after shutdown")
+	require.NoError(suite.T(), p.Shutdown(), "failed on second shutdown call")
+
+	//Processor can be run again after shutdown
+	require.NoError(suite.T(), p.Run(), "failed to rerun processor")
+	require.NoError(suite.T(), p.Shutdown(), "failed to shutdown processor")
+}
+
+func (suite *BaseProcessorTestSuite) TestBaseProcessor__RunLoopError() {
+	p := &eventsCollector{}
+	p.BaseProcessor = NewBaseProcessor(p, BaseProcessorParams{
+		LivenessInterval: time.Second,
+		RunLoop: func(stop <-chan struct{}) error {
+			return fmt.Errorf("loop error")
+		},
+	})
+
+	exited, _ := p.Exited()
+	require.False(suite.T(), exited, "processor exited before run")
+	require.NoError(suite.T(), p.Run(), "failed to run processor")
+	//Processor should become unready once its loop returned
+	err := wait.Poll(time.Millisecond, time.Second, func() (bool, error) { return !p.IsReady(), nil })
+	require.NoError(suite.T(), err, "processor is still ready after loop returned")
+	exited, err = p.Exited()
+	require.True(suite.T(), exited, "returned loop was not reported")
+	require.Error(suite.T(), err, "run loop error was not reported")
+	require.Error(suite.T(), p.Shutdown(), "run loop error was not returned")
+	exited, _ = p.Exited()
+	require.False(suite.T(), exited, "processor exited after shutdown")
+}
+
+func (suite *BaseProcessorTestSuite) TestBaseProcessor__ReactiveProcessor() {
+	//A processor with no run loop only handles events pushed to its tap
+	p := &eventsCollector{}
+	p.BaseProcessor = NewBaseProcessor(p, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), p.Run(), "failed to run processor")
+
+	events := prepareEvents(3)
+	sink := NewSink(p.GetTap())
+	for _, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	require.Equal(suite.T(), events, p.events)
+
+	//Sinks registry
+	require.NoError(suite.T(), p.AddEventSink(pb.EventType_DummyEventType, sink), "failed to add event sink")
+	require.Error(suite.T(), p.AddEventSink(pb.EventType_DummyEventType, sink), "added event sink twice")
+	got, err := p.GetEventSink(pb.EventType_DummyEventType)
+	require.NoError(suite.T(), err, "missing event sink")
+	require.Equal(suite.T(), sink, got)
+	_, err = p.GetQuerySink(pb.QueryType_DummyQueryType)
+	require.Error(suite.T(), err, "got query sink which was not added")
+
+	require.NoError(suite.T(), p.Shutdown(), "failed to shutdown processor")
+}
+
+func TestBaseProcessor__RUN(t *testing.T) {
+	crt := new(BaseProcessorTestSuite)
+	suite.Run(t, crt)
+}
+
+//Minimal processor on top of BaseProcessor collecting the received events
+type eventsCollector struct {
+	*BaseProcessor
+	events []*pb.Event
+}
+
+func (ec *eventsCollector) PushEvent(event *pb.Event) error {
+	ec.events = append(ec.events, event)
+	return nil
+}
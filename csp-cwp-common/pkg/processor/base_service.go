@@ -0,0 +1,18 @@
+package processor
+
+//Reusable implementation of the ServiceInterface boilerplate:
+//Same as BaseProcessor, with an ingress tap passing both events and queries to the
+//embedding service, which only supplies its event and query handling and run loop.
+type BaseService struct {
+	*BaseProcessor
+}
+
+//Create the base of a service:
+//handler is the embedding service, used as the event and query handler of the ingress tap.
+func NewBaseService(handler ServiceInterface, params BaseProcessorParams) *BaseService {
+	bs := &BaseService{
+		BaseProcessor: newBaseProcessor(params),
+	}
+	bs.tap = NewServiceTap(handler, handler)
+	return bs
+}
@@ -0,0 +1,276 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+const (
+	defaultBatchEvents = 100
+	defaultBatchLinger = time.Second
+)
+
+//Parameters of a batching sink
+type BatchingSinkParams struct {
+	//Number of events completing a batch (default 100)
+	MaxEvents int
+	//Encoded size of the events completing a batch, zero for no limit
+	MaxBytes int
+	//Time the first event of a batch waits for the batch to complete before it is delivered anyway (default 1s)
+	Linger time.Duration
+}
+
+//Check batching sink params validity and fill in defaults
+func (p *BatchingSinkParams) validate() error {
+	if p.MaxEvents < 0 || p.MaxBytes < 0 || p.Linger < 0 {
+		return fmt.Errorf("batching sink limits should not be negative")
+	}
+	if p.MaxEvents == 0 {
+		p.MaxEvents = defaultBatchEvents
+	}
+	if p.Linger == 0 {
+		p.Linger = defaultBatchLinger
+	}
+	return nil
+}
+
+//This is an egress object delivering the events in batches:
+//Events are accumulated until the batch reaches the events count or the size limit, or its
+//first event lingered long enough, and are then pushed to the wrapped sink as a single event
+//of the same type holding an EventBatch. A batch completed or overflowed by an event is delivered
+//in the call pushing it, so its delivery error is returned to that call, while a lingering batch
+//is delivered in the background. Batches are delivered in order, without holding up the events
+//pushed meanwhile into the next batch. The events of a failed batch are dropped.
+//The pending batch is delivered on Close, after which events are rejected.
+//Queries are not batched and are passed to the wrapped sink directly.
+type BatchingSink struct {
+	SinkInterface
+	params BatchingSinkParams
+	sink   SinkInterface
+
+	//Guards the pending batch
+	lock   sync.Mutex
+	events []*proto.Event
+	bytes  int
+	timer  *time.Timer
+	//Incremented on each batch taken for delivery, so a lingering timer of a taken batch is
+	//ignored, and the batches are delivered in the order they were taken
+	generation uint64
+	closed     bool
+
+	//Generation of the next batch to deliver, signaled on each delivery
+	turnLock sync.Mutex
+	turn     uint64
+	turnDone *sync.Cond
+
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+//Create batching sink
+func NewBatchingSink(sink SinkInterface, params BatchingSinkParams) (*BatchingSink, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	b := &BatchingSink{
+		params: params,
+		sink:   sink,
+	}
+	b.turnDone = sync.NewCond(&b.turnLock)
+	return b, nil
+}
+
+func (b *BatchingSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return b.RunQueryContext(context.Background(), query)
+}
+
+func (b *BatchingSink) PushEvent(event *proto.Event) error {
+	return b.PushEventContext(context.Background(), event)
+}
+
+func (b *BatchingSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return RunQueryWithContext(ctx, b.sink, query)
+}
+
+//The event is acknowledged to the caller once it is added to a batch, unless it completes the batch.
+func (b *BatchingSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	size := event.Size()
+
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return fmt.Errorf("batching sink is closed")
+	}
+	//An event which would overflow the pending batch starts the next one, and is rejected
+	//along with the batch if the batch delivery fails, so it is not duplicated by retrying it
+	if b.params.MaxBytes > 0 && len(b.events) > 0 && b.bytes+size > b.params.MaxBytes {
+		generation, events := b.take()
+		b.lock.Unlock()
+		if err := b.deliver(ctx, generation, events); err != nil {
+			return err
+		}
+		b.lock.Lock()
+		if b.closed {
+			b.lock.Unlock()
+			return fmt.Errorf("batching sink is closed")
+		}
+	}
+	if len(b.events) == 0 {
+		generation := b.generation
+		b.timer = time.AfterFunc(b.params.Linger, func() { b.linger(generation) })
+	}
+	b.events = append(b.events, event)
+	b.bytes += size
+	if len(b.events) < b.params.MaxEvents && (b.params.MaxBytes == 0 || b.bytes < b.params.MaxBytes) {
+		b.lock.Unlock()
+		return nil
+	}
+	generation, events := b.take()
+	b.lock.Unlock()
+	return b.deliver(ctx, generation, events)
+}
+
+//Deliver the pending batch right away
+func (b *BatchingSink) Flush(ctx context.Context) error {
+	b.lock.Lock()
+	generation, events := b.take()
+	b.lock.Unlock()
+	return b.deliver(ctx, generation, events)
+}
+
+//Get the number of delivered batches
+func (b *BatchingSink) Delivered() uint64 {
+	return b.delivered.Load()
+}
+
+//Get the number of events dropped for their batch delivery failing
+func (b *BatchingSink) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+//Deliver the pending batch under the context, bounding the delivery, and reject further events
+func (b *BatchingSink) Close(ctx context.Context) error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	generation, events := b.take()
+	b.lock.Unlock()
+	return b.deliver(ctx, generation, events)
+}
+
+//Private method for delivering the pending batch of a lingering timer, unless already taken
+func (b *BatchingSink) linger(generation uint64) {
+	b.lock.Lock()
+	if generation != b.generation {
+		b.lock.Unlock()
+		return
+	}
+	generation, events := b.take()
+	b.lock.Unlock()
+	_ = b.deliver(context.Background(), generation, events)
+}
+
+//Private method for taking the pending batch for delivery along with its generation,
+//called with the lock held
+func (b *BatchingSink) take() (uint64, []*proto.Event) {
+	if len(b.events) == 0 {
+		return 0, nil
+	}
+	generation := b.generation
+	events := b.events
+	b.events = nil
+	b.bytes = 0
+	b.generation++
+	b.timer.Stop()
+	return generation, events
+}
+
+//Private method for delivering a taken batch once the batches taken before it were delivered
+func (b *BatchingSink) deliver(ctx context.Context, generation uint64, events []*proto.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	b.turnLock.Lock()
+	for b.turn != generation {
+		b.turnDone.Wait()
+	}
+	b.turnLock.Unlock()
+	defer func() {
+		b.turnLock.Lock()
+		b.turn++
+		b.turnDone.Broadcast()
+		b.turnLock.Unlock()
+	}()
+
+	batch := &proto.Event{
+		Type: events[0].Type,
+		Info: &proto.Event_Batch{
+			Batch: &proto.EventBatch{
+				Events: events,
+			},
+		},
+	}
+	if err := PushEventWithContext(ctx, b.sink, batch); err != nil {
+		b.dropped.Add(uint64(len(events)))
+		return fmt.Errorf("failed to deliver batch of %d events: %s", len(events), err)
+	}
+	b.delivered.Inc()
+	return nil
+}
+
+//Get the events of a batch event, flattening nested batches, or the event itself if it is not a batch
+func UnpackBatch(event *proto.Event) []*proto.Event {
+	batch := event.GetBatch()
+	if batch == nil {
+		return []*proto.Event{event}
+	}
+	events := make([]*proto.Event, 0, len(batch.Events))
+	for _, batched := range batch.Events {
+		events = append(events, UnpackBatch(batched)...)
+	}
+	return events
+}
+
+//Wrap a tap for pushing the events of the batches it receives one by one to its handler,
+//for processors consuming the relations delivering batches
+func NewUnpackingTap(tap TapInterface) TapInterface {
+	return &unpackingTap{
+		TapInterface: tap,
+	}
+}
+
+type unpackingTap struct {
+	TapInterface
+}
+
+func (u *unpackingTap) PushEvent(event *proto.Event) error {
+	return u.PushEventContext(context.Background(), event)
+}
+
+//All the events of a batch are pushed, the batch fails if any of them does.
+func (u *unpackingTap) PushEventContext(ctx context.Context, event *proto.Event) error {
+	events := UnpackBatch(event)
+	var firstErr error
+	failed := 0
+	for _, unpacked := range events {
+		if err := PushEventWithContext(ctx, u.TapInterface, unpacked); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("failed to push %d of %d batched events: %s", failed, len(events), firstErr)
+	}
+	return nil
+}
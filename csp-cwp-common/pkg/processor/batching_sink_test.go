@@ -0,0 +1,161 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type BatchingSinkTestSuite struct {
+	suite.Suite
+}
+
+func (suite *BatchingSinkTestSuite) SetupTest() {
+}
+
+func (suite *BatchingSinkTestSuite) TearDownTest() {
+}
+
+func (suite *BatchingSinkTestSuite) TestBatchingSink__Count() {
+	_, err := NewBatchingSink(&recordingSink{}, BatchingSinkParams{MaxEvents: -1})
+	require.Error(suite.T(), err, "created sink with negative limit")
+
+	recording := &recordingSink{}
+	sink, err := NewBatchingSink(recording, BatchingSinkParams{
+		MaxEvents: 3,
+		Linger:    time.Hour,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	events := prepareEvents(7)
+	for _, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	batches := recording.received()
+	require.Equal(suite.T(), 2, len(batches))
+	for _, batch := range batches {
+		require.Equal(suite.T(), pb.EventType_DummyEventType, batch.Type)
+		require.Equal(suite.T(), 3, len(batch.GetBatch().Events))
+	}
+	require.Equal(suite.T(), events[3], batches[1].GetBatch().Events[0])
+
+	//The pending event is delivered on close
+	require.NoError(suite.T(), sink.Close(context.Background()), "failed to close sink")
+	batches = recording.received()
+	require.Equal(suite.T(), 3, len(batches))
+	require.Equal(suite.T(), []*pb.Event{events[6]}, UnpackBatch(batches[2]))
+	require.Equal(suite.T(), uint64(3), sink.Delivered())
+	require.Error(suite.T(), sink.PushEvent(events[0]), "pushed event to closed sink")
+
+	//Queries pass through
+	queries, _ := prepareQueries(1)
+	_, err = sink.RunQuery(queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+}
+
+func (suite *BatchingSinkTestSuite) TestBatchingSink__BytesAndLinger() {
+	events := prepareEvents(6)
+	recording := &recordingSink{}
+	sink, err := NewBatchingSink(recording, BatchingSinkParams{
+		MaxBytes: 2*events[0].Size() + 1,
+		Linger:   50 * time.Millisecond,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	defer sink.Close(context.Background())
+
+	//A third event would overflow the size limit, so it starts the next batch
+	for _, event := range events[:3] {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	require.Equal(suite.T(), 1, len(recording.received()))
+	require.Equal(suite.T(), events[:2], UnpackBatch(recording.received()[0]))
+
+	//The next batch is delivered once its first event lingered
+	err = wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(recording.received()) == 2, nil
+	})
+	require.NoError(suite.T(), err, "lingering batch was not delivered: %s", err)
+	require.Equal(suite.T(), events[2:3], UnpackBatch(recording.received()[1]))
+
+	//Failed batches are dropped, the error is returned to the event triggering the delivery
+	recording.failing.Store(true)
+	require.NoError(suite.T(), sink.PushEvent(events[3]), "failed to push event")
+	require.NoError(suite.T(), sink.PushEvent(events[4]), "failed to push event")
+	require.Error(suite.T(), sink.PushEvent(events[5]), "pushed event overflowing failed batch")
+	require.Equal(suite.T(), uint64(2), sink.Dropped())
+	require.NoError(suite.T(), sink.PushEvent(events[5]), "failed to push rejected event again")
+	require.Error(suite.T(), sink.Flush(context.Background()), "flushed failed batch")
+	require.Equal(suite.T(), uint64(3), sink.Dropped())
+	require.NoError(suite.T(), sink.Flush(context.Background()), "failed to flush empty batch")
+}
+
+func (suite *BatchingSinkTestSuite) TestBatchingSink__SlowDelivery() {
+	recording := &recordingSink{block: make(chan struct{})}
+	sink, err := NewBatchingSink(recording, BatchingSinkParams{
+		MaxEvents: 2,
+		Linger:    time.Hour,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	events := prepareEvents(5)
+
+	//Events are added to the next batch while the completed one is being delivered
+	require.NoError(suite.T(), sink.PushEvent(events[0]), "failed to push event")
+	pushErrors := make(chan error, 2)
+	go func() {
+		pushErrors <- sink.PushEvent(events[1])
+	}()
+	err = wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return recording.blocked.Load() == 1, nil
+	})
+	require.NoError(suite.T(), err, "batch delivery did not start: %s", err)
+	require.NoError(suite.T(), sink.PushEvent(events[2]), "failed to push event")
+
+	//The next batch is delivered after the previous one
+	go func() {
+		pushErrors <- sink.PushEvent(events[3])
+	}()
+	close(recording.block)
+	require.NoError(suite.T(), <-pushErrors, "failed to deliver batch")
+	require.NoError(suite.T(), <-pushErrors, "failed to deliver batch")
+	batches := recording.received()
+	require.Equal(suite.T(), 2, len(batches))
+	require.Equal(suite.T(), events[:2], UnpackBatch(batches[0]))
+	require.Equal(suite.T(), events[2:4], UnpackBatch(batches[1]))
+
+	//The delivery on close is bounded by the context
+	recording.block = make(chan struct{})
+	require.NoError(suite.T(), sink.PushEvent(events[4]), "failed to push event")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Error(suite.T(), sink.Close(ctx), "delivered batch to hanging destination")
+	require.Equal(suite.T(), uint64(1), sink.Dropped())
+}
+
+func (suite *BatchingSinkTestSuite) TestBatchingSink__Unpack() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	tap := NewUnpackingTap(NewProcessorTap(collector))
+	events := prepareEvents(4)
+
+	nested := &pb.Event{
+		Info: &pb.Event_Batch{Batch: &pb.EventBatch{Events: events[1:3]}},
+	}
+	batch := &pb.Event{
+		Info: &pb.Event_Batch{Batch: &pb.EventBatch{Events: []*pb.Event{events[0], nested}}},
+	}
+	require.NoError(suite.T(), tap.PushEvent(batch), "failed to push batch")
+	require.NoError(suite.T(), tap.PushEvent(events[3]), "failed to push event")
+	require.Equal(suite.T(), events, collector.events)
+}
+
+func TestBatchingSink__RUN(t *testing.T) {
+	crt := new(BatchingSinkTestSuite)
+	suite.Run(t, crt)
+}
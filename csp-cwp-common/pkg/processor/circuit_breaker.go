@@ -0,0 +1,291 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rapid7/csp-cwp-common/pkg/agent_libraries/logger"
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//State of a circuit breaker
+type CircuitState int
+
+const (
+	//Queries pass through while the failures are tracked
+	CircuitClosed CircuitState = iota
+	//Queries fail fast until the cool-down passes
+	CircuitOpen
+	//A limited number of trial queries pass through, deciding whether to close or reopen
+	CircuitHalfOpen
+)
+
+var circuitStateNames = map[CircuitState]string{
+	CircuitClosed:   "closed",
+	CircuitOpen:     "open",
+	CircuitHalfOpen: "halfOpen",
+}
+
+func (s CircuitState) String() string {
+	if name, exists := circuitStateNames[s]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+//Returned by a circuit breaker sink for queries rejected while the circuit is open
+type CircuitOpenError struct {
+	Relation string
+	//Time left until trial queries are allowed, zero if trial queries are already running
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit of %s is open, retry after %s", e.Relation, e.RetryAfter)
+}
+
+//Implemented by processors reporting the status of their components on their heartbeat, as BaseProcessor
+type StatusReporter interface {
+	//Set the status of a component, empty status to remove it
+	ReportStatus(component string, status string)
+}
+
+//Parameters of a circuit breaker sink
+type CircuitBreakerParams struct {
+	//Period over which the failure ratio is computed (default 10s)
+	Window time.Duration
+	//Number of queries in a period before the circuit may open (default 10)
+	MinRequests int
+	//Ratio of failed queries in a period opening the circuit, in (0, 1] (default 0.5)
+	FailureRatio float64
+	//Duration beyond which a successful query is counted as failed, zero for no threshold
+	LatencyThreshold time.Duration
+	//Duration the circuit stays open before trial queries are allowed (default 5s)
+	CoolDown time.Duration
+	//Number of successful trial queries closing the circuit (default 1)
+	Probes int
+	//Logger of the state changes, nil for no logging
+	Logger logger.Logger
+	//Reporter of the state, nil for no reporting
+	Reporter StatusReporter
+}
+
+//Check circuit breaker params validity and fill in defaults
+func (p *CircuitBreakerParams) validate() error {
+	if p.Window < 0 || p.LatencyThreshold < 0 || p.CoolDown < 0 || p.MinRequests < 0 || p.Probes < 0 {
+		return fmt.Errorf("circuit breaker params should not be negative")
+	}
+	if p.FailureRatio < 0 || p.FailureRatio > 1 {
+		return fmt.Errorf("circuit breaker failure ratio should be in (0, 1]")
+	}
+	if p.Window == 0 {
+		p.Window = 10 * time.Second
+	}
+	if p.MinRequests == 0 {
+		p.MinRequests = 10
+	}
+	if p.FailureRatio == 0 {
+		p.FailureRatio = 0.5
+	}
+	if p.CoolDown == 0 {
+		p.CoolDown = 5 * time.Second
+	}
+	if p.Probes == 0 {
+		p.Probes = 1
+	}
+	return nil
+}
+
+//This is a queries egress object failing fast while the wrapped sink keeps failing:
+//The circuit opens once the ratio of failed or slow queries in a period reaches the threshold,
+//rejecting queries with CircuitOpenError for the cool-down. Trial queries are allowed afterwards,
+//closing the circuit if they all succeed or reopening it on the first failure.
+//Queries abandoned by their caller are not counted. Events pass through unaffected.
+type CircuitBreakerSink struct {
+	SinkInterface
+	params   CircuitBreakerParams
+	relation string
+	sink     SinkInterface
+
+	lock  sync.Mutex
+	state CircuitState
+	//Incremented on each state change, for ignoring results of queries started in a previous state
+	generation  uint64
+	windowStart time.Time
+	calls       int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+//Create circuit breaker sink:
+//relation is the relation name used on the errors, logs and reported status.
+func NewCircuitBreakerSink(sink SinkInterface, relation string, params CircuitBreakerParams) (*CircuitBreakerSink, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	c := &CircuitBreakerSink{
+		params:      params,
+		relation:    relation,
+		sink:        sink,
+		windowStart: time.Now(),
+	}
+	c.report()
+	return c, nil
+}
+
+func (c *CircuitBreakerSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return c.RunQueryContext(context.Background(), query)
+}
+
+func (c *CircuitBreakerSink) PushEvent(event *proto.Event) error {
+	return c.PushEventContext(context.Background(), event)
+}
+
+func (c *CircuitBreakerSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	generation, err := c.allow()
+	if err != nil {
+		return nil, err
+	}
+	//A trial query with no outcome gives its slot back, so the circuit is not stuck half open
+	recorded := false
+	defer func() {
+		if !recorded {
+			c.release(generation)
+		}
+	}()
+	start := time.Now()
+	result, err := RunQueryWithContext(ctx, c.sink, query)
+	if err == nil || ctx.Err() == nil {
+		failed := err != nil || (c.params.LatencyThreshold > 0 && time.Since(start) > c.params.LatencyThreshold)
+		c.record(generation, failed)
+		recorded = true
+	}
+	return result, err
+}
+
+func (c *CircuitBreakerSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	return PushEventWithContext(ctx, c.sink, event)
+}
+
+//Get the circuit state
+func (c *CircuitBreakerSink) State() CircuitState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+//Check whether queries may currently pass through, for skipping the replica while the circuit is open
+func (c *CircuitBreakerSink) IsAvailable() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch c.state {
+	case CircuitOpen:
+		return time.Since(c.openedAt) >= c.params.CoolDown
+	case CircuitHalfOpen:
+		return c.probes < c.params.Probes
+	}
+	return true
+}
+
+//Private method for admitting a query, return the generation it was admitted in
+func (c *CircuitBreakerSink) allow() (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	switch c.state {
+	case CircuitClosed:
+		if now.Sub(c.windowStart) > c.params.Window {
+			c.windowStart, c.calls, c.failures = now, 0, 0
+		}
+	case CircuitOpen:
+		if retryAfter := c.openedAt.Add(c.params.CoolDown).Sub(now); retryAfter > 0 {
+			return 0, &CircuitOpenError{Relation: c.relation, RetryAfter: retryAfter}
+		}
+		c.transition(CircuitHalfOpen)
+		fallthrough
+	case CircuitHalfOpen:
+		if c.probes >= c.params.Probes {
+			return 0, &CircuitOpenError{Relation: c.relation}
+		}
+		c.probes++
+	}
+	return c.generation, nil
+}
+
+//Private method for recording the outcome of a query admitted in the given generation
+func (c *CircuitBreakerSink) record(generation uint64, failed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	switch c.state {
+	case CircuitClosed:
+		c.calls++
+		if failed {
+			c.failures++
+		}
+		if c.calls >= c.params.MinRequests && float64(c.failures) >= c.params.FailureRatio*float64(c.calls) {
+			c.transition(CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		if failed {
+			c.transition(CircuitOpen)
+			return
+		}
+		c.successes++
+		if c.successes >= c.params.Probes {
+			c.transition(CircuitClosed)
+		}
+	}
+}
+
+//Private method for releasing the trial slot of a query admitted in the given generation with no outcome
+func (c *CircuitBreakerSink) release(generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation == c.generation && c.state == CircuitHalfOpen && c.probes > 0 {
+		c.probes--
+	}
+}
+
+//Private method for changing the state, called under the lock
+func (c *CircuitBreakerSink) transition(state CircuitState) {
+	from := c.state
+	c.state = state
+	c.generation++
+	c.probes, c.successes = 0, 0
+	switch state {
+	case CircuitOpen:
+		c.openedAt = time.Now()
+		//A failed trial is logged alone, as the window counters are of the queries which first opened the circuit
+		if c.params.Logger != nil && from == CircuitHalfOpen {
+			c.params.Logger.Warnf("circuit of %s reopened after a failed trial query, cooling down for %s",
+				c.relation, c.params.CoolDown)
+		} else if c.params.Logger != nil {
+			c.params.Logger.Warnf("circuit of %s opened after %d failures out of %d queries, cooling down for %s",
+				c.relation, c.failures, c.calls, c.params.CoolDown)
+		}
+	case CircuitClosed:
+		c.windowStart, c.calls, c.failures = time.Now(), 0, 0
+		if c.params.Logger != nil {
+			c.params.Logger.Infof("circuit of %s closed", c.relation)
+		}
+	case CircuitHalfOpen:
+		if c.params.Logger != nil {
+			c.params.Logger.Infof("circuit of %s half open, trying %d queries", c.relation, c.params.Probes)
+		}
+	}
+	c.report()
+}
+
+//Private method for reporting the state as the status of the circuit component
+func (c *CircuitBreakerSink) report() {
+	if c.params.Reporter != nil {
+		c.params.Reporter.ReportStatus("circuit "+c.relation, c.state.String())
+	}
+}
@@ -0,0 +1,245 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rapid7/csp-cwp-common/pkg/agent_libraries/logger"
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type CircuitBreakerTestSuite struct {
+	suite.Suite
+}
+
+func (suite *CircuitBreakerTestSuite) SetupTest() {
+}
+
+func (suite *CircuitBreakerTestSuite) TearDownTest() {
+}
+
+func (suite *CircuitBreakerTestSuite) TestCircuitBreaker__OpenAndRecover() {
+	target := &breakerTargetSink{failing: true}
+	log := &recordingLogger{}
+	reporter := newBaseProcessor(BaseProcessorParams{})
+	breaker, err := NewCircuitBreakerSink(target, "relation", CircuitBreakerParams{
+		MinRequests:  4,
+		FailureRatio: 0.5,
+		CoolDown:     20 * time.Millisecond,
+		Logger:       log,
+		Reporter:     reporter,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	require.Equal(suite.T(), "circuit relation: closed", reporter.GetHeartbeat().Status)
+
+	//Circuit opens once enough queries failed
+	queries, _ := prepareQueries(6)
+	for _, query := range queries[:4] {
+		_, err := breaker.RunQuery(query)
+		require.Error(suite.T(), err, "failed query was not reported")
+	}
+	require.Equal(suite.T(), CircuitOpen, breaker.State())
+	require.False(suite.T(), breaker.IsAvailable())
+	require.Equal(suite.T(), "circuit relation: open", reporter.GetHeartbeat().Status)
+
+	//Queries fail fast while open
+	_, err = breaker.RunQuery(queries[4])
+	openErr, ok := err.(*CircuitOpenError)
+	require.True(suite.T(), ok, "unexpected error %v", err)
+	require.Equal(suite.T(), "relation", openErr.Relation)
+	require.True(suite.T(), openErr.RetryAfter > 0)
+	require.Equal(suite.T(), 4, target.calls)
+
+	//Successful trial query closes the circuit after the cool-down
+	time.Sleep(25 * time.Millisecond)
+	require.True(suite.T(), breaker.IsAvailable())
+	target.failing = false
+	result, err := breaker.RunQuery(queries[5])
+	require.NoError(suite.T(), err, "failed to run trial query: %s", err)
+	require.Equal(suite.T(), queries[5].UUID, result.UUID)
+	require.Equal(suite.T(), CircuitClosed, breaker.State())
+	require.Equal(suite.T(), "circuit relation: closed", reporter.GetHeartbeat().Status)
+
+	messages := strings.Join(log.messages(), "\n")
+	for _, expected := range []string{"opened", "half open", "closed"} {
+		require.Contains(suite.T(), messages, expected)
+	}
+}
+
+func (suite *CircuitBreakerTestSuite) TestCircuitBreaker__TrialFailure() {
+	target := &breakerTargetSink{failing: true}
+	log := &recordingLogger{}
+	breaker, err := NewCircuitBreakerSink(target, "relation", CircuitBreakerParams{
+		MinRequests: 1,
+		CoolDown:    10 * time.Millisecond,
+		Logger:      log,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	queries, _ := prepareQueries(3)
+	_, err = breaker.RunQuery(queries[0])
+	require.Error(suite.T(), err, "failed query was not reported")
+	require.Equal(suite.T(), CircuitOpen, breaker.State())
+
+	//Failed trial query reopens the circuit for another cool-down
+	time.Sleep(15 * time.Millisecond)
+	_, err = breaker.RunQuery(queries[1])
+	require.Error(suite.T(), err, "failed trial query was not reported")
+	_, ok := err.(*CircuitOpenError)
+	require.False(suite.T(), ok, "trial query was not run")
+	require.Equal(suite.T(), CircuitOpen, breaker.State())
+	_, err = breaker.RunQuery(queries[2])
+	_, ok = err.(*CircuitOpenError)
+	require.True(suite.T(), ok, "unexpected error %v", err)
+	require.Equal(suite.T(), 2, target.calls)
+	require.Equal(suite.T(), []string{
+		"circuit of relation opened after 1 failures out of 1 queries, cooling down for 10ms",
+		"circuit of relation half open, trying 1 queries",
+		"circuit of relation reopened after a failed trial query, cooling down for 10ms",
+	}, log.messages())
+}
+
+func (suite *CircuitBreakerTestSuite) TestCircuitBreaker__AbandonedTrial() {
+	target := &breakerTargetSink{failing: true}
+	breaker, err := NewCircuitBreakerSink(target, "relation", CircuitBreakerParams{
+		MinRequests: 1,
+		CoolDown:    10 * time.Millisecond,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	queries, _ := prepareQueries(3)
+	_, err = breaker.RunQuery(queries[0])
+	require.Error(suite.T(), err, "failed query was not reported")
+	require.Equal(suite.T(), CircuitOpen, breaker.State())
+
+	//Trial query abandoned by its caller gives its slot to the next one
+	time.Sleep(15 * time.Millisecond)
+	target.delay = 20 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	_, err = RunQueryWithContext(ctx, breaker, queries[1])
+	_, ok := err.(*CircuitOpenError)
+	require.False(suite.T(), ok, "trial query was not run")
+	require.Equal(suite.T(), CircuitHalfOpen, breaker.State())
+	require.True(suite.T(), breaker.IsAvailable())
+
+	target.failing, target.delay = false, 0
+	_, err = breaker.RunQuery(queries[2])
+	require.NoError(suite.T(), err, "failed to run trial query: %s", err)
+	require.Equal(suite.T(), CircuitClosed, breaker.State())
+	require.Equal(suite.T(), 3, target.calls)
+}
+
+func (suite *CircuitBreakerTestSuite) TestCircuitBreaker__LatencyThreshold() {
+	target := &breakerTargetSink{delay: 10 * time.Millisecond}
+	breaker, err := NewCircuitBreakerSink(target, "relation", CircuitBreakerParams{
+		MinRequests:      2,
+		LatencyThreshold: 5 * time.Millisecond,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	//Slow queries succeed but open the circuit
+	queries, _ := prepareQueries(2)
+	for _, query := range queries {
+		_, err := breaker.RunQuery(query)
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+	}
+	require.Equal(suite.T(), CircuitOpen, breaker.State())
+}
+
+func (suite *CircuitBreakerTestSuite) TestCircuitBreaker__Window() {
+	target := &breakerTargetSink{failing: true}
+	breaker, err := NewCircuitBreakerSink(target, "relation", CircuitBreakerParams{
+		Window:      20 * time.Millisecond,
+		MinRequests: 2,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	//Failures of different periods do not add up
+	queries, _ := prepareQueries(2)
+	_, _ = breaker.RunQuery(queries[0])
+	time.Sleep(30 * time.Millisecond)
+	_, _ = breaker.RunQuery(queries[1])
+	require.Equal(suite.T(), CircuitClosed, breaker.State())
+
+	//Queries abandoned by the caller are not counted
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _ = breaker.RunQueryContext(ctx, queries[0])
+	require.Equal(suite.T(), CircuitClosed, breaker.State())
+
+	//Events pass through
+	require.NoError(suite.T(), breaker.PushEvent(prepareEvents(1)[0]), "failed to push event")
+}
+
+func (suite *CircuitBreakerTestSuite) TestCircuitBreaker__InvalidParams() {
+	for _, params := range []CircuitBreakerParams{
+		{FailureRatio: 1.5},
+		{CoolDown: -time.Second},
+		{MinRequests: -1},
+	} {
+		_, err := NewCircuitBreakerSink(&breakerTargetSink{}, "relation", params)
+		require.Error(suite.T(), err, "created sink with params %+v", params)
+	}
+}
+
+func TestCircuitBreaker__RUN(t *testing.T) {
+	crt := new(CircuitBreakerTestSuite)
+	suite.Run(t, crt)
+}
+
+//Sink stub answering queries with a delay or failing them
+type breakerTargetSink struct {
+	SinkInterface
+	failing bool
+	delay   time.Duration
+	calls   int
+}
+
+func (b *breakerTargetSink) PushEventContext(ctx context.Context, event *pb.Event) error {
+	return nil
+}
+
+func (b *breakerTargetSink) RunQueryContext(ctx context.Context, query *pb.Query) (*pb.QueryResult, error) {
+	b.calls++
+	time.Sleep(b.delay)
+	if b.failing {
+		return nil, fmt.Errorf("service is down")
+	}
+	return &pb.QueryResult{Type: query.Type, UUID: query.UUID}, nil
+}
+
+//Logger stub recording its formatted messages
+type recordingLogger struct {
+	logger.Logger
+	lock  sync.Mutex
+	lines []string
+}
+
+func (r *recordingLogger) Infof(format string, args ...interface{}) {
+	r.record(format, args...)
+}
+
+func (r *recordingLogger) Warnf(format string, args ...interface{}) {
+	r.record(format, args...)
+}
+
+func (r *recordingLogger) record(format string, args ...interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+//Get the recorded messages
+func (r *recordingLogger) messages() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.lines...)
+}
@@ -0,0 +1,125 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Events path common to the processors, taps and sinks
+type EventPusher interface {
+	PushEvent(event *proto.Event) error
+}
+
+//Queries path common to the services, taps and sinks
+type QueryRunner interface {
+	RunQuery(query *proto.Query) (*proto.QueryResult, error)
+}
+
+//Optional extension of ProcessorInterface:
+//A processor implementing it gets the caller context along with every event, so it can
+//stop handling once the caller deadline passed or the mesh is shutting down.
+type ContextProcessorInterface interface {
+	//Handle received event under the given context
+	PushEventContext(ctx context.Context, event *proto.Event) error
+}
+
+//Optional extension of ServiceInterface:
+//A service implementing it gets the caller context along with every query.
+type ContextServiceInterface interface {
+	//Handle received query under the given context
+	RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error)
+}
+
+//Optional extension of TapInterface:
+//A tap implementing it passes the caller context on to the handlers, as all the taps of this
+//package do. Taps should be called through the PushEventWithContext and RunQueryWithContext
+//adapters, so the taps not implementing it keep working.
+type ContextTapInterface interface {
+	ContextProcessorInterface
+	ContextServiceInterface
+}
+
+//Optional extension of SinkInterface:
+//A sink implementing it abandons the call once the caller context is done, as all the sinks
+//of this package do. Sinks should be called through the PushEventWithContext and
+//RunQueryWithContext adapters, so the sinks not implementing it keep working.
+type ContextSinkInterface interface {
+	ContextProcessorInterface
+	ContextServiceInterface
+}
+
+//Error returned when the deadline of an event or query call expired before it was handled
+type TimeoutError struct {
+	//The timed out operation
+	Operation string
+	//The sink timeout applied on the call, zero if the deadline was set by the caller context
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Timeout > 0 {
+		return fmt.Sprintf("%s timed out after %s", e.Operation, e.Timeout)
+	}
+	return fmt.Sprintf("%s deadline exceeded", e.Operation)
+}
+
+//Check if error is or wraps a TimeoutError
+func IsTimeoutError(err error) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+//Adapter for pushing an event to any processor, tap or sink under a context:
+//The context is passed to those implementing ContextProcessorInterface, others are called
+//with their plain PushEvent method once the context is verified to be still valid.
+func PushEventWithContext(ctx context.Context, handler EventPusher, event *proto.Event) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(err, "push event", 0)
+	}
+	if ctxHandler, ok := handler.(ContextProcessorInterface); ok {
+		return ctxHandler.PushEventContext(ctx, event)
+	}
+	return handler.PushEvent(event)
+}
+
+//Adapter for running a query on any service, tap or sink under a context:
+//The context is passed to those implementing ContextServiceInterface, others are called
+//with their plain RunQuery method once the context is verified to be still valid.
+func RunQueryWithContext(ctx context.Context, handler QueryRunner, query *proto.Query) (*proto.QueryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err, "run query", 0)
+	}
+	if ctxHandler, ok := handler.(ContextServiceInterface); ok {
+		return ctxHandler.RunQueryContext(ctx, query)
+	}
+	return handler.RunQuery(query)
+}
+
+//Private helper binding PushEventWithContext to a processor, tap or sink
+func pushEventHandler(handler EventPusher) EventHandler {
+	return func(ctx context.Context, event *proto.Event) error {
+		return PushEventWithContext(ctx, handler, event)
+	}
+}
+
+//Private helper binding RunQueryWithContext to a service, tap or sink
+func runQueryHandler(handler QueryRunner) QueryHandler {
+	return func(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+		return RunQueryWithContext(ctx, handler, query)
+	}
+}
+
+//Convert a done context error into the error returned to the caller
+func contextError(err error, operation string, timeout time.Duration) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &TimeoutError{
+			Operation: operation,
+			Timeout:   timeout,
+		}
+	}
+	return fmt.Errorf("%s canceled: %w", operation, err)
+}
@@ -0,0 +1,204 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type ContextTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ContextTestSuite) SetupTest() {
+}
+
+func (suite *ContextTestSuite) TearDownTest() {
+}
+
+func (suite *ContextTestSuite) TestContext__SinkTimeout() {
+	service := newHungService()
+	defer close(service.release)
+
+	sink := NewSinkWithContext(context.Background(), NewServiceTap(service, service), 20*time.Millisecond)
+	queries, _ := prepareQueries(1)
+
+	start := time.Now()
+	_, err := sink.RunQuery(queries[0])
+	require.Error(suite.T(), err, "hung query did not time out")
+	require.True(suite.T(), IsTimeoutError(err), "unexpected error type: %s", err)
+	require.True(suite.T(), time.Since(start) < time.Second, "caller was not released on timeout")
+
+	err = sink.PushEvent(prepareEvents(1)[0])
+	require.True(suite.T(), IsTimeoutError(err), "unexpected error type: %s", err)
+}
+
+func (suite *ContextTestSuite) TestContext__CallerDeadline() {
+	service := newHungService()
+	defer close(service.release)
+
+	sink := NewSink(NewServiceTap(service, service))
+	queries, _ := prepareQueries(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := RunQueryWithContext(ctx, sink, queries[0])
+	require.True(suite.T(), IsTimeoutError(err), "unexpected error type: %s", err)
+}
+
+func (suite *ContextTestSuite) TestContext__BaseContextCancel() {
+	service := newHungService()
+	defer close(service.release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := NewSinkWithContext(ctx, NewServiceTap(service, service), 0)
+	queries, _ := prepareQueries(1)
+
+	errors := make(chan error, 1)
+	//Cancelling the base context should release the pending caller through the handler context
+	go func() {
+		errors <- sink.PushEvent(prepareEvents(1)[0])
+	}()
+	cancel()
+	select {
+	case err := <-errors:
+		require.Error(suite.T(), err, "cancelled event did not fail")
+		require.False(suite.T(), IsTimeoutError(err), "cancel reported as timeout: %s", err)
+	case <-time.After(time.Second):
+		require.Fail(suite.T(), "caller was not released on cancel")
+	}
+
+	//Further calls fail immediately
+	_, err := sink.RunQuery(queries[0])
+	require.Error(suite.T(), err, "query passed on cancelled sink")
+}
+
+func (suite *ContextTestSuite) TestContext__ContextHandler() {
+	service := newHungService()
+	defer close(service.release)
+
+	sink := NewSink(NewServiceTap(service, service))
+	queries, expectedResults := prepareQueries(1)
+
+	//Context aware service gets the caller context
+	ctx := context.WithValue(context.Background(), contextKey{}, "value")
+	result, err := RunQueryWithContext(ctx, sink, queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.Equal(suite.T(), expectedResults[0], result)
+	require.Equal(suite.T(), "value", service.lastValue)
+}
+
+func (suite *ContextTestSuite) TestContext__PlainTapAndSink() {
+	//Taps and sinks without the context paths are called through the adapters
+	tap := &plainTap{}
+	sink := NewInterceptedSink(NewSinkWithContext(context.Background(), tap, time.Second), nil, nil)
+	queries, _ := prepareQueries(1)
+	events := prepareEvents(1)
+	_, err := RunQueryWithContext(context.Background(), sink, queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.NoError(suite.T(), PushEventWithContext(context.Background(), sink, events[0]), "failed to push event")
+	require.Equal(suite.T(), 2, tap.calls)
+
+	plain := &plainSink{tap: tap}
+	wrapped := NewInterceptedSink(plain, nil, nil)
+	require.NoError(suite.T(), wrapped.PushEvent(events[0]), "failed to push event")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(suite.T(), PushEventWithContext(ctx, wrapped, events[0]), "event passed with cancelled context")
+	require.Equal(suite.T(), 3, tap.calls)
+}
+
+func TestContext__RUN(t *testing.T) {
+	crt := new(ContextTestSuite)
+	suite.Run(t, crt)
+}
+
+type contextKey struct{}
+
+//Service stub which hangs on plain calls until released, and answers context aware calls
+type hungService struct {
+	ServiceInterface
+	release   chan struct{}
+	lastValue interface{}
+}
+
+func newHungService() *hungService {
+	return &hungService{
+		release: make(chan struct{}),
+	}
+}
+
+func (hs *hungService) PushEvent(event *pb.Event) error {
+	<-hs.release
+	return nil
+}
+
+//Context aware handling is released along with the context
+func (hs *hungService) PushEventContext(ctx context.Context, event *pb.Event) error {
+	select {
+	case <-hs.release:
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx.Err(), "push event", 0)
+	}
+}
+
+func (hs *hungService) RunQuery(query *pb.Query) (*pb.QueryResult, error) {
+	<-hs.release
+	return nil, nil
+}
+
+func (hs *hungService) RunQueryContext(ctx context.Context, query *pb.Query) (*pb.QueryResult, error) {
+	hs.lastValue = ctx.Value(contextKey{})
+	if hs.lastValue == nil {
+		return hs.RunQuery(query)
+	}
+	return &pb.QueryResult{
+		Type: query.Type,
+		UUID: query.UUID,
+		Info: &pb.QueryResult_Dummy{
+			Dummy: &pb.DummyQueryResult{
+				Info: query.GetDummy().Info,
+			},
+		},
+	}, nil
+}
+
+//Tap implementing only the plain paths
+type plainTap struct {
+	calls int
+}
+
+func (pt *plainTap) RunQuery(query *pb.Query) (*pb.QueryResult, error) {
+	pt.calls++
+	return &pb.QueryResult{Type: query.Type, UUID: query.UUID}, nil
+}
+
+func (pt *plainTap) PushEvent(event *pb.Event) error {
+	pt.calls++
+	return nil
+}
+
+func (pt *plainTap) SetQueryHandler(queryHandler ServiceInterface) {
+}
+
+func (pt *plainTap) SetEventHandler(eventHandler ProcessorInterface) {
+}
+
+//Sink implementing only the plain paths
+type plainSink struct {
+	tap *plainTap
+}
+
+func (ps *plainSink) RunQuery(query *pb.Query) (*pb.QueryResult, error) {
+	return ps.tap.RunQuery(query)
+}
+
+func (ps *plainSink) PushEvent(event *pb.Event) error {
+	return ps.tap.PushEvent(event)
+}
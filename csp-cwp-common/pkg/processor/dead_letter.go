@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/gogo/protobuf/jsonpb"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Dead letter destination pushing the dead letters as events to another processor
+type SinkDeadLetter struct {
+	sink SinkInterface
+}
+
+//Create dead letter destination pushing DeadLetterEventType events to the sink
+func NewSinkDeadLetter(sink SinkInterface) *SinkDeadLetter {
+	return &SinkDeadLetter{
+		sink: sink,
+	}
+}
+
+func (s *SinkDeadLetter) PushDeadLetter(ctx context.Context, letter *proto.DeadLetter) error {
+	return PushEventWithContext(ctx, s.sink, &proto.Event{
+		Type: proto.EventType_DeadLetterEventType,
+		Info: &proto.Event_DeadLetter{
+			DeadLetter: letter,
+		},
+	})
+}
+
+//Dead letter destination appending the dead letters to a file, as a JSON object per line
+type FileDeadLetter struct {
+	lock      sync.Mutex
+	file      *os.File
+	marshaler jsonpb.Marshaler
+}
+
+//Create dead letter destination appending to the file at path, created if missing
+func NewFileDeadLetter(path string) (*FileDeadLetter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead letter file: %s", err)
+	}
+	return &FileDeadLetter{
+		file: file,
+	}, nil
+}
+
+func (f *FileDeadLetter) PushDeadLetter(ctx context.Context, letter *proto.DeadLetter) error {
+	line, err := f.marshaler.MarshalToString(letter)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, err = f.file.WriteString(line + "\n")
+	return err
+}
+
+//Close the dead letter file
+func (f *FileDeadLetter) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,86 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/atomic"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Stamps the envelope header of the events emitted by a single source instance:
+//All the sinks of a source should share the same enveloper, so its events are
+//sequenced regardless of their type and destination.
+type EventEnveloper struct {
+	source   string
+	sequence atomic.Uint64
+}
+
+//Create enveloper of the events emitted by the named source instance
+func NewEventEnveloper(source string) *EventEnveloper {
+	return &EventEnveloper{
+		source: source,
+	}
+}
+
+//Stamp event envelope header, returning the stamped event:
+//The caller event is left untouched, as it may be reused or pushed concurrently, so the
+//stamped event is a shallow copy of it with a new header.
+//An event with no header is given a new header with the next source sequence number.
+//An event which already has a header is being forwarded, so only its hop count is increased.
+func (e *EventEnveloper) Stamp(event *proto.Event) *proto.Event {
+	stamped := *event
+	if event.Header != nil {
+		header := *event.Header
+		if event.Header.TraceContext != nil {
+			header.TraceContext = make(map[string]string, len(event.Header.TraceContext))
+			for key, value := range event.Header.TraceContext {
+				header.TraceContext[key] = value
+			}
+		}
+		header.HopCount++
+		stamped.Header = &header
+		return &stamped
+	}
+	stamped.Header = &proto.EventHeader{
+		UUID:      uuid.New().String(),
+		Timestamp: time.Now().UnixNano(),
+		Source:    e.source,
+		Sequence:  e.sequence.Inc(),
+	}
+	return &stamped
+}
+
+//This is an events egress object stamping the envelope header of the events
+//before passing them on to the wrapped sink.
+type EnvelopeSink struct {
+	SinkInterface
+	enveloper *EventEnveloper
+	sink      SinkInterface
+}
+
+//Create sink stamping the events with the given enveloper
+func NewEnvelopeSink(enveloper *EventEnveloper, sink SinkInterface) SinkInterface {
+	return &EnvelopeSink{
+		enveloper: enveloper,
+		sink:      sink,
+	}
+}
+
+func (e *EnvelopeSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return e.sink.RunQuery(query)
+}
+
+func (e *EnvelopeSink) PushEvent(event *proto.Event) error {
+	return e.PushEventContext(context.Background(), event)
+}
+
+func (e *EnvelopeSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return RunQueryWithContext(ctx, e.sink, query)
+}
+
+func (e *EnvelopeSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	return PushEventWithContext(ctx, e.sink, e.enveloper.Stamp(event))
+}
@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type EnvelopeSinkTestSuite struct {
+	suite.Suite
+}
+
+func (suite *EnvelopeSinkTestSuite) SetupTest() {
+}
+
+func (suite *EnvelopeSinkTestSuite) TearDownTest() {
+}
+
+func (suite *EnvelopeSinkTestSuite) TestEnvelopeSink__Stamp() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	//Sinks of the same source share the sequence
+	enveloper := NewEventEnveloper("Instance1")
+	sinks := []SinkInterface{
+		NewEnvelopeSink(enveloper, NewSink(collector.GetTap())),
+		NewEnvelopeSink(enveloper, NewSink(collector.GetTap())),
+	}
+
+	before := time.Now().UnixNano()
+	events := prepareEvents(4)
+	for i, event := range events {
+		require.NoError(suite.T(), sinks[i%len(sinks)].PushEvent(event), "failed to push event")
+	}
+
+	uuids := make(map[string]struct{})
+	for i, event := range collector.events {
+		header := event.Header
+		require.NotNil(suite.T(), header, "event was not stamped")
+		require.Equal(suite.T(), "Instance1", header.Source)
+		require.Equal(suite.T(), uint64(i+1), header.Sequence)
+		require.Zero(suite.T(), header.HopCount)
+		require.GreaterOrEqual(suite.T(), header.Timestamp, before)
+		require.NotEmpty(suite.T(), header.UUID)
+		uuids[header.UUID] = struct{}{}
+	}
+	require.Equal(suite.T(), len(events), len(uuids), "events share UUID")
+}
+
+func (suite *EnvelopeSinkTestSuite) TestEnvelopeSink__Forward() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	event := NewEventEnveloper("Instance1").Stamp(prepareEvents(1)[0])
+	header := *event.Header
+
+	//Forwarding processor keeps the original header
+	sink := NewEnvelopeSink(NewEventEnveloper("Instance2"), NewSink(collector.GetTap()))
+	require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	forwarded := collector.events[0].Header
+	require.Equal(suite.T(), header.UUID, forwarded.UUID)
+	require.Equal(suite.T(), "Instance1", forwarded.Source)
+	require.Equal(suite.T(), header.Sequence, forwarded.Sequence)
+	require.Equal(suite.T(), uint32(1), forwarded.HopCount)
+}
+
+func (suite *EnvelopeSinkTestSuite) TestEnvelopeSink__CallerEvent() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	sink := NewEnvelopeSink(NewEventEnveloper("Instance1"), NewSink(collector.GetTap()))
+
+	//A reused event is stamped anew on each push, and left untouched
+	event := prepareEvents(1)[0]
+	require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	require.Nil(suite.T(), event.Header, "caller event was stamped")
+	require.Equal(suite.T(), uint64(1), collector.events[0].Header.Sequence)
+	require.Equal(suite.T(), uint64(2), collector.events[1].Header.Sequence)
+	require.Zero(suite.T(), collector.events[1].Header.HopCount)
+	require.Equal(suite.T(), event.GetDummy(), collector.events[0].GetDummy())
+
+	//A forwarded event keeps its header untouched as well
+	forwarded := collector.events[0]
+	forwarded.Header.TraceContext = map[string]string{"trace": "1"}
+	require.NoError(suite.T(), sink.PushEvent(forwarded), "failed to push event")
+	require.Zero(suite.T(), forwarded.Header.HopCount)
+	collector.events[2].Header.TraceContext["trace"] = "2"
+	require.Equal(suite.T(), "1", forwarded.Header.TraceContext["trace"])
+	require.Equal(suite.T(), uint32(1), collector.events[2].Header.HopCount)
+}
+
+func TestEnvelopeSink__RUN(t *testing.T) {
+	crt := new(EnvelopeSinkTestSuite)
+	suite.Run(t, crt)
+}
@@ -0,0 +1,500 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Filter of events by their fields content, compiled from an expression:
+//
+//  Header.Source == "Instance1" && (Dummy.Info =~ "^disk" || !Header.TraceContext.tenant)
+//
+//Fields are referred to by their dotted path from the event, as named in the proto definition
+//ignoring case, with map values referred to by their key. Oneof members not set on an event are missing.
+//Fields are compared with string, number or boolean literals using ==, !=, <, <=, >, >=,
+//and with a regular expression string using =~. Enum fields are compared by their name.
+//Within string literals, a backslash escapes a quote or a backslash, and is kept otherwise.
+//A comparison with a missing field is false, whatever its operator.
+//A field alone is true if it is set to a non zero value.
+//Comparisons are combined with &&, || and !, along with parentheses.
+type Filter struct {
+	expression string
+	root       filterNode
+}
+
+//Compile filter expression, checking the syntax and that the fields exist on events
+func CompileFilter(expression string) (*Filter, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", expression, err)
+	}
+	parser := &filterParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err == nil && parser.position < len(tokens) {
+		err = fmt.Errorf("unexpected %q", tokens[parser.position].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", expression, err)
+	}
+	return &Filter{
+		expression: expression,
+		root:       root,
+	}, nil
+}
+
+//Get the filter expression
+func (f *Filter) String() string {
+	return f.expression
+}
+
+//Check whether an event matches the filter
+func (f *Filter) Match(event *proto.Event) bool {
+	return f.root.match(reflect.ValueOf(event))
+}
+
+//This is an events egress object passing on only the events matching a filter:
+//Other events are dropped without an error. Queries pass through unaffected.
+type FilterSink struct {
+	SinkInterface
+	filter *Filter
+	sink   SinkInterface
+}
+
+//Create sink passing on the events matching the filter
+func NewFilterSink(filter *Filter, sink SinkInterface) SinkInterface {
+	return &FilterSink{
+		filter: filter,
+		sink:   sink,
+	}
+}
+
+func (f *FilterSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return f.RunQueryContext(context.Background(), query)
+}
+
+func (f *FilterSink) PushEvent(event *proto.Event) error {
+	return f.PushEventContext(context.Background(), event)
+}
+
+func (f *FilterSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return RunQueryWithContext(ctx, f.sink, query)
+}
+
+func (f *FilterSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	if !f.filter.Match(event) {
+		return nil
+	}
+	return PushEventWithContext(ctx, f.sink, event)
+}
+
+//Node of a compiled filter expression
+type filterNode interface {
+	match(event reflect.Value) bool
+}
+
+type andNode struct {
+	left, right filterNode
+}
+
+func (n *andNode) match(event reflect.Value) bool {
+	return n.left.match(event) && n.right.match(event)
+}
+
+type orNode struct {
+	left, right filterNode
+}
+
+func (n *orNode) match(event reflect.Value) bool {
+	return n.left.match(event) || n.right.match(event)
+}
+
+type notNode struct {
+	node filterNode
+}
+
+func (n *notNode) match(event reflect.Value) bool {
+	return !n.node.match(event)
+}
+
+//Field alone, true if set to a non zero value
+type fieldNode struct {
+	path []string
+}
+
+func (n *fieldNode) match(event reflect.Value) bool {
+	value, exists := resolveField(event, n.path)
+	return exists && !value.IsZero()
+}
+
+//Comparison of a field with a literal
+type compareNode struct {
+	path     []string
+	operator string
+	//One of string, float64 or bool
+	literal interface{}
+	regex   *regexp.Regexp
+}
+
+func (n *compareNode) match(event reflect.Value) bool {
+	value, exists := resolveField(event, n.path)
+	if !exists {
+		return false
+	}
+	switch literal := n.literal.(type) {
+	case bool:
+		return (value.Bool() == literal) == (n.operator == "==")
+	case float64:
+		var number float64
+		switch value.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			number = float64(value.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			number = float64(value.Uint())
+		default:
+			number = value.Float()
+		}
+		return compareOrdered(n.operator, compareNumbers(number, literal))
+	default:
+		text := fieldString(value)
+		if n.regex != nil {
+			return n.regex.MatchString(text)
+		}
+		return compareOrdered(n.operator, strings.Compare(text, literal.(string)))
+	}
+}
+
+func compareNumbers(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+//Apply comparison operator on the result of a three way comparison
+func compareOrdered(operator string, comparison int) bool {
+	switch operator {
+	case "==":
+		return comparison == 0
+	case "!=":
+		return comparison != 0
+	case "<":
+		return comparison < 0
+	case "<=":
+		return comparison <= 0
+	case ">":
+		return comparison > 0
+	}
+	return comparison >= 0
+}
+
+//Get the string of a field, by name for enums
+func fieldString(value reflect.Value) string {
+	if value.Kind() != reflect.String {
+		if stringer, ok := value.Interface().(fmt.Stringer); ok {
+			return stringer.String()
+		}
+	}
+	return value.String()
+}
+
+//Resolve field path of an event, return false if the field is missing:
+//Fields are looked up by name, ignoring case, and oneof members through their generated getters.
+func resolveField(value reflect.Value, path []string) (reflect.Value, bool) {
+	for _, name := range path {
+		switch {
+		case value.Kind() == reflect.Map:
+			value = value.MapIndex(reflect.ValueOf(name))
+		case value.Kind() == reflect.Ptr && value.Elem().Kind() == reflect.Struct && hasField(value.Elem().Type(), name):
+			value = value.Elem().FieldByNameFunc(fieldMatcher(name))
+		default:
+			getter := value.MethodByName(getterName(name))
+			if !getter.IsValid() {
+				return value, false
+			}
+			value = getter.Call(nil)[0]
+		}
+		if !value.IsValid() || ((value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface || value.Kind() == reflect.Map) && value.IsNil()) {
+			return value, false
+		}
+	}
+	return value, true
+}
+
+//Resolve the type of a field path of events, checking that the fields exist
+func resolveFieldType(path []string) (reflect.Type, error) {
+	fieldType := reflect.TypeOf(&proto.Event{})
+	for i, name := range path {
+		if fieldType.Kind() == reflect.Map && fieldType.Key().Kind() == reflect.String {
+			fieldType = fieldType.Elem()
+			continue
+		}
+		if fieldType.Kind() == reflect.Ptr && fieldType.Elem().Kind() == reflect.Struct && hasField(fieldType.Elem(), name) {
+			field, _ := fieldType.Elem().FieldByNameFunc(fieldMatcher(name))
+			fieldType = field.Type
+			continue
+		}
+		getter, exists := fieldType.MethodByName(getterName(name))
+		if !exists || getter.Type.NumIn() != 1 || getter.Type.NumOut() != 1 {
+			return nil, fmt.Errorf("unknown field %s", strings.Join(path[:i+1], "."))
+		}
+		fieldType = getter.Type.Out(0)
+	}
+	return fieldType, nil
+}
+
+//Check whether a struct type has an exported field of a name, ignoring case
+func hasField(structType reflect.Type, name string) bool {
+	_, exists := structType.FieldByNameFunc(fieldMatcher(name))
+	return exists
+}
+
+//Get matcher of the field names equal to a name, ignoring case
+func fieldMatcher(name string) func(string) bool {
+	return func(fieldName string) bool {
+		return strings.EqualFold(fieldName, name)
+	}
+}
+
+//Get the generated getter name of a oneof member
+func getterName(name string) string {
+	runes := []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+	return "Get" + string(runes)
+}
+
+//Token of a filter expression
+type filterToken struct {
+	kind string
+	text string
+}
+
+const (
+	tokenField    = "field"
+	tokenString   = "string"
+	tokenNumber   = "number"
+	tokenBool     = "bool"
+	tokenOperator = "operator"
+)
+
+var filterOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "<", ">", "!", "(", ")"}
+
+//Split filter expression into tokens
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			//Quoted string, with backslash escaping quotes and backslashes only, so regular
+			//expression escapes as \d are kept as is
+			var text strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) && strings.ContainsRune(`"'\`, runes[j+1]) {
+					j++
+				}
+				text.WriteRune(runes[j])
+			}
+			if j == len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, text: text.String()})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: tokenNumber, text: string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '.' || runes[j] == '-') {
+				j++
+			}
+			text := string(runes[i:j])
+			if text == "true" || text == "false" {
+				tokens = append(tokens, filterToken{kind: tokenBool, text: text})
+			} else {
+				tokens = append(tokens, filterToken{kind: tokenField, text: text})
+			}
+			i = j
+		default:
+			matched := false
+			for _, operator := range filterOperators {
+				if strings.HasPrefix(string(runes[i:]), operator) {
+					tokens = append(tokens, filterToken{kind: tokenOperator, text: operator})
+					i += len([]rune(operator))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at %d", r, i)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+//Recursive descent parser of filter expression tokens
+type filterParser struct {
+	tokens   []filterToken
+	position int
+}
+
+//Private method for consuming the next token if it is the given operator
+func (p *filterParser) accept(operator string) bool {
+	if p.position < len(p.tokens) && p.tokens[p.position].kind == tokenOperator && p.tokens[p.position].text == operator {
+		p.position++
+		return true
+	}
+	return false
+}
+
+//Private method for consuming the next token, return false at the end of the expression
+func (p *filterParser) next() (filterToken, bool) {
+	if p.position >= len(p.tokens) {
+		return filterToken{}, false
+	}
+	p.position++
+	return p.tokens[p.position-1], true
+}
+
+//or := and ("||" and)*
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right filterNode
+		if right, err = p.parseAnd(); err == nil {
+			left = &orNode{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+//and := unary ("&&" unary)*
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept("&&") {
+		var right filterNode
+		if right, err = p.parseUnary(); err == nil {
+			left = &andNode{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+//unary := "!" unary | "(" or ")" | field [operator literal]
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.accept("!") {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node: node}, nil
+	}
+	if p.accept("(") {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return node, nil
+	}
+
+	token, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	if token.kind != tokenField {
+		return nil, fmt.Errorf("expected field instead of %q", token.text)
+	}
+	path := strings.Split(token.text, ".")
+	for _, name := range path {
+		if name == "" {
+			return nil, fmt.Errorf("empty field name in %q", token.text)
+		}
+	}
+	fieldType, err := resolveFieldType(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, operator := range []string{"==", "!=", "<=", ">=", "=~", "<", ">"} {
+		if p.accept(operator) {
+			return p.parseComparison(path, fieldType, operator)
+		}
+	}
+	return &fieldNode{path: path}, nil
+}
+
+//Private method for parsing the literal of a comparison, checking it suits the field type
+func (p *filterParser) parseComparison(path []string, fieldType reflect.Type, operator string) (filterNode, error) {
+	token, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("missing literal after %s", operator)
+	}
+	node := &compareNode{
+		path:     path,
+		operator: operator,
+	}
+	field := strings.Join(path, ".")
+	isEnum := fieldType.Kind() != reflect.String && fieldType.Implements(reflect.TypeOf((*fmt.Stringer)(nil)).Elem())
+	switch token.kind {
+	case tokenString:
+		if fieldType.Kind() != reflect.String && !isEnum {
+			return nil, fmt.Errorf("field %s is not a string", field)
+		}
+		node.literal = token.text
+		if operator == "=~" {
+			regex, err := regexp.Compile(token.text)
+			if err != nil {
+				return nil, err
+			}
+			node.regex = regex
+		}
+		return node, nil
+	case tokenNumber:
+		switch fieldType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			return nil, fmt.Errorf("field %s is not a number", field)
+		}
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, err
+		}
+		node.literal = number
+	case tokenBool:
+		if fieldType.Kind() != reflect.Bool {
+			return nil, fmt.Errorf("field %s is not a boolean", field)
+		}
+		if operator != "==" && operator != "!=" {
+			return nil, fmt.Errorf("operator %s is not supported for booleans", operator)
+		}
+		node.literal = token.text == "true"
+	default:
+		return nil, fmt.Errorf("expected literal instead of %q", token.text)
+	}
+	if operator == "=~" {
+		return nil, fmt.Errorf("operator =~ requires a string")
+	}
+	return node, nil
+}
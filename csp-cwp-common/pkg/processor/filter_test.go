@@ -0,0 +1,110 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type FilterTestSuite struct {
+	suite.Suite
+}
+
+func (suite *FilterTestSuite) SetupTest() {
+}
+
+func (suite *FilterTestSuite) TearDownTest() {
+}
+
+func (suite *FilterTestSuite) TestFilter__Match() {
+	event := &pb.Event{
+		Type: pb.EventType_DummyEventType,
+		Info: &pb.Event_Dummy{
+			Dummy: &pb.DummyEvent{
+				Info: "disk full",
+			},
+		},
+		Header: &pb.EventHeader{
+			Source:       "Instance1",
+			HopCount:     2,
+			TraceContext: map[string]string{"tenant": "acme"},
+		},
+	}
+	expressions := map[string]bool{
+		`Dummy.Info == "disk full"`:                       true,
+		`Dummy.Info != 'disk full'`:                       false,
+		`dummy.info =~ "^disk"`:                           true,
+		`Dummy.Info =~ "^cpu"`:                            false,
+		`Dummy.Info =~ "^\w+\s"`:                          true,
+		`Dummy.Info =~ "^\d+"`:                            false,
+		`Dummy.Info == "disk \"full\""`:                   false,
+		`Dummy.Info != 'disk\'s full'`:                    true,
+		`Type == "DummyEventType"`:                        true,
+		`Type == 0`:                                       true,
+		`Header.HopCount >= 2 && Header.HopCount < 3`:     true,
+		`Header.HopCount > 2 || Header.Source == "Other"`: false,
+		`Header.TraceContext.tenant == "acme"`:            true,
+		`!Header.TraceContext.user`:                       true,
+		`Header.Sequence`:                                 false,
+		`DeadLetter.Relation == "relation"`:               false,
+		`DeadLetter.Relation != "relation"`:               false,
+		`!(Dummy.Info == "x" || Header.HopCount == 1)`:    true,
+		`Header.Source < "Instance2" && Dummy`:            true,
+	}
+	for expression, expected := range expressions {
+		filter, err := CompileFilter(expression)
+		require.NoError(suite.T(), err, "failed to compile %s: %s", expression, err)
+		require.Equal(suite.T(), expected, filter.Match(event), "unexpected match of %s", expression)
+	}
+}
+
+func (suite *FilterTestSuite) TestFilter__Invalid() {
+	for _, expression := range []string{
+		``,
+		`Dummy.Info ==`,
+		`Dummy.Info == "open`,
+		`Dummy.Size == 1`,
+		`Dummy.Info == 1`,
+		`Header.HopCount == "two"`,
+		`Header.HopCount =~ 2`,
+		`Dummy.Info =~ "("`,
+		`(Dummy.Info == "x"`,
+		`Dummy.Info == "x" Header.Source == "y"`,
+		`Dummy.Info == "x" & Header.Source == "y"`,
+		`"x" == Dummy.Info`,
+		`Header. == "x"`,
+		`Header..Source == "x"`,
+		`.Type == 0`,
+	} {
+		_, err := CompileFilter(expression)
+		require.Error(suite.T(), err, "compiled invalid filter %s", expression)
+	}
+}
+
+func (suite *FilterTestSuite) TestFilter__Sink() {
+	filter, err := CompileFilter(`Dummy.Info == "Event 1"`)
+	require.NoError(suite.T(), err, "failed to compile filter: %s", err)
+	recording := &recordingSink{}
+	sink := NewFilterSink(filter, recording)
+
+	//Only matching events are passed on
+	events := prepareEvents(3)
+	for _, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	received := recording.received()
+	require.Equal(suite.T(), 1, len(received))
+	require.True(suite.T(), received[0].Equal(events[1]), "unexpected event passed on")
+
+	queries, _ := prepareQueries(1)
+	_, err = sink.RunQuery(queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+}
+
+func TestFilter__RUN(t *testing.T) {
+	crt := new(FilterTestSuite)
+	suite.Run(t, crt)
+}
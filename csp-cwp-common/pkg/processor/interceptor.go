@@ -0,0 +1,125 @@
+package processor
+
+import (
+	"context"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Handler of an intercepted event, the next interceptor in chain or the destination itself
+type EventHandler func(ctx context.Context, event *proto.Event) error
+
+//Handler of an intercepted query, the next interceptor in chain or the destination itself
+type QueryHandler func(ctx context.Context, query *proto.Query) (*proto.QueryResult, error)
+
+//Interceptor of the events passing between processors:
+//It may inspect or modify the event and pass it on by calling next, or reject it by
+//returning an error without calling next.
+type EventInterceptor func(ctx context.Context, event *proto.Event, next EventHandler) error
+
+//Interceptor of the queries passing between processors:
+//It may inspect or modify the query and result around calling next, reject the query by
+//returning an error, or short-circuit it by returning a result without calling next.
+type QueryInterceptor func(ctx context.Context, query *proto.Query, next QueryHandler) (*proto.QueryResult, error)
+
+//Chain event interceptors into a single interceptor, called in the given order
+func ChainEventInterceptors(interceptors ...EventInterceptor) EventInterceptor {
+	return func(ctx context.Context, event *proto.Event, next EventHandler) error {
+		return chainEventHandler(interceptors, next)(ctx, event)
+	}
+}
+
+//Chain query interceptors into a single interceptor, called in the given order
+func ChainQueryInterceptors(interceptors ...QueryInterceptor) QueryInterceptor {
+	return func(ctx context.Context, query *proto.Query, next QueryHandler) (*proto.QueryResult, error) {
+		return chainQueryHandler(interceptors, next)(ctx, query)
+	}
+}
+
+//Build handler passing the events through the interceptors before the final handler
+func chainEventHandler(interceptors []EventInterceptor, handler EventHandler) EventHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, event *proto.Event) error {
+			return interceptor(ctx, event, next)
+		}
+	}
+	return handler
+}
+
+//Build handler passing the queries through the interceptors before the final handler
+func chainQueryHandler(interceptors []QueryInterceptor, handler QueryHandler) QueryHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+			return interceptor(ctx, query, next)
+		}
+	}
+	return handler
+}
+
+//This is an egress object passing the events and queries through interceptors
+//before they reach the wrapped sink.
+type InterceptedSink struct {
+	SinkInterface
+	pushEvent EventHandler
+	runQuery  QueryHandler
+}
+
+//Create sink calling the interceptors, in the given order, on each event and query
+func NewInterceptedSink(sink SinkInterface, eventInterceptors []EventInterceptor, queryInterceptors []QueryInterceptor) SinkInterface {
+	return &InterceptedSink{
+		pushEvent: chainEventHandler(eventInterceptors, pushEventHandler(sink)),
+		runQuery:  chainQueryHandler(queryInterceptors, runQueryHandler(sink)),
+	}
+}
+
+func (s *InterceptedSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return s.RunQueryContext(context.Background(), query)
+}
+
+func (s *InterceptedSink) PushEvent(event *proto.Event) error {
+	return s.PushEventContext(context.Background(), event)
+}
+
+func (s *InterceptedSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return s.runQuery(ctx, query)
+}
+
+func (s *InterceptedSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	return s.pushEvent(ctx, event)
+}
+
+//This is an ingress object passing the events and queries through interceptors
+//before they reach the handlers of the wrapped tap.
+type InterceptedTap struct {
+	//Handlers setters are passed on to the wrapped tap
+	TapInterface
+	pushEvent EventHandler
+	runQuery  QueryHandler
+}
+
+//Create tap calling the interceptors, in the given order, on each event and query
+func NewInterceptedTap(tap TapInterface, eventInterceptors []EventInterceptor, queryInterceptors []QueryInterceptor) TapInterface {
+	return &InterceptedTap{
+		TapInterface: tap,
+		pushEvent:    chainEventHandler(eventInterceptors, pushEventHandler(tap)),
+		runQuery:     chainQueryHandler(queryInterceptors, runQueryHandler(tap)),
+	}
+}
+
+func (t *InterceptedTap) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return t.RunQueryContext(context.Background(), query)
+}
+
+func (t *InterceptedTap) PushEvent(event *proto.Event) error {
+	return t.PushEventContext(context.Background(), event)
+}
+
+func (t *InterceptedTap) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return t.runQuery(ctx, query)
+}
+
+func (t *InterceptedTap) PushEventContext(ctx context.Context, event *proto.Event) error {
+	return t.pushEvent(ctx, event)
+}
@@ -0,0 +1,98 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type InterceptorTestSuite struct {
+	suite.Suite
+}
+
+func (suite *InterceptorTestSuite) SetupTest() {
+}
+
+func (suite *InterceptorTestSuite) TearDownTest() {
+}
+
+func (suite *InterceptorTestSuite) TestInterceptor__EventChain() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+
+	calls := []string{}
+	tracing := func(name string) EventInterceptor {
+		return func(ctx context.Context, event *pb.Event, next EventHandler) error {
+			calls = append(calls, name)
+			return next(ctx, event)
+		}
+	}
+	//Modify the event info
+	modifying := func(ctx context.Context, event *pb.Event, next EventHandler) error {
+		event.GetDummy().Info = "modified"
+		return next(ctx, event)
+	}
+	//Reject events of empty info
+	rejecting := func(ctx context.Context, event *pb.Event, next EventHandler) error {
+		if event.GetDummy().Info == "" {
+			return fmt.Errorf("empty event")
+		}
+		return next(ctx, event)
+	}
+	sink := NewInterceptedSink(NewSink(collector.GetTap()),
+		[]EventInterceptor{tracing("first"), rejecting, ChainEventInterceptors(tracing("second"), modifying)}, nil)
+
+	require.NoError(suite.T(), sink.PushEvent(prepareEvents(1)[0]), "failed to push event")
+	require.Equal(suite.T(), []string{"first", "second"}, calls)
+	require.Equal(suite.T(), 1, len(collector.events))
+	require.Equal(suite.T(), "modified", collector.events[0].GetDummy().Info)
+
+	event := prepareEvents(1)[0]
+	event.GetDummy().Info = ""
+	require.Error(suite.T(), sink.PushEvent(event), "rejected event was pushed")
+	require.Equal(suite.T(), 1, len(collector.events))
+}
+
+func (suite *InterceptorTestSuite) TestInterceptor__QueryShortCircuit() {
+	service := newHungService()
+	defer close(service.release)
+
+	//Queries of known UUID are answered without reaching the hung service
+	cached := &pb.QueryResult{
+		Type: pb.QueryType_DummyQueryType,
+		UUID: "query-uuid",
+	}
+	shortCircuit := func(ctx context.Context, query *pb.Query, next QueryHandler) (*pb.QueryResult, error) {
+		if query.UUID == cached.UUID {
+			return cached, nil
+		}
+		return next(ctx, query)
+	}
+	tap := NewInterceptedTap(NewServiceTap(service, service), nil, []QueryInterceptor{shortCircuit})
+
+	queries, _ := prepareQueries(1)
+	result, err := NewSink(tap).RunQuery(queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.Equal(suite.T(), cached, result)
+
+	//Other queries reach the service
+	queries[0].UUID = "other-uuid"
+	ctx := context.WithValue(context.Background(), contextKey{}, "value")
+	result, err = RunQueryWithContext(ctx, tap, queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.Equal(suite.T(), "other-uuid", result.UUID)
+	require.Equal(suite.T(), "value", service.lastValue)
+}
+
+func TestInterceptor__RUN(t *testing.T) {
+	crt := new(InterceptorTestSuite)
+	suite.Run(t, crt)
+}
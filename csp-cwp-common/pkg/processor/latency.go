@@ -0,0 +1,156 @@
+package processor
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+//Highest latency tracked by the latency histograms, longer latencies are recorded as this value
+const maxTrackedLatency = time.Hour
+
+//Latency histogram backed by an HdrHistogram, safe for concurrent use:
+//Latencies are tracked in microseconds resolution. It implements go-metrics Histogram
+//over the microseconds values, so it can be registered on a metrics registry.
+type LatencyHistogram struct {
+	lock      sync.Mutex
+	histogram *hdrhistogram.Histogram
+	sum       int64
+}
+
+//Point in time view of a latency histogram
+type LatencySnapshot struct {
+	Count int64
+	Min   time.Duration
+	Max   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+//Create empty latency histogram
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{
+		histogram: hdrhistogram.New(1, int64(maxTrackedLatency/time.Microsecond), 3),
+	}
+}
+
+//Record a single latency
+func (h *LatencyHistogram) Record(latency time.Duration) {
+	h.Update(int64(latency / time.Microsecond))
+}
+
+//Record the latency passed since start
+func (h *LatencyHistogram) Since(start time.Time) {
+	h.Record(time.Since(start))
+}
+
+//Get snapshot of the recorded latencies
+func (h *LatencyHistogram) Latencies() LatencySnapshot {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return LatencySnapshot{
+		Count: h.histogram.TotalCount(),
+		Min:   time.Duration(h.histogram.Min()) * time.Microsecond,
+		Max:   time.Duration(h.histogram.Max()) * time.Microsecond,
+		Mean:  time.Duration(h.histogram.Mean() * float64(time.Microsecond)),
+		P50:   time.Duration(h.histogram.ValueAtPercentile(50)) * time.Microsecond,
+		P90:   time.Duration(h.histogram.ValueAtPercentile(90)) * time.Microsecond,
+		P99:   time.Duration(h.histogram.ValueAtPercentile(99)) * time.Microsecond,
+	}
+}
+
+//Clear the recorded latencies
+func (h *LatencyHistogram) Clear() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.histogram.Reset()
+	h.sum = 0
+}
+
+//Record a single latency in microseconds
+func (h *LatencyHistogram) Update(value int64) {
+	if highest := h.histogram.HighestTrackableValue(); value > highest {
+		value = highest
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.histogram.RecordValue(value) == nil {
+		h.sum += value
+	}
+}
+
+func (h *LatencyHistogram) Count() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.histogram.TotalCount()
+}
+
+func (h *LatencyHistogram) Max() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.histogram.Max()
+}
+
+func (h *LatencyHistogram) Mean() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.histogram.Mean()
+}
+
+func (h *LatencyHistogram) Min() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.histogram.Min()
+}
+
+//Get value at percentile, given in the go-metrics [0, 1] scale
+func (h *LatencyHistogram) Percentile(percentile float64) float64 {
+	return h.Percentiles([]float64{percentile})[0]
+}
+
+//Get values at percentiles, given in the go-metrics [0, 1] scale
+func (h *LatencyHistogram) Percentiles(percentiles []float64) []float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	values := make([]float64, len(percentiles))
+	for i, percentile := range percentiles {
+		values[i] = float64(h.histogram.ValueAtPercentile(percentile * 100))
+	}
+	return values
+}
+
+//Samples are not kept, the HdrHistogram replaces them
+func (h *LatencyHistogram) Sample() metrics.Sample {
+	return metrics.NilSample{}
+}
+
+//Get a copy of the histogram
+func (h *LatencyHistogram) Snapshot() metrics.Histogram {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return &LatencyHistogram{
+		histogram: hdrhistogram.Import(h.histogram.Export()),
+		sum:       h.sum,
+	}
+}
+
+func (h *LatencyHistogram) StdDev() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.histogram.StdDev()
+}
+
+func (h *LatencyHistogram) Sum() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.sum
+}
+
+func (h *LatencyHistogram) Variance() float64 {
+	return math.Pow(h.StdDev(), 2)
+}
@@ -0,0 +1,158 @@
+package processor
+
+import (
+	"fmt"
+	"sync"
+)
+
+//State of a processor instance lifecycle
+type LifecycleState int
+
+const (
+	//Created and not run yet
+	LifecycleCreated LifecycleState = iota
+	//Run was called and did not return yet
+	LifecycleStarting
+	//Run succeeded
+	LifecycleRunning
+	//Shutdown was called and did not return yet
+	LifecycleStopping
+	//Shutdown succeeded, the instance may be run again
+	LifecycleStopped
+	//Run or Shutdown failed, or the instance was found dead
+	LifecycleFailed
+)
+
+var lifecycleStateNames = map[LifecycleState]string{
+	LifecycleCreated:  "Created",
+	LifecycleStarting: "Starting",
+	LifecycleRunning:  "Running",
+	LifecycleStopping: "Stopping",
+	LifecycleStopped:  "Stopped",
+	LifecycleFailed:   "Failed",
+}
+
+func (s LifecycleState) String() string {
+	if name, exists := lifecycleStateNames[s]; exists {
+		return name
+	}
+	return "Unknown"
+}
+
+//Mapping from a state to the states it may transition to:
+//A failed instance may be run again, or shut down for releasing whatever it managed to start.
+var lifecycleTransitions = map[LifecycleState][]LifecycleState{
+	LifecycleCreated:  {LifecycleStarting},
+	LifecycleStarting: {LifecycleRunning, LifecycleFailed},
+	LifecycleRunning:  {LifecycleStopping, LifecycleFailed},
+	LifecycleStopping: {LifecycleStopped, LifecycleFailed},
+	LifecycleStopped:  {LifecycleStarting},
+	LifecycleFailed:   {LifecycleStarting, LifecycleStopping},
+}
+
+//Listener of lifecycle state changes
+type LifecycleListener func(from LifecycleState, to LifecycleState)
+
+//Tracks the lifecycle state of a processor instance:
+//Transitions are checked against the allowed ones, and each one is notified to the subscribed
+//listeners in order of subscription. Listeners are called with the lifecycle lock held, so the
+//notifications are in the order of the transitions, and should neither block nor transition
+//the lifecycle themselves.
+type Lifecycle struct {
+	lock      sync.Mutex
+	state     LifecycleState
+	listeners []*lifecycleSubscription
+	//Signaled on each transition, for waiting for the lifecycle to settle
+	transitioned *sync.Cond
+}
+
+type lifecycleSubscription struct {
+	listener LifecycleListener
+}
+
+//Create lifecycle in the Created state
+func NewLifecycle() *Lifecycle {
+	l := &Lifecycle{
+		state: LifecycleCreated,
+	}
+	l.transitioned = sync.NewCond(&l.lock)
+	return l
+}
+
+//Get the current state
+func (l *Lifecycle) State() LifecycleState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.state
+}
+
+//Wait while the state is Starting or Stopping, and get the state it settled in
+func (l *Lifecycle) Settle() LifecycleState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for l.state == LifecycleStarting || l.state == LifecycleStopping {
+		l.transitioned.Wait()
+	}
+	return l.state
+}
+
+//Transition to a state, failing if it is not allowed from the current state
+func (l *Lifecycle) Transition(to LifecycleState) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.transition(to)
+}
+
+//Transition from a state to another atomically, failing if the current state is not the given
+//one or if the transition is not allowed
+func (l *Lifecycle) TransitionFrom(from LifecycleState, to LifecycleState) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.state != from {
+		return fmt.Errorf("invalid lifecycle transition from %s to %s, the state is %s", from, to, l.state)
+	}
+	return l.transition(to)
+}
+
+//Private method for transitioning with the lock held
+func (l *Lifecycle) transition(to LifecycleState) error {
+	from := l.state
+	allowed := false
+	for _, state := range lifecycleTransitions[from] {
+		if state == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("invalid lifecycle transition from %s to %s", from, to)
+	}
+	l.state = to
+	for _, subscription := range l.listeners {
+		subscription.listener(from, to)
+	}
+	l.transitioned.Broadcast()
+	return nil
+}
+
+//Subscribe listener to the state changes:
+//Return function for unsubscribing it.
+func (l *Lifecycle) Subscribe(listener LifecycleListener) func() {
+	subscription := &lifecycleSubscription{
+		listener: listener,
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.listeners = append(l.listeners, subscription)
+
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		for i, subscribed := range l.listeners {
+			if subscribed == subscription {
+				l.listeners = append(l.listeners[:i:i], l.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
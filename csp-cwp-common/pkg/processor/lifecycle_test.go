@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type LifecycleTestSuite struct {
+	suite.Suite
+}
+
+func (suite *LifecycleTestSuite) SetupTest() {
+}
+
+func (suite *LifecycleTestSuite) TearDownTest() {
+}
+
+func (suite *LifecycleTestSuite) TestLifecycle__Transitions() {
+	lifecycle := NewLifecycle()
+	require.Equal(suite.T(), LifecycleCreated, lifecycle.State())
+	require.Equal(suite.T(), "Created", lifecycle.State().String())
+
+	//Only the allowed transitions succeed
+	require.Error(suite.T(), lifecycle.Transition(LifecycleRunning), "ran with no start")
+	require.Error(suite.T(), lifecycle.Transition(LifecycleStopping), "stopped before run")
+	for _, state := range []LifecycleState{LifecycleStarting, LifecycleRunning, LifecycleStopping, LifecycleStopped} {
+		require.NoError(suite.T(), lifecycle.Transition(state), "failed to transition to %s", state)
+		require.Equal(suite.T(), state, lifecycle.State())
+	}
+	require.Error(suite.T(), lifecycle.Transition(LifecycleStopped), "stopped twice")
+
+	//Failed instances may be run again or shut down
+	require.NoError(suite.T(), lifecycle.Transition(LifecycleStarting))
+	require.NoError(suite.T(), lifecycle.Transition(LifecycleFailed))
+	require.Error(suite.T(), lifecycle.Transition(LifecycleRunning), "ran failed instance with no start")
+	require.NoError(suite.T(), lifecycle.Transition(LifecycleStopping))
+	require.NoError(suite.T(), lifecycle.Transition(LifecycleStopped))
+	require.Equal(suite.T(), "Unknown", LifecycleState(100).String())
+}
+
+func (suite *LifecycleTestSuite) TestLifecycle__Subscribe() {
+	lifecycle := NewLifecycle()
+	first := []LifecycleState{}
+	second := []LifecycleState{}
+	unsubscribe := lifecycle.Subscribe(func(from LifecycleState, to LifecycleState) {
+		first = append(first, from, to)
+	})
+	lifecycle.Subscribe(func(from LifecycleState, to LifecycleState) {
+		second = append(second, to)
+	})
+	require.NoError(suite.T(), lifecycle.Transition(LifecycleStarting))
+	require.Error(suite.T(), lifecycle.Transition(LifecycleStopped), "stopped while starting")
+	unsubscribe()
+	unsubscribe()
+	require.NoError(suite.T(), lifecycle.Transition(LifecycleRunning))
+
+	require.Equal(suite.T(), []LifecycleState{LifecycleCreated, LifecycleStarting}, first)
+	require.Equal(suite.T(), []LifecycleState{LifecycleStarting, LifecycleRunning}, second)
+}
+
+func (suite *LifecycleTestSuite) TestLifecycle__TransitionFrom() {
+	lifecycle := NewLifecycle()
+	require.Error(suite.T(), lifecycle.TransitionFrom(LifecycleStopped, LifecycleStarting), "transitioned from other state")
+	require.Equal(suite.T(), LifecycleCreated, lifecycle.State())
+	require.Error(suite.T(), lifecycle.TransitionFrom(LifecycleCreated, LifecycleRunning), "ran with no start")
+	require.NoError(suite.T(), lifecycle.TransitionFrom(LifecycleCreated, LifecycleStarting))
+	require.Error(suite.T(), lifecycle.TransitionFrom(LifecycleCreated, LifecycleStarting), "started twice")
+	require.Equal(suite.T(), LifecycleStarting, lifecycle.State())
+}
+
+func (suite *LifecycleTestSuite) TestLifecycle__Settle() {
+	lifecycle := NewLifecycle()
+	require.Equal(suite.T(), LifecycleCreated, lifecycle.Settle())
+	require.NoError(suite.T(), lifecycle.Transition(LifecycleStarting))
+
+	//Settling waits for the start to complete
+	settled := make(chan LifecycleState, 1)
+	go func() {
+		settled <- lifecycle.Settle()
+	}()
+	select {
+	case state := <-settled:
+		require.Fail(suite.T(), "settled while starting", state.String())
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(suite.T(), lifecycle.Transition(LifecycleRunning))
+	select {
+	case state := <-settled:
+		require.Equal(suite.T(), LifecycleRunning, state)
+	case <-time.After(5 * time.Second):
+		require.Fail(suite.T(), "did not settle after start")
+	}
+}
+
+func TestLifecycle__RUN(t *testing.T) {
+	crt := new(LifecycleTestSuite)
+	suite.Run(t, crt)
+}
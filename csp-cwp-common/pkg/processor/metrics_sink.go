@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Metrics of the calls made over a single relation
+type RelationMetrics struct {
+	//Events pushed successfully
+	EventsPushed metrics.Counter
+	//Events which failed to be pushed
+	EventErrors metrics.Counter
+	//Queries run, whether successful or not
+	Queries metrics.Counter
+	//Queries which failed
+	QueryErrors metrics.Counter
+	//Latency of the queries
+	QueryLatency *LatencyHistogram
+	//Events dropped or queries rejected for exceeding the relation rate limit
+	RateLimited metrics.Counter
+	//Events dropped by the relation sampling
+	SampledOut metrics.Counter
+}
+
+//Point in time view of a relation metrics
+type RelationSnapshot struct {
+	EventsPushed int64
+	EventErrors  int64
+	Queries      int64
+	QueryErrors  int64
+	QueryLatency LatencySnapshot
+	RateLimited  int64
+	SampledOut   int64
+}
+
+//Get the metrics registry key prefix of a relation
+func RelationName(source string, destination string, typeName string) string {
+	return fmt.Sprintf("%s->%s:%s", source, destination, typeName)
+}
+
+//Get relation metrics from the registry, registering them under the relation name
+//prefix if missing: Metrics are registered as <relation>.<metric>, as
+//Instance1->Instance2:DummyQueryType.queryLatency
+func GetOrRegisterRelationMetrics(registry metrics.Registry, relation string) (*RelationMetrics, error) {
+	latency, ok := registry.GetOrRegister(relation+".queryLatency", NewLatencyHistogram).(*LatencyHistogram)
+	if !ok {
+		return nil, fmt.Errorf("unexpected metric type for %s.queryLatency", relation)
+	}
+	return &RelationMetrics{
+		EventsPushed: metrics.GetOrRegisterCounter(relation+".eventsPushed", registry),
+		EventErrors:  metrics.GetOrRegisterCounter(relation+".eventErrors", registry),
+		Queries:      metrics.GetOrRegisterCounter(relation+".queries", registry),
+		QueryErrors:  metrics.GetOrRegisterCounter(relation+".queryErrors", registry),
+		QueryLatency: latency,
+		RateLimited:  metrics.GetOrRegisterCounter(relation+".rateLimited", registry),
+		SampledOut:   metrics.GetOrRegisterCounter(relation+".sampledOut", registry),
+	}, nil
+}
+
+//Get snapshot of the relation metrics
+func (m *RelationMetrics) Snapshot() RelationSnapshot {
+	return RelationSnapshot{
+		EventsPushed: m.EventsPushed.Count(),
+		EventErrors:  m.EventErrors.Count(),
+		Queries:      m.Queries.Count(),
+		QueryErrors:  m.QueryErrors.Count(),
+		QueryLatency: m.QueryLatency.Latencies(),
+		RateLimited:  m.RateLimited.Count(),
+		SampledOut:   m.SampledOut.Count(),
+	}
+}
+
+//This is an egress object recording the relation metrics of the calls made
+//through the wrapped sink.
+type MetricsSink struct {
+	SinkInterface
+	metrics *RelationMetrics
+	sink    SinkInterface
+}
+
+//Create sink recording the calls into the relation metrics
+func NewMetricsSink(metrics *RelationMetrics, sink SinkInterface) SinkInterface {
+	return &MetricsSink{
+		metrics: metrics,
+		sink:    sink,
+	}
+}
+
+func (m *MetricsSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return m.RunQueryContext(context.Background(), query)
+}
+
+func (m *MetricsSink) PushEvent(event *proto.Event) error {
+	return m.PushEventContext(context.Background(), event)
+}
+
+func (m *MetricsSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	start := time.Now()
+	result, err := RunQueryWithContext(ctx, m.sink, query)
+	m.metrics.QueryLatency.Since(start)
+	m.metrics.Queries.Inc(1)
+	if err != nil {
+		m.metrics.QueryErrors.Inc(1)
+	}
+	return result, err
+}
+
+//A streaming query is recorded as a single query lasting until its stream is terminated.
+func (m *MetricsSink) RunStreamingQuery(ctx context.Context, query *proto.Query, stream ResultStream) error {
+	start := time.Now()
+	err := RunStreamingQuery(ctx, m.sink, query, stream)
+	m.metrics.QueryLatency.Since(start)
+	m.metrics.Queries.Inc(1)
+	if err != nil {
+		m.metrics.QueryErrors.Inc(1)
+	}
+	return err
+}
+
+func (m *MetricsSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	err := PushEventWithContext(ctx, m.sink, event)
+	if err != nil {
+		m.metrics.EventErrors.Inc(1)
+	} else {
+		m.metrics.EventsPushed.Inc(1)
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type MetricsSinkTestSuite struct {
+	suite.Suite
+}
+
+func (suite *MetricsSinkTestSuite) SetupTest() {
+}
+
+func (suite *MetricsSinkTestSuite) TearDownTest() {
+}
+
+func (suite *MetricsSinkTestSuite) TestMetricsSink__Record() {
+	registry := metrics.NewRegistry()
+	relation := RelationName("Instance1", "Instance2", "DummyQueryType")
+	require.Equal(suite.T(), "Instance1->Instance2:DummyQueryType", relation)
+	relationMetrics, err := GetOrRegisterRelationMetrics(registry, relation)
+	require.NoError(suite.T(), err, "failed to register metrics: %s", err)
+
+	service := newHungService()
+	close(service.release)
+	sink := NewMetricsSink(relationMetrics, NewSink(NewServiceTap(service, service)))
+	queries, _ := prepareQueries(3)
+	for _, query := range queries {
+		_, err := sink.RunQuery(query)
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+	}
+	for _, event := range prepareEvents(2) {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	//Calls through sink with no tap fail
+	broken := NewMetricsSink(relationMetrics, NewSink(nil))
+	require.Error(suite.T(), broken.PushEvent(prepareEvents(1)[0]), "pushed event with no tap")
+	_, err = broken.RunQuery(queries[0])
+	require.Error(suite.T(), err, "ran query with no tap")
+
+	snapshot := relationMetrics.Snapshot()
+	require.Equal(suite.T(), int64(2), snapshot.EventsPushed)
+	require.Equal(suite.T(), int64(1), snapshot.EventErrors)
+	require.Equal(suite.T(), int64(4), snapshot.Queries)
+	require.Equal(suite.T(), int64(1), snapshot.QueryErrors)
+	require.Equal(suite.T(), int64(4), snapshot.QueryLatency.Count)
+
+	//Metrics are shared through the registry
+	require.Equal(suite.T(), int64(4), registry.Get(relation+".queries").(metrics.Counter).Count())
+	require.Equal(suite.T(), int64(4), registry.Get(relation+".queryLatency").(metrics.Histogram).Count())
+	require.Zero(suite.T(), registry.Get(relation+".rateLimited").(metrics.Counter).Count())
+	again, err := GetOrRegisterRelationMetrics(registry, relation)
+	require.NoError(suite.T(), err, "failed to get metrics: %s", err)
+	require.Equal(suite.T(), snapshot, again.Snapshot())
+}
+
+func (suite *MetricsSinkTestSuite) TestMetricsSink__Latency() {
+	histogram := NewLatencyHistogram()
+	for i := 1; i <= 100; i++ {
+		histogram.Record(time.Duration(i) * time.Millisecond)
+	}
+	histogram.Record(2 * maxTrackedLatency)
+
+	snapshot := histogram.Latencies()
+	require.Equal(suite.T(), int64(101), snapshot.Count)
+	require.InDelta(suite.T(), float64(time.Millisecond), float64(snapshot.Min), float64(time.Millisecond)/100)
+	require.InDelta(suite.T(), float64(50*time.Millisecond), float64(snapshot.P50), float64(2*time.Millisecond))
+	require.InDelta(suite.T(), float64(90*time.Millisecond), float64(snapshot.P90), float64(2*time.Millisecond))
+	require.InDelta(suite.T(), float64(maxTrackedLatency), float64(snapshot.Max), float64(maxTrackedLatency)/100)
+
+	//Histogram is also a go-metrics histogram of the microseconds values
+	var metricsHistogram metrics.Histogram = histogram.Snapshot()
+	require.Equal(suite.T(), int64(101), metricsHistogram.Count())
+	require.InDelta(suite.T(), 50000, metricsHistogram.Percentile(0.5), 2000)
+
+	histogram.Clear()
+	require.Zero(suite.T(), histogram.Latencies().Count)
+	require.Equal(suite.T(), int64(101), metricsHistogram.Count())
+}
+
+func TestMetricsSink__RUN(t *testing.T) {
+	crt := new(MetricsSinkTestSuite)
+	suite.Run(t, crt)
+}
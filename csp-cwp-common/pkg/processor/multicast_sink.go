@@ -0,0 +1,118 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	gogoproto "github.com/gogo/protobuf/proto"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Error aggregating the failures of multicast destinations
+type MulticastError struct {
+	//Mapping of failed destination name to its error
+	Errors map[string]error
+}
+
+func (e *MulticastError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failures := make([]string, 0, len(names))
+	for _, name := range names {
+		failures = append(failures, fmt.Sprintf("%s: %s", name, e.Errors[name]))
+	}
+	return fmt.Sprintf("failed to push event to %d destinations (%s)", len(failures), strings.Join(failures, ", "))
+}
+
+type multicastDestination struct {
+	name string
+	sink SinkInterface
+}
+
+//This is an events egress object delivering each event to multiple destinations:
+//Events are pushed to all destinations concurrently, so a failing or slow destination
+//does not prevent the delivery to the others. Failures are aggregated into a MulticastError.
+//Each destination gets its own copy of the event, so destinations can not affect each other.
+type MulticastSink struct {
+	SinkInterface
+	destinations []multicastDestination
+}
+
+//Create multicast sink with no destinations
+func NewMulticastSink() *MulticastSink {
+	return &MulticastSink{}
+}
+
+//Add destination sink:
+//Should be called during bootstrap when building the processors and relations from a single thread.
+func (m *MulticastSink) AddDestination(name string, sink SinkInterface) error {
+	for _, destination := range m.destinations {
+		if destination.name == name {
+			return fmt.Errorf("destination %s already exists", name)
+		}
+	}
+	m.destinations = append(m.destinations, multicastDestination{
+		name: name,
+		sink: sink,
+	})
+	return nil
+}
+
+func (m *MulticastSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return m.RunQueryContext(context.Background(), query)
+}
+
+func (m *MulticastSink) PushEvent(event *proto.Event) error {
+	return m.PushEventContext(context.Background(), event)
+}
+
+func (m *MulticastSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return nil, fmt.Errorf("queries are not supported by multicast sink")
+}
+
+func (m *MulticastSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	switch len(m.destinations) {
+	case 0:
+		return fmt.Errorf("no destinations for multicast sink")
+	case 1:
+		return PushEventWithContext(ctx, m.destinations[0].sink, event)
+	}
+
+	//Copy the event before any destination gets it
+	events := make([]*proto.Event, len(m.destinations))
+	events[0] = event
+	for i := 1; i < len(events); i++ {
+		events[i] = gogoproto.Clone(event).(*proto.Event)
+	}
+
+	errors := make([]error, len(m.destinations))
+	var wg sync.WaitGroup
+	for i := range m.destinations {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errors[i] = PushEventWithContext(ctx, m.destinations[i].sink, events[i])
+		}(i)
+	}
+	wg.Wait()
+
+	multicastErr := &MulticastError{
+		Errors: make(map[string]error),
+	}
+	for i, err := range errors {
+		if err != nil {
+			multicastErr.Errors[m.destinations[i].name] = err
+		}
+	}
+	if len(multicastErr.Errors) > 0 {
+		return multicastErr
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package processor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type MulticastSinkTestSuite struct {
+	suite.Suite
+}
+
+func (suite *MulticastSinkTestSuite) SetupTest() {
+}
+
+func (suite *MulticastSinkTestSuite) TearDownTest() {
+}
+
+func (suite *MulticastSinkTestSuite) TestMulticastSink__Deliver() {
+	collectors := []*eventsCollector{{}, {}, {}}
+	multicast := NewMulticastSink()
+	for i, collector := range collectors {
+		collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+			LivenessInterval: time.Second,
+		})
+		err := multicast.AddDestination(fmt.Sprintf("collector%d", i), NewSink(collector.GetTap()))
+		require.NoError(suite.T(), err, "failed to add destination: %s", err)
+	}
+	err := multicast.AddDestination("collector0", NewSink(collectors[0].GetTap()))
+	require.Error(suite.T(), err, "added same destination twice")
+
+	events := prepareEvents(5)
+	for _, event := range events {
+		require.NoError(suite.T(), multicast.PushEvent(event), "failed to push event")
+	}
+
+	//Each destination gets equal but separate copies of the events
+	for _, collector := range collectors {
+		require.Equal(suite.T(), len(events), len(collector.events))
+		for i, event := range collector.events {
+			require.True(suite.T(), event.Equal(events[i]), "mismatching events")
+		}
+	}
+	require.True(suite.T(), collectors[0].events[0] != collectors[1].events[0], "destinations share event copy")
+
+	_, err = multicast.RunQuery(&pb.Query{})
+	require.Error(suite.T(), err, "multicast sink ran a query")
+}
+
+func (suite *MulticastSinkTestSuite) TestMulticastSink__FailureIsolation() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	multicast := NewMulticastSink()
+	require.NoError(suite.T(), multicast.AddDestination("broken", NewSink(nil)), "failed to add destination")
+	require.NoError(suite.T(), multicast.AddDestination("collector", NewSink(collector.GetTap())), "failed to add destination")
+
+	events := prepareEvents(1)
+	err := multicast.PushEvent(events[0])
+	require.Error(suite.T(), err, "failure of destination was not reported")
+	multicastErr, ok := err.(*MulticastError)
+	require.True(suite.T(), ok, "unexpected error type %T", err)
+	require.Equal(suite.T(), 1, len(multicastErr.Errors))
+	require.Contains(suite.T(), multicastErr.Errors, "broken")
+
+	//Healthy destination still got the event
+	require.Equal(suite.T(), 1, len(collector.events))
+}
+
+func TestMulticastSink__RUN(t *testing.T) {
+	crt := new(MulticastSinkTestSuite)
+	suite.Run(t, crt)
+}
@@ -0,0 +1,59 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+//Error returned when the handler of an event or query panicked
+type PanicError struct {
+	//The panicking operation
+	Operation string
+	//The value the handler panicked with
+	Value interface{}
+	//Stack trace of the panicking goroutine
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s panicked: %v", e.Operation, e.Value)
+}
+
+//Check if error is or wraps a PanicError
+func IsPanicError(err error) bool {
+	var panicErr *PanicError
+	return errors.As(err, &panicErr)
+}
+
+//Handler of the panics recovered by a tap
+type PanicHandler func(err *PanicError)
+
+//Optional extension of TapInterface for taps recovering the panics of their handlers, as Tap:
+//The panic handler is called with each recovered panic, including the panics of events handled
+//asynchronously (as by a queued tap) which are not returned to any caller.
+type PanicNotifier interface {
+	SetPanicHandler(handler PanicHandler)
+}
+
+//Private method for recovering a panic into the error returned by a handler call:
+//Should be deferred directly by the calling method.
+func (t *Tap) recoverPanic(operation string, err *error) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	panicErr := &PanicError{
+		Operation: operation,
+		Value:     value,
+		Stack:     debug.Stack(),
+	}
+	*err = panicErr
+
+	t.panicLock.RLock()
+	handler := t.panicHandler
+	t.panicLock.RUnlock()
+	if handler != nil {
+		handler(panicErr)
+	}
+}
@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/atomic"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type PanicTestSuite struct {
+	suite.Suite
+}
+
+func (suite *PanicTestSuite) SetupTest() {
+}
+
+func (suite *PanicTestSuite) TearDownTest() {
+}
+
+func (suite *PanicTestSuite) TestPanic__Tap() {
+	service := &panickingService{}
+	tap := NewServiceTap(service, service)
+	recovered := []*PanicError{}
+	tap.(PanicNotifier).SetPanicHandler(func(err *PanicError) {
+		recovered = append(recovered, err)
+	})
+
+	//Panics of all the handler calls are returned as errors
+	err := tap.PushEvent(prepareEvents(1)[0])
+	var panicErr *PanicError
+	require.True(suite.T(), errors.As(err, &panicErr), "unexpected error %v", err)
+	require.Equal(suite.T(), "push event", panicErr.Operation)
+	require.Equal(suite.T(), "event handler bug", panicErr.Value)
+	require.True(suite.T(), strings.Contains(string(panicErr.Stack), "PushEvent"), "missing stack trace")
+	_, err = tap.RunQuery(&pb.Query{})
+	require.True(suite.T(), IsPanicError(err), "unexpected error %v", err)
+	_, err = RunQueryWithContext(context.Background(), tap, &pb.Query{})
+	require.True(suite.T(), IsPanicError(err), "unexpected error %v", err)
+	_, err = collectStream(NewSink(tap), &pb.Query{})
+	require.True(suite.T(), IsPanicError(err), "unexpected error %v", err)
+	require.Equal(suite.T(), 4, len(recovered))
+
+	//Panics of calls made from another goroutine by a sink with a timeout are returned as well
+	sink := NewSinkWithContext(context.Background(), tap, time.Second)
+	err = PushEventWithContext(context.Background(), sink, prepareEvents(1)[0])
+	require.True(suite.T(), IsPanicError(err), "unexpected error %v", err)
+}
+
+func (suite *PanicTestSuite) TestPanic__QueuedTap() {
+	service := &panickingService{}
+	tap, err := NewQueuedProcessorTap(service, QueuedTapParams{QueueSize: 1})
+	require.NoError(suite.T(), err, "failed to create queued tap: %s", err)
+	recovered := atomic.NewInt32(0)
+	tap.SetPanicHandler(func(err *PanicError) {
+		recovered.Inc()
+	})
+
+	//Panics of queued events are notified, and the dispatching goes on
+	require.NoError(suite.T(), tap.PushEvent(prepareEvents(1)[0]), "failed to push event")
+	require.NoError(suite.T(), tap.PushEvent(prepareEvents(1)[0]), "failed to push event")
+	err = wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return recovered.Load() == 2, nil
+	})
+	require.NoError(suite.T(), err, "panics were not notified: %s", err)
+	require.NoError(suite.T(), tap.Close(), "failed to close tap")
+	require.Equal(suite.T(), uint64(2), tap.HandlerErrors())
+}
+
+func TestPanic__RUN(t *testing.T) {
+	crt := new(PanicTestSuite)
+	suite.Run(t, crt)
+}
+
+//Service panicking on every call
+type panickingService struct {
+	ServiceInterface
+}
+
+func (ps *panickingService) PushEvent(event *pb.Event) error {
+	panic("event handler bug")
+}
+
+func (ps *panickingService) RunQuery(query *pb.Query) (*pb.QueryResult, error) {
+	panic("query handler bug")
+}
@@ -0,0 +1,236 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+const (
+	defaultSegmentSize  = 16 << 20
+	defaultRetryBackoff = time.Second
+)
+
+//Parameters of a persistent sink
+type PersistentSinkParams struct {
+	//Directory of the write-ahead log, should not be shared with other sinks
+	Dir string
+	//Size beyond which a new log segment is started (default 16MiB)
+	SegmentSize int64
+	//Size limit of the undelivered events in the log, events are rejected with ErrLogFull
+	//beyond it, zero for no limit
+	MaxBytes int64
+	//Age beyond which undelivered events are dropped, zero for no limit
+	MaxAge time.Duration
+	//Delay between failed delivery attempts (default 1s)
+	RetryBackoff time.Duration
+	//Sync the log to disk on each event, trading throughput for surviving a host crash
+	SyncWrites bool
+}
+
+//Check persistent sink params validity and fill in defaults
+func (p *PersistentSinkParams) validate() error {
+	if p.Dir == "" {
+		return fmt.Errorf("persistent sink directory should be set")
+	}
+	if p.SegmentSize < 0 || p.MaxBytes < 0 || p.MaxAge < 0 || p.RetryBackoff < 0 {
+		return fmt.Errorf("persistent sink limits should not be negative")
+	}
+	if p.SegmentSize == 0 {
+		p.SegmentSize = defaultSegmentSize
+	}
+	if p.RetryBackoff == 0 {
+		p.RetryBackoff = defaultRetryBackoff
+	}
+	return nil
+}
+
+//This is an egress object delivering events at least once, across agent restarts:
+//Events are appended to a write-ahead log on disk and delivered to the wrapped sink
+//asynchronously, in order. A delivered event is acknowledged, while a failed delivery is
+//retried until it succeeds or the event gets older than the age limit. Events left
+//unacknowledged when the sink is closed are replayed by the next sink opening the same directory.
+//Queries are not persisted and are passed to the wrapped sink directly.
+type PersistentSink struct {
+	SinkInterface
+	params PersistentSinkParams
+	sink   SinkInterface
+	log    *writeAheadLog
+
+	//Cancelled on Close for stopping the delivery
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+
+	//Error the delivery is stuck on reading the log with, if any
+	readErrLock sync.Mutex
+	readErr     error
+}
+
+//Create persistent sink and start delivering the events left in its directory
+func NewPersistentSink(sink SinkInterface, params PersistentSinkParams) (*PersistentSink, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	log, err := openWriteAheadLog(params.Dir, params.SegmentSize, params.MaxBytes, params.SyncWrites)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log %s: %s", params.Dir, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &PersistentSink{
+		params: params,
+		sink:   sink,
+		log:    log,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go p.deliver()
+	return p, nil
+}
+
+func (p *PersistentSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return p.RunQueryContext(context.Background(), query)
+}
+
+func (p *PersistentSink) PushEvent(event *proto.Event) error {
+	return p.PushEventContext(context.Background(), event)
+}
+
+func (p *PersistentSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return RunQueryWithContext(ctx, p.sink, query)
+}
+
+//The event is acknowledged to the caller once it is appended to the log, not when delivered.
+func (p *PersistentSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	if p.ctx.Err() != nil {
+		return fmt.Errorf("persistent sink is closed")
+	}
+	data, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	return p.log.append(data)
+}
+
+//Get the number of events appended but not yet delivered or dropped
+func (p *PersistentSink) Pending() uint64 {
+	return p.log.pending()
+}
+
+//Get the number of delivered events
+func (p *PersistentSink) Delivered() uint64 {
+	return p.delivered.Load()
+}
+
+//Get the number of events dropped for exceeding the age limit or failing to decode
+func (p *PersistentSink) Dropped() uint64 {
+	return p.dropped.Load()
+}
+
+//Get the error the delivery is stuck on reading the log with, nil while delivering:
+//An unreadable record is not skipped, so no event is lost, and the delivery is resumed once
+//the record is read.
+func (p *PersistentSink) ReadError() error {
+	p.readErrLock.Lock()
+	defer p.readErrLock.Unlock()
+	return p.readErr
+}
+
+//Stop the delivery and close the log, keeping the undelivered events for replay:
+//Return the error the delivery was stuck on, if any.
+func (p *PersistentSink) Close() error {
+	var err error
+	p.once.Do(func() {
+		p.cancel()
+		<-p.done
+		err = p.log.close()
+		if readErr := p.ReadError(); readErr != nil && err == nil {
+			err = fmt.Errorf("delivery stuck on reading write-ahead log: %s", readErr)
+		}
+	})
+	return err
+}
+
+//Private method for delivering the log events in order until the sink is closed
+func (p *PersistentSink) deliver() {
+	defer close(p.done)
+	reader := p.log.newReader()
+	defer reader.close()
+	for {
+		record, err := reader.next()
+		p.setReadError(err)
+		if err != nil {
+			//Retry reading the record from scratch rather than losing it
+			reader.close()
+			if !p.backoff() {
+				return
+			}
+			continue
+		}
+		if record == nil {
+			select {
+			case <-p.log.appended:
+				continue
+			case <-p.ctx.Done():
+				return
+			}
+		}
+		if !p.deliverRecord(record) {
+			return
+		}
+		//A failed acknowledgement only causes the event to be delivered again after a restart
+		_ = p.log.acknowledge(record)
+	}
+}
+
+//Private method for delivering a single record until success or expiry, return false if the sink was closed
+func (p *PersistentSink) deliverRecord(record *walRecord) bool {
+	for {
+		if p.params.MaxAge > 0 && time.Since(time.Unix(0, record.timestamp)) > p.params.MaxAge {
+			p.dropped.Inc()
+			return true
+		}
+		//Unmarshal each attempt, as the wrapped sink may modify the event
+		event := &proto.Event{}
+		if err := event.Unmarshal(record.payload); err != nil {
+			p.dropped.Inc()
+			return true
+		}
+		if err := PushEventWithContext(p.ctx, p.sink, event); err == nil {
+			p.delivered.Inc()
+			return true
+		}
+		if !p.backoff() {
+			return false
+		}
+	}
+}
+
+//Private method for waiting between failed attempts, return false if the sink was closed meanwhile
+func (p *PersistentSink) backoff() bool {
+	timer := time.NewTimer(p.params.RetryBackoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+//Private method for recording the outcome of reading the log
+func (p *PersistentSink) setReadError(err error) {
+	p.readErrLock.Lock()
+	defer p.readErrLock.Unlock()
+	p.readErr = err
+}
@@ -0,0 +1,309 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/atomic"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type PersistentSinkTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *PersistentSinkTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "persistent_sink_")
+	require.NoError(suite.T(), err, "failed to create directory: %s", err)
+	suite.dir = dir
+}
+
+func (suite *PersistentSinkTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *PersistentSinkTestSuite) TestPersistentSink__Deliver() {
+	destination := &recordingSink{}
+	sink, err := NewPersistentSink(destination, PersistentSinkParams{
+		Dir:         suite.dir,
+		SegmentSize: 64,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	defer sink.Close()
+
+	events := prepareEvents(10)
+	for _, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	suite.waitDelivered(sink, 10)
+	require.Equal(suite.T(), uint64(0), sink.Pending())
+	for i, event := range destination.received() {
+		require.True(suite.T(), event.Equal(events[i]), "event %d delivered out of order", i)
+	}
+
+	//Delivered segments are removed, except the one still appended to
+	segments, err := filepath.Glob(filepath.Join(suite.dir, "*.wal"))
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), 1, len(segments))
+}
+
+func (suite *PersistentSinkTestSuite) TestPersistentSink__Replay() {
+	destination := &recordingSink{}
+	destination.failing.Store(true)
+	sink, err := NewPersistentSink(destination, PersistentSinkParams{
+		Dir:          suite.dir,
+		SegmentSize:  64,
+		RetryBackoff: time.Millisecond,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	events := prepareEvents(5)
+	for _, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	require.NoError(suite.T(), sink.Close(), "failed to close sink")
+	require.Error(suite.T(), sink.PushEvent(events[0]), "closed sink accepted event")
+
+	//Simulate a crash in the middle of appending a record
+	segments, err := filepath.Glob(filepath.Join(suite.dir, "*.wal"))
+	require.NoError(suite.T(), err)
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(suite.T(), err, "failed to open segment: %s", err)
+	_, err = file.Write([]byte{0, 0, 0, 100, 1, 2})
+	require.NoError(suite.T(), err, "failed to write segment: %s", err)
+	require.NoError(suite.T(), file.Close())
+
+	//Undelivered events are replayed, followed by new ones
+	destination = &recordingSink{}
+	sink, err = NewPersistentSink(destination, PersistentSinkParams{
+		Dir: suite.dir,
+	})
+	require.NoError(suite.T(), err, "failed to reopen sink: %s", err)
+	defer sink.Close()
+	more := prepareEvents(2)
+	for _, event := range more {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	suite.waitDelivered(sink, 7)
+	for i, event := range destination.received() {
+		require.True(suite.T(), event.Equal(append(events, more...)[i]), "event %d delivered out of order", i)
+	}
+}
+
+func (suite *PersistentSinkTestSuite) TestPersistentSink__Limits() {
+	destination := &recordingSink{}
+	destination.failing.Store(true)
+	sink, err := NewPersistentSink(destination, PersistentSinkParams{
+		Dir:          suite.dir,
+		MaxBytes:     100,
+		MaxAge:       20 * time.Millisecond,
+		RetryBackoff: time.Millisecond,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	defer sink.Close()
+
+	//Events beyond the size limit are rejected
+	accepted := 0
+	for ; accepted < 10; accepted++ {
+		if err = sink.PushEvent(prepareEvents(1)[0]); err != nil {
+			break
+		}
+	}
+	require.Equal(suite.T(), ErrLogFull, err)
+
+	//Events beyond the age limit are dropped
+	err = wait.Poll(time.Millisecond, time.Second, func() (bool, error) { return sink.Pending() == 0, nil })
+	require.NoError(suite.T(), err, "expired events were not dropped")
+	require.Equal(suite.T(), uint64(accepted), sink.Dropped())
+	require.Equal(suite.T(), uint64(0), sink.Delivered())
+
+	_, err = NewPersistentSink(destination, PersistentSinkParams{})
+	require.Error(suite.T(), err, "created sink without directory")
+}
+
+func (suite *PersistentSinkTestSuite) TestPersistentSink__DeliveredBeyondLimit() {
+	destination := &recordingSink{}
+	sink, err := NewPersistentSink(destination, PersistentSinkParams{
+		Dir:      suite.dir,
+		MaxBytes: 256,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	defer sink.Close()
+
+	//Only the undelivered events count against the size limit, within a single segment
+	events := prepareEvents(50)
+	for i, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event %d", i)
+		suite.waitDelivered(sink, uint64(i+1))
+	}
+	require.Equal(suite.T(), uint64(0), sink.Pending())
+	require.Equal(suite.T(), len(events), len(destination.received()))
+
+	//The acknowledged records are not counted after a restart either
+	require.NoError(suite.T(), sink.Close(), "failed to close sink")
+	sink, err = NewPersistentSink(destination, PersistentSinkParams{
+		Dir:      suite.dir,
+		MaxBytes: 256,
+	})
+	require.NoError(suite.T(), err, "failed to reopen sink: %s", err)
+	require.NoError(suite.T(), sink.PushEvent(events[0]), "failed to push event")
+	suite.waitDelivered(sink, 1)
+}
+
+func (suite *PersistentSinkTestSuite) TestPersistentSink__UnreadableRecord() {
+	destination := &recordingSink{}
+	destination.failing.Store(true)
+	sink, err := NewPersistentSink(destination, PersistentSinkParams{
+		Dir:          suite.dir,
+		RetryBackoff: time.Millisecond,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	defer sink.Close()
+
+	events := prepareEvents(3)
+	for _, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+
+	//Corrupt the second record while the first one is being retried
+	segments, err := filepath.Glob(filepath.Join(suite.dir, "*.wal"))
+	require.NoError(suite.T(), err)
+	content, err := ioutil.ReadFile(segments[0])
+	require.NoError(suite.T(), err, "failed to read segment: %s", err)
+	offset := walHeaderSize + events[0].Size() + walHeaderSize
+	corrupted := append([]byte{}, content...)
+	corrupted[offset] ^= 0xff
+	require.NoError(suite.T(), ioutil.WriteFile(segments[0], corrupted, 0600))
+
+	//The delivery is stuck on the unreadable record rather than skipping it
+	destination.failing.Store(false)
+	suite.waitDelivered(sink, 1)
+	err = wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) { return sink.ReadError() != nil, nil })
+	require.NoError(suite.T(), err, "read error was not reported")
+	require.Equal(suite.T(), uint64(2), sink.Pending())
+	require.Equal(suite.T(), uint64(0), sink.Dropped())
+
+	//The delivery resumes once the record is readable
+	require.NoError(suite.T(), ioutil.WriteFile(segments[0], content, 0600))
+	suite.waitDelivered(sink, 3)
+	require.NoError(suite.T(), sink.ReadError())
+	for i, event := range destination.received() {
+		require.True(suite.T(), event.Equal(events[i]), "event %d delivered out of order", i)
+	}
+}
+
+func (suite *PersistentSinkTestSuite) TestPersistentSink__CorruptedSegment() {
+	destination := &recordingSink{}
+	destination.failing.Store(true)
+	sink, err := NewPersistentSink(destination, PersistentSinkParams{
+		Dir:          suite.dir,
+		RetryBackoff: time.Millisecond,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	events := prepareEvents(3)
+	for _, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	require.NoError(suite.T(), sink.Close(), "failed to close sink")
+
+	//A corrupted record in the middle of a segment fails the reopening, keeping the records after it
+	segments, err := filepath.Glob(filepath.Join(suite.dir, "*.wal"))
+	require.NoError(suite.T(), err)
+	content, err := ioutil.ReadFile(segments[0])
+	require.NoError(suite.T(), err, "failed to read segment: %s", err)
+	corrupted := append([]byte{}, content...)
+	corrupted[walHeaderSize+events[0].Size()+walHeaderSize] ^= 0xff
+	require.NoError(suite.T(), ioutil.WriteFile(segments[0], corrupted, 0600))
+	_, err = NewPersistentSink(destination, PersistentSinkParams{
+		Dir: suite.dir,
+	})
+	require.Error(suite.T(), err, "reopened corrupted log")
+	kept, err := ioutil.ReadFile(segments[0])
+	require.NoError(suite.T(), err, "failed to read segment: %s", err)
+	require.Equal(suite.T(), corrupted, kept, "corrupted segment was truncated")
+
+	//The log is reopened once the record is readable again
+	require.NoError(suite.T(), ioutil.WriteFile(segments[0], content, 0600))
+	destination.failing.Store(false)
+	sink, err = NewPersistentSink(destination, PersistentSinkParams{
+		Dir: suite.dir,
+	})
+	require.NoError(suite.T(), err, "failed to reopen sink: %s", err)
+	defer sink.Close()
+	suite.waitDelivered(sink, 3)
+}
+
+func (suite *PersistentSinkTestSuite) TestPersistentSink__Query() {
+	sink, err := NewPersistentSink(&recordingSink{}, PersistentSinkParams{
+		Dir: suite.dir,
+	})
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+	defer sink.Close()
+
+	queries, _ := prepareQueries(1)
+	result, err := sink.RunQuery(queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.Equal(suite.T(), queries[0].UUID, result.UUID)
+}
+
+//Helper method for waiting until a number of events is delivered
+func (suite *PersistentSinkTestSuite) waitDelivered(sink *PersistentSink, num uint64) {
+	err := wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) { return sink.Delivered() == num, nil })
+	require.NoError(suite.T(), err, "delivered %d events out of %d", sink.Delivered(), num)
+}
+
+func TestPersistentSink__RUN(t *testing.T) {
+	crt := new(PersistentSinkTestSuite)
+	suite.Run(t, crt)
+}
+
+//Sink stub recording its events, safe for concurrent use
+type recordingSink struct {
+	SinkInterface
+	lock    sync.Mutex
+	events  []*pb.Event
+	failing atomic.Bool
+	//Pushes wait for the channel to be closed or for their context, if set
+	block   chan struct{}
+	blocked atomic.Int32
+}
+
+func (r *recordingSink) PushEventContext(ctx context.Context, event *pb.Event) error {
+	if r.failing.Load() {
+		return fmt.Errorf("destination is down")
+	}
+	if r.block != nil {
+		r.blocked.Inc()
+		select {
+		case <-r.block:
+		case <-ctx.Done():
+			return contextError(ctx.Err(), "push event", 0)
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *recordingSink) RunQueryContext(ctx context.Context, query *pb.Query) (*pb.QueryResult, error) {
+	return &pb.QueryResult{Type: query.Type, UUID: query.UUID}, nil
+}
+
+//Get the recorded events
+func (r *recordingSink) received() []*pb.Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*pb.Event{}, r.events...)
+}
@@ -50,3 +50,10 @@ type ProcessorInterface interface {
 	//Update configuration
 	UpdateConfiguration(conf *proto.Configuration) error
 }
+
+//Optional extension of ProcessorInterface for processors whose run loop may return by itself,
+//as those embedding BaseProcessor
+type ExitReporter interface {
+	//Check if the run loop of the running processor returned, along with the error it returned
+	Exited() (bool, error)
+}
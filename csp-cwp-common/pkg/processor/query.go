@@ -0,0 +1,19 @@
+package processor
+
+import (
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Canonical key of a query:
+//The serialized query excluding its UUID and trace context, so identical questions
+//asked by different callers get the same key.
+func QueryKey(query *proto.Query) (string, error) {
+	canonical := *query
+	canonical.UUID = ""
+	canonical.TraceContext = nil
+	data, err := canonical.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
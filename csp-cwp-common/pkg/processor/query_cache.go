@@ -0,0 +1,283 @@
+package processor
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Metrics of a query cache
+type QueryCacheMetrics struct {
+	//Queries answered from the cache, including the ones waiting for a running identical query
+	Hits metrics.Counter
+	//Queries passed on
+	Misses metrics.Counter
+	//Results evicted to keep the cache size
+	Evictions metrics.Counter
+}
+
+//Get query cache metrics from the registry, registering them under the name prefix if missing:
+//Metrics are registered as <name>.cacheHits, <name>.cacheMisses and <name>.cacheEvictions.
+func GetOrRegisterQueryCacheMetrics(registry metrics.Registry, name string) *QueryCacheMetrics {
+	return &QueryCacheMetrics{
+		Hits:      metrics.GetOrRegisterCounter(name+".cacheHits", registry),
+		Misses:    metrics.GetOrRegisterCounter(name+".cacheMisses", registry),
+		Evictions: metrics.GetOrRegisterCounter(name+".cacheEvictions", registry),
+	}
+}
+
+//Parameters of a query cache
+type QueryCacheParams struct {
+	//Duration a result is kept for
+	TTL time.Duration
+	//Number of results kept, the least recently used are evicted beyond it, zero for no limit
+	MaxEntries int
+	//Duration a failure is kept for, zero for not caching failures
+	ErrorTTL time.Duration
+	//Metrics of the cache, nil for unregistered metrics
+	Metrics *QueryCacheMetrics
+}
+
+//Cached result of a query
+type cacheEntry struct {
+	key     string
+	result  *proto.QueryResult
+	err     error
+	expires time.Time
+}
+
+//Running query, shared by the identical queries arriving meanwhile
+type cacheCall struct {
+	done   chan struct{}
+	result *proto.QueryResult
+	err    error
+}
+
+//Cache of query results keyed by QueryKey, so identical queries of different callers share
+//their result: Results are kept for the TTL, up to a maximal number of results with least recently
+//used eviction. Identical queries arriving while a query is running wait for its result instead
+//of running as well. Cached results are returned with the UUID of the query they answer.
+type QueryCache struct {
+	params QueryCacheParams
+
+	lock sync.Mutex
+	//Mapping from a query key to its entry in the recently used list, most recent first
+	entries map[string]*list.Element
+	recent  *list.List
+	//Mapping from a query key to its running call
+	calls map[string]*cacheCall
+}
+
+//Create query cache
+func NewQueryCache(params QueryCacheParams) (*QueryCache, error) {
+	if params.TTL <= 0 {
+		return nil, fmt.Errorf("query cache TTL should be positive")
+	}
+	if params.MaxEntries < 0 || params.ErrorTTL < 0 {
+		return nil, fmt.Errorf("query cache limits should not be negative")
+	}
+	if params.Metrics == nil {
+		params.Metrics = &QueryCacheMetrics{
+			Hits:      metrics.NewCounter(),
+			Misses:    metrics.NewCounter(),
+			Evictions: metrics.NewCounter(),
+		}
+	}
+	return &QueryCache{
+		params:  params,
+		entries: make(map[string]*list.Element),
+		recent:  list.New(),
+		calls:   make(map[string]*cacheCall),
+	}, nil
+}
+
+//Get the cache metrics
+func (c *QueryCache) Metrics() *QueryCacheMetrics {
+	return c.params.Metrics
+}
+
+//Get the number of cached results
+func (c *QueryCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.recent.Len()
+}
+
+//Answer query from the cache, or by running it through the given handler on a miss:
+//The returned result is a shallow copy of the cached one and should not be modified.
+func (c *QueryCache) RunQuery(ctx context.Context, query *proto.Query, handler QueryHandler) (*proto.QueryResult, error) {
+	key, err := QueryKey(query)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		c.lock.Lock()
+		if element, exists := c.entries[key]; exists {
+			entry := element.Value.(*cacheEntry)
+			if time.Now().Before(entry.expires) {
+				c.recent.MoveToFront(element)
+				c.lock.Unlock()
+				c.params.Metrics.Hits.Inc(1)
+				return answer(query, entry.result, entry.err)
+			}
+			c.remove(element)
+		}
+
+		//Wait for an identical running query
+		if call, exists := c.calls[key]; exists {
+			c.lock.Unlock()
+			c.params.Metrics.Hits.Inc(1)
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, contextError(ctx.Err(), "run query", 0)
+			}
+			//Run again if the query was abandoned by its own caller
+			if isContextError(call.err) && ctx.Err() == nil {
+				continue
+			}
+			return answer(query, call.result, call.err)
+		}
+
+		call := &cacheCall{
+			done: make(chan struct{}),
+		}
+		c.calls[key] = call
+		c.lock.Unlock()
+		c.params.Metrics.Misses.Inc(1)
+
+		call.result, call.err = handler(ctx, query)
+		c.lock.Lock()
+		delete(c.calls, key)
+		c.store(key, call.result, call.err)
+		c.lock.Unlock()
+		close(call.done)
+		return answer(query, call.result, call.err)
+	}
+}
+
+//Private method for caching the result of a query, called under the lock
+func (c *QueryCache) store(key string, result *proto.QueryResult, err error) {
+	ttl := c.params.TTL
+	if err != nil {
+		if c.params.ErrorTTL == 0 || isContextError(err) {
+			return
+		}
+		ttl = c.params.ErrorTTL
+	}
+	c.entries[key] = c.recent.PushFront(&cacheEntry{
+		key:     key,
+		result:  result,
+		err:     err,
+		expires: time.Now().Add(ttl),
+	})
+	for c.params.MaxEntries > 0 && c.recent.Len() > c.params.MaxEntries {
+		c.remove(c.recent.Back())
+		c.params.Metrics.Evictions.Inc(1)
+	}
+}
+
+//Private method for removing a cached result, called under the lock
+func (c *QueryCache) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+//Copy a shared result for answering a specific query
+func answer(query *proto.Query, result *proto.QueryResult, err error) (*proto.QueryResult, error) {
+	if err != nil {
+		return nil, err
+	}
+	answer := *result
+	answer.UUID = query.UUID
+	return &answer, nil
+}
+
+//Check whether an error was caused by the call context rather than the query, as the
+//cancellation and timeout errors returned by the sinks
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || IsTimeoutError(err)
+}
+
+//This is a queries egress object answering the queries from a cache before passing them to the wrapped sink.
+//Events pass through unaffected.
+type CachingSink struct {
+	SinkInterface
+	cache *QueryCache
+	sink  SinkInterface
+}
+
+//Create sink answering the queries from the cache
+func NewCachingSink(cache *QueryCache, sink SinkInterface) SinkInterface {
+	return &CachingSink{
+		cache: cache,
+		sink:  sink,
+	}
+}
+
+func (c *CachingSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return c.RunQueryContext(context.Background(), query)
+}
+
+func (c *CachingSink) PushEvent(event *proto.Event) error {
+	return c.PushEventContext(context.Background(), event)
+}
+
+func (c *CachingSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return c.cache.RunQuery(ctx, query, runQueryHandler(c.sink))
+}
+
+func (c *CachingSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	return PushEventWithContext(ctx, c.sink, event)
+}
+
+//This is a service wrapper answering the queries from a cache before passing them to the wrapped service:
+//Queries arriving through its tap are answered from the cache as well.
+type CachingService struct {
+	ServiceInterface
+	cache *QueryCache
+	tap   TapInterface
+}
+
+//Create service answering the queries from the cache
+func NewCachingService(cache *QueryCache, service ServiceInterface) ServiceInterface {
+	return &CachingService{
+		ServiceInterface: service,
+		cache:            cache,
+		tap: &cachingTap{
+			TapInterface: service.GetTap(),
+			cache:        cache,
+		},
+	}
+}
+
+func (c *CachingService) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return c.cache.RunQuery(context.Background(), query, func(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+		return c.ServiceInterface.RunQuery(query)
+	})
+}
+
+func (c *CachingService) GetTap() TapInterface {
+	return c.tap
+}
+
+//Ingress tap answering the queries from a cache before passing them to the wrapped tap
+type cachingTap struct {
+	TapInterface
+	cache *QueryCache
+}
+
+func (c *cachingTap) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return c.RunQueryContext(context.Background(), query)
+}
+
+func (c *cachingTap) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return c.cache.RunQuery(ctx, query, runQueryHandler(c.TapInterface))
+}
@@ -0,0 +1,221 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/atomic"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type QueryCacheTestSuite struct {
+	suite.Suite
+}
+
+func (suite *QueryCacheTestSuite) SetupTest() {
+}
+
+func (suite *QueryCacheTestSuite) TearDownTest() {
+}
+
+func (suite *QueryCacheTestSuite) TestQueryCache__HitAndExpiry() {
+	registry := metrics.NewRegistry()
+	cache, err := NewQueryCache(QueryCacheParams{
+		TTL:     20 * time.Millisecond,
+		Metrics: GetOrRegisterQueryCacheMetrics(registry, "relation"),
+	})
+	require.NoError(suite.T(), err, "failed to create cache: %s", err)
+	replica := &replicaSink{}
+	sink := NewCachingSink(cache, replica)
+
+	//Same query of another caller is answered from the cache with its own UUID
+	queries, _ := prepareQueries(1)
+	for _, uuid := range []string{"first", "second"} {
+		query := *queries[0]
+		query.UUID = uuid
+		result, err := sink.RunQuery(&query)
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+		require.Equal(suite.T(), uuid, result.UUID)
+	}
+	require.Equal(suite.T(), int64(1), replica.queries.Load())
+	require.Equal(suite.T(), int64(1), registry.Get("relation.cacheHits").(metrics.Counter).Count())
+	require.Equal(suite.T(), int64(1), registry.Get("relation.cacheMisses").(metrics.Counter).Count())
+
+	//Expired result is run again
+	time.Sleep(30 * time.Millisecond)
+	_, err = sink.RunQuery(queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.Equal(suite.T(), int64(2), replica.queries.Load())
+
+	//Events pass through
+	recording := &recordingSink{}
+	require.NoError(suite.T(), NewCachingSink(cache, recording).PushEvent(prepareEvents(1)[0]), "failed to push event")
+	require.Equal(suite.T(), 1, len(recording.received()))
+}
+
+func (suite *QueryCacheTestSuite) TestQueryCache__Eviction() {
+	cache, err := NewQueryCache(QueryCacheParams{
+		TTL:        time.Hour,
+		MaxEntries: 2,
+	})
+	require.NoError(suite.T(), err, "failed to create cache: %s", err)
+	replica := &replicaSink{}
+	sink := NewCachingSink(cache, replica)
+
+	//Least recently used result is evicted
+	queries, _ := prepareQueries(3)
+	for _, query := range []*pb.Query{queries[0], queries[1], queries[0], queries[2]} {
+		_, err := sink.RunQuery(query)
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+	}
+	require.Equal(suite.T(), 2, cache.Len())
+	require.Equal(suite.T(), int64(1), cache.Metrics().Evictions.Count())
+	_, _ = sink.RunQuery(queries[0])
+	require.Equal(suite.T(), int64(3), replica.queries.Load())
+	_, _ = sink.RunQuery(queries[1])
+	require.Equal(suite.T(), int64(4), replica.queries.Load())
+}
+
+func (suite *QueryCacheTestSuite) TestQueryCache__Errors() {
+	queries, _ := prepareQueries(1)
+	for _, errorTTL := range []time.Duration{0, time.Hour} {
+		cache, err := NewQueryCache(QueryCacheParams{
+			TTL:      time.Hour,
+			ErrorTTL: errorTTL,
+		})
+		require.NoError(suite.T(), err, "failed to create cache: %s", err)
+		flaky := &flakySink{failures: 10}
+		sink := NewCachingSink(cache, flaky)
+		for i := 0; i < 2; i++ {
+			_, err := sink.RunQuery(queries[0])
+			require.Error(suite.T(), err, "failure was not reported")
+		}
+		if errorTTL == 0 {
+			require.Equal(suite.T(), 2, flaky.calls)
+		} else {
+			require.Equal(suite.T(), 1, flaky.calls)
+		}
+	}
+
+	_, err := NewQueryCache(QueryCacheParams{})
+	require.Error(suite.T(), err, "created cache without TTL")
+}
+
+func (suite *QueryCacheTestSuite) TestQueryCache__Stampede() {
+	cache, err := NewQueryCache(QueryCacheParams{
+		TTL: time.Hour,
+	})
+	require.NoError(suite.T(), err, "failed to create cache: %s", err)
+	replica := &replicaSink{block: make(chan struct{})}
+	sink := NewCachingSink(cache, replica)
+
+	//Identical queries wait for the running one
+	queries, _ := prepareQueries(1)
+	results := make([]*pb.QueryResult, 5)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			query := *queries[0]
+			query.UUID = string(rune('a' + i))
+			results[i], _ = sink.RunQuery(&query)
+		}(i)
+	}
+	err = wait.Poll(time.Millisecond, time.Second, func() (bool, error) { return cache.Metrics().Hits.Count() == 4, nil })
+	require.NoError(suite.T(), err, "queries did not wait for the running one")
+	close(replica.block)
+	wg.Wait()
+	require.Equal(suite.T(), int64(1), replica.queries.Load())
+	for i, result := range results {
+		require.Equal(suite.T(), string(rune('a'+i)), result.UUID)
+	}
+}
+
+func (suite *QueryCacheTestSuite) TestQueryCache__AbandonedLeader() {
+	cache, err := NewQueryCache(QueryCacheParams{
+		TTL:      time.Hour,
+		ErrorTTL: time.Hour,
+	})
+	require.NoError(suite.T(), err, "failed to create cache: %s", err)
+	queries, expected := prepareQueries(1)
+	var calls atomic.Int32
+	handler := func(ctx context.Context, query *pb.Query) (*pb.QueryResult, error) {
+		if calls.Inc() == 1 {
+			<-ctx.Done()
+			return nil, contextError(ctx.Err(), "run query", 0)
+		}
+		return expected[0], nil
+	}
+
+	//The running query blocks until its caller cancels it
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := cache.RunQuery(ctx, queries[0], handler)
+		leaderErr <- err
+	}()
+	err = wait.Poll(time.Millisecond, time.Second, func() (bool, error) { return calls.Load() == 1, nil })
+	require.NoError(suite.T(), err, "query did not run")
+
+	//A waiter abandoned by its own caller gets its own timeout
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer timeoutCancel()
+	_, err = cache.RunQuery(timeoutCtx, queries[0], handler)
+	require.True(suite.T(), IsTimeoutError(err), "unexpected waiter error: %v", err)
+
+	//A waiter runs the query again once the running one is abandoned by its caller
+	waiterResult := make(chan *pb.QueryResult, 1)
+	go func() {
+		result, _ := cache.RunQuery(context.Background(), queries[0], handler)
+		waiterResult <- result
+	}()
+	err = wait.Poll(time.Millisecond, time.Second, func() (bool, error) { return cache.Metrics().Hits.Count() == 2, nil })
+	require.NoError(suite.T(), err, "query did not wait for the running one")
+	cancel()
+	err = <-leaderErr
+	require.True(suite.T(), errors.Is(err, context.Canceled), "unexpected leader error: %v", err)
+	result := <-waiterResult
+	require.NotNil(suite.T(), result, "waiter got no result")
+	require.True(suite.T(), result.Equal(expected[0]), "unexpected result %v", result)
+	require.Equal(suite.T(), int32(2), calls.Load())
+
+	//The cancellation is not cached, the result is
+	result, err = cache.RunQuery(context.Background(), queries[0], handler)
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.True(suite.T(), result.Equal(expected[0]), "unexpected result %v", result)
+	require.Equal(suite.T(), int32(2), calls.Load())
+}
+
+func (suite *QueryCacheTestSuite) TestQueryCache__Service() {
+	cache, err := NewQueryCache(QueryCacheParams{
+		TTL: time.Hour,
+	})
+	require.NoError(suite.T(), err, "failed to create cache: %s", err)
+	service := NewCachingService(cache, NewTestService(&TestServiceParams{
+		LivenessInterval: time.Second,
+	}))
+
+	//Queries through the service and its tap share the cache
+	queries, expected := prepareQueries(1)
+	result, err := service.GetTap().RunQuery(queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.True(suite.T(), result.Equal(expected[0]), "unexpected result %v", result)
+	result, err = service.RunQuery(queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.True(suite.T(), result.Equal(expected[0]), "unexpected result %v", result)
+	require.Equal(suite.T(), int64(1), cache.Metrics().Hits.Count())
+}
+
+func TestQueryCache__RUN(t *testing.T) {
+	crt := new(QueryCacheTestSuite)
+	suite.Run(t, crt)
+}
@@ -0,0 +1,244 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Policy applied by a queued tap when an event arrives while its queue is full
+type OverflowPolicy int
+
+const (
+	//Block the producer until there is room in the queue
+	OverflowBlock OverflowPolicy = iota
+	//Block the producer up to the configured timeout, then drop the new event
+	OverflowBlockWithTimeout
+	//Drop the new event and keep the queued ones
+	OverflowDropNewest
+	//Drop the oldest queued event to make room for the new one
+	OverflowDropOldest
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowBlockWithTimeout:
+		return "blockWithTimeout"
+	case OverflowDropNewest:
+		return "dropNewest"
+	case OverflowDropOldest:
+		return "dropOldest"
+	}
+	return "unknown"
+}
+
+var (
+	//Returned to the producer when its event was dropped by a full queue
+	ErrEventDropped = errors.New("event dropped by full tap queue")
+	//Returned to the producer when pushing into a closed queued tap
+	ErrTapClosed = errors.New("tap is closed")
+)
+
+type QueuedTapParams struct {
+	//Maximal number of events waiting to be handled
+	QueueSize int
+	//What to do with a new event when the queue is full
+	Policy OverflowPolicy
+	//Maximal producer blocking time, used by OverflowBlockWithTimeout policy only
+	BlockTimeout time.Duration
+}
+
+//This is an ingress tap which decouples the producers from the event handler:
+//Events are queued into a bounded buffer and handled by a single dispatching goroutine,
+//so a slow handler only affects producers according to the selected overflow policy.
+//Queries are not queued and are passed synchronously to the query handler.
+type QueuedTap struct {
+	*Tap
+	params QueuedTapParams
+
+	//Bounded events buffer
+	queue chan *proto.Event
+
+	//Counters of dropped events and of events the handler failed on
+	dropped       atomic.Uint64
+	handlerErrors atomic.Uint64
+
+	//For rejecting the producers and signaling the dispatching goroutine to stop from Close call:
+	//Producers hold closeLock for reading across the enqueueing, so Close can wait for the
+	//in-flight ones before letting the dispatching goroutine drain the queue.
+	closeLock sync.RWMutex
+	stop      chan struct{}
+	drain     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+//Create a queued tap for a processor and start its dispatching goroutine.
+//Close should be called in order to stop the dispatching.
+func NewQueuedProcessorTap(eventHandler ProcessorInterface, params QueuedTapParams) (*QueuedTap, error) {
+	if params.QueueSize <= 0 {
+		return nil, fmt.Errorf("invalid queue size %d", params.QueueSize)
+	}
+	if params.Policy == OverflowBlockWithTimeout && params.BlockTimeout <= 0 {
+		return nil, fmt.Errorf("block timeout must be positive for %s policy", params.Policy)
+	}
+	q := &QueuedTap{
+		Tap: &Tap{
+			eventHandler: eventHandler,
+		},
+		params: params,
+		queue:  make(chan *proto.Event, params.QueueSize),
+		stop:   make(chan struct{}),
+		drain:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go q.dispatch()
+	return q, nil
+}
+
+//Create a queued tap for a service and start its dispatching goroutine.
+//Close should be called in order to stop the dispatching.
+func NewQueuedServiceTap(eventHandler ProcessorInterface, queryHandler ServiceInterface, params QueuedTapParams) (*QueuedTap, error) {
+	q, err := NewQueuedProcessorTap(eventHandler, params)
+	if err != nil {
+		return nil, err
+	}
+	q.SetQueryHandler(queryHandler)
+	return q, nil
+}
+
+//Queue the event for handling according to the overflow policy
+func (q *QueuedTap) PushEvent(event *proto.Event) error {
+	return q.PushEventContext(context.Background(), event)
+}
+
+//Queue the event for handling according to the overflow policy:
+//A blocked producer is released once the context is done.
+//NOTE: the context only applies to the queueing, the event is handled later without it.
+func (q *QueuedTap) PushEventContext(ctx context.Context, event *proto.Event) error {
+	q.closeLock.RLock()
+	defer q.closeLock.RUnlock()
+
+	select {
+	case <-q.stop:
+		return ErrTapClosed
+	default:
+	}
+
+	switch q.params.Policy {
+	case OverflowBlockWithTimeout:
+		timer := time.NewTimer(q.params.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case q.queue <- event:
+			return nil
+		case <-timer.C:
+			q.dropped.Inc()
+			return ErrEventDropped
+		case <-q.stop:
+			return ErrTapClosed
+		case <-ctx.Done():
+			return contextError(ctx.Err(), "push event", 0)
+		}
+	case OverflowDropNewest:
+		select {
+		case q.queue <- event:
+			return nil
+		default:
+			q.dropped.Inc()
+			return ErrEventDropped
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.queue <- event:
+				return nil
+			default:
+			}
+			//Queue is full, make room by dropping the oldest event
+			select {
+			case <-q.queue:
+				q.dropped.Inc()
+			default:
+			}
+		}
+	default:
+		select {
+		case q.queue <- event:
+			return nil
+		case <-q.stop:
+			return ErrTapClosed
+		case <-ctx.Done():
+			return contextError(ctx.Err(), "push event", 0)
+		}
+	}
+}
+
+//Stop accepting events, handle the already queued ones and stop the dispatching goroutine.
+//Safe to be called more than once.
+func (q *QueuedTap) Close() error {
+	q.closeOnce.Do(func() {
+		//Release the blocked producers, then wait for the in-flight ones before draining
+		close(q.stop)
+		q.closeLock.Lock()
+		close(q.drain)
+		q.closeLock.Unlock()
+	})
+	<-q.done
+	return nil
+}
+
+//Number of events currently waiting in the queue
+func (q *QueuedTap) QueueDepth() int {
+	return len(q.queue)
+}
+
+//Maximal number of events the queue can hold
+func (q *QueuedTap) QueueCapacity() int {
+	return cap(q.queue)
+}
+
+//Number of events dropped due to a full queue
+func (q *QueuedTap) Dropped() uint64 {
+	return q.dropped.Load()
+}
+
+//Number of queued events the event handler returned an error for
+func (q *QueuedTap) HandlerErrors() uint64 {
+	return q.handlerErrors.Load()
+}
+
+//Private dispatching loop, passes the queued events to the event handler one by one
+func (q *QueuedTap) dispatch() {
+	defer close(q.done)
+	for {
+		select {
+		case event := <-q.queue:
+			q.handle(event)
+		case <-q.drain:
+			//Drain the events which were already accepted
+			for {
+				select {
+				case event := <-q.queue:
+					q.handle(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *QueuedTap) handle(event *proto.Event) {
+	if err := q.Tap.PushEvent(event); err != nil {
+		q.handlerErrors.Inc()
+	}
+}
@@ -0,0 +1,238 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/atomic"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type QueuedTapTestSuite struct {
+	suite.Suite
+}
+
+func (suite *QueuedTapTestSuite) SetupTest() {
+}
+
+func (suite *QueuedTapTestSuite) TearDownTest() {
+}
+
+func (suite *QueuedTapTestSuite) TestQueuedTap__InvalidParams() {
+	handler := newGatedProcessor()
+	_, err := NewQueuedProcessorTap(handler, QueuedTapParams{})
+	require.Error(suite.T(), err, "created queued tap with zero queue size")
+
+	_, err = NewQueuedProcessorTap(handler, QueuedTapParams{
+		QueueSize: 1,
+		Policy:    OverflowBlockWithTimeout,
+	})
+	require.Error(suite.T(), err, "created queued tap with blocking policy and no timeout")
+}
+
+func (suite *QueuedTapTestSuite) TestQueuedTap__DropNewest() {
+	handler := newGatedProcessor()
+	tap, err := NewQueuedProcessorTap(handler, QueuedTapParams{
+		QueueSize: 2,
+		Policy:    OverflowDropNewest,
+	})
+	require.NoError(suite.T(), err, "failed to create queued tap: %s", err)
+
+	events := prepareEvents(5)
+	//First event is taken by the blocked handler, next two fill the queue
+	require.NoError(suite.T(), tap.PushEvent(events[0]), "failed to push event")
+	handler.waitForPending(suite.T())
+	for _, event := range events[1:3] {
+		require.NoError(suite.T(), tap.PushEvent(event), "failed to push event")
+	}
+	require.Equal(suite.T(), 2, tap.QueueDepth())
+
+	//Rest of the events should be dropped
+	for _, event := range events[3:] {
+		require.Equal(suite.T(), ErrEventDropped, tap.PushEvent(event))
+	}
+	require.Equal(suite.T(), uint64(2), tap.Dropped())
+
+	//Release the handler and close the tap, queued events should be handled
+	close(handler.gate)
+	require.NoError(suite.T(), tap.Close(), "failed to close tap")
+	require.Equal(suite.T(), events[:3], handler.handled())
+	require.Equal(suite.T(), ErrTapClosed, tap.PushEvent(events[0]))
+}
+
+func (suite *QueuedTapTestSuite) TestQueuedTap__DropOldest() {
+	handler := newGatedProcessor()
+	tap, err := NewQueuedProcessorTap(handler, QueuedTapParams{
+		QueueSize: 2,
+		Policy:    OverflowDropOldest,
+	})
+	require.NoError(suite.T(), err, "failed to create queued tap: %s", err)
+
+	events := prepareEvents(5)
+	require.NoError(suite.T(), tap.PushEvent(events[0]), "failed to push event")
+	handler.waitForPending(suite.T())
+	for _, event := range events[1:] {
+		require.NoError(suite.T(), tap.PushEvent(event), "failed to push event")
+	}
+	require.Equal(suite.T(), uint64(2), tap.Dropped())
+
+	//Only the first and the two newest events should be handled
+	close(handler.gate)
+	require.NoError(suite.T(), tap.Close(), "failed to close tap")
+	require.Equal(suite.T(), []*pb.Event{events[0], events[3], events[4]}, handler.handled())
+}
+
+func (suite *QueuedTapTestSuite) TestQueuedTap__BlockWithTimeout() {
+	handler := newGatedProcessor()
+	tap, err := NewQueuedProcessorTap(handler, QueuedTapParams{
+		QueueSize:    1,
+		Policy:       OverflowBlockWithTimeout,
+		BlockTimeout: 50 * time.Millisecond,
+	})
+	require.NoError(suite.T(), err, "failed to create queued tap: %s", err)
+
+	events := prepareEvents(3)
+	require.NoError(suite.T(), tap.PushEvent(events[0]), "failed to push event")
+	handler.waitForPending(suite.T())
+	require.NoError(suite.T(), tap.PushEvent(events[1]), "failed to push event")
+
+	start := time.Now()
+	require.Equal(suite.T(), ErrEventDropped, tap.PushEvent(events[2]))
+	require.True(suite.T(), time.Since(start) >= 50*time.Millisecond, "producer was not blocked up to timeout")
+
+	close(handler.gate)
+	require.NoError(suite.T(), tap.Close(), "failed to close tap")
+	require.Equal(suite.T(), events[:2], handler.handled())
+}
+
+func (suite *QueuedTapTestSuite) TestQueuedTap__Block() {
+	handler := newGatedProcessor()
+	tap, err := NewQueuedProcessorTap(handler, QueuedTapParams{
+		QueueSize: 1,
+		Policy:    OverflowBlock,
+	})
+	require.NoError(suite.T(), err, "failed to create queued tap: %s", err)
+
+	events := prepareEvents(4)
+	require.NoError(suite.T(), tap.PushEvent(events[0]), "failed to push event")
+	handler.waitForPending(suite.T())
+	require.NoError(suite.T(), tap.PushEvent(events[1]), "failed to push event")
+
+	//A blocked producer is released by its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = tap.PushEventContext(ctx, events[2])
+	require.True(suite.T(), IsTimeoutError(err), "unexpected error %v", err)
+
+	//A blocked producer is released by the close, and the accepted events are still handled
+	pushed := make(chan error, 1)
+	go func() {
+		pushed <- tap.PushEvent(events[3])
+	}()
+	select {
+	case err = <-pushed:
+		require.Fail(suite.T(), "producer was not blocked", "returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- tap.Close()
+	}()
+	require.Equal(suite.T(), ErrTapClosed, <-pushed)
+	close(handler.gate)
+	require.NoError(suite.T(), <-closed, "failed to close tap")
+	require.Equal(suite.T(), events[:2], handler.handled())
+	require.Zero(suite.T(), tap.Dropped())
+}
+
+func (suite *QueuedTapTestSuite) TestQueuedTap__PushRacingClose() {
+	for _, policy := range []OverflowPolicy{OverflowBlock, OverflowDropNewest, OverflowDropOldest} {
+		handler := &countingProcessor{}
+		tap, err := NewQueuedProcessorTap(handler, QueuedTapParams{
+			QueueSize: 1000,
+			Policy:    policy,
+		})
+		require.NoError(suite.T(), err, "failed to create queued tap: %s", err)
+
+		//Every event accepted before or while closing should be handled
+		accepted := atomic.NewInt32(0)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, event := range prepareEvents(50) {
+					if tap.PushEvent(event) == nil {
+						accepted.Inc()
+					}
+				}
+			}()
+		}
+		require.NoError(suite.T(), tap.Close(), "failed to close tap")
+		wg.Wait()
+		require.Equal(suite.T(), accepted.Load(), handler.count.Load(), "lost events with %s policy", policy)
+	}
+}
+
+func TestQueuedTap__RUN(t *testing.T) {
+	crt := new(QueuedTapTestSuite)
+	suite.Run(t, crt)
+}
+
+//Processor stub counting the handled events
+type countingProcessor struct {
+	ProcessorInterface
+	count atomic.Int32
+}
+
+func (cp *countingProcessor) PushEvent(event *pb.Event) error {
+	cp.count.Inc()
+	return nil
+}
+
+//Processor stub which blocks on handling events until its gate is closed
+type gatedProcessor struct {
+	ProcessorInterface
+	gate     chan struct{}
+	pending  chan *pb.Event
+	received []*pb.Event
+}
+
+func newGatedProcessor() *gatedProcessor {
+	return &gatedProcessor{
+		gate:    make(chan struct{}),
+		pending: make(chan *pb.Event, 100),
+	}
+}
+
+func (gp *gatedProcessor) PushEvent(event *pb.Event) error {
+	gp.pending <- event
+	<-gp.gate
+	return nil
+}
+
+//Wait until the handler was called for the next event
+func (gp *gatedProcessor) waitForPending(t *testing.T) {
+	err := wait.Poll(time.Millisecond, time.Second, func() (bool, error) {
+		if len(gp.pending) == 0 {
+			return false, nil
+		}
+		gp.received = append(gp.received, <-gp.pending)
+		return true, nil
+	})
+	require.NoError(t, err, "handler was not called")
+}
+
+//Get all events the handler was called with
+func (gp *gatedProcessor) handled() []*pb.Event {
+	for len(gp.pending) > 0 {
+		gp.received = append(gp.received, <-gp.pending)
+	}
+	return gp.received
+}
@@ -0,0 +1,209 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Returned by a rate limiting sink for queries exceeding the rate limit
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+//Token bucket rate limiter:
+//Tokens are added at a constant rate up to the burst size, and each allowed call takes one.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+//Create token bucket allowing rate calls per second on average, and up to burst calls at once:
+//The bucket starts full.
+func NewTokenBucket(rate float64, burst int) (*TokenBucket, error) {
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return nil, fmt.Errorf("rate should be positive")
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("burst should be positive")
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}, nil
+}
+
+//Take a token if available
+func (t *TokenBucket) Allow() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+//This is an egress object limiting the rate of the calls made through the wrapped sink:
+//Events beyond the limit are dropped without an error, while queries beyond the limit
+//are rejected with ErrRateLimited. Both are counted by the given counter.
+type RateLimitSink struct {
+	SinkInterface
+	bucket  *TokenBucket
+	sink    SinkInterface
+	limited metrics.Counter
+}
+
+//Create rate limiting sink:
+//limited is the counter of the dropped events and rejected queries, nil for not counting them.
+func NewRateLimitSink(bucket *TokenBucket, sink SinkInterface, limited metrics.Counter) SinkInterface {
+	if limited == nil {
+		limited = metrics.NilCounter{}
+	}
+	return &RateLimitSink{
+		bucket:  bucket,
+		sink:    sink,
+		limited: limited,
+	}
+}
+
+func (r *RateLimitSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return r.RunQueryContext(context.Background(), query)
+}
+
+func (r *RateLimitSink) PushEvent(event *proto.Event) error {
+	return r.PushEventContext(context.Background(), event)
+}
+
+func (r *RateLimitSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	if !r.bucket.Allow() {
+		r.limited.Inc(1)
+		return nil, ErrRateLimited
+	}
+	return RunQueryWithContext(ctx, r.sink, query)
+}
+
+func (r *RateLimitSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	if !r.bucket.Allow() {
+		r.limited.Inc(1)
+		return nil
+	}
+	return PushEventWithContext(ctx, r.sink, event)
+}
+
+//Mode of selecting the sampled events
+type SamplingMode int
+
+const (
+	//Select each event independently at random
+	SampleRandom SamplingMode = iota
+	//Select by a hash of the event UUID, so the same events are selected by all the relations
+	//and hops sampling at the same rate
+	SampleDeterministic
+)
+
+var samplingModeNames = map[SamplingMode]string{
+	SampleRandom:        "random",
+	SampleDeterministic: "deterministic",
+}
+
+func (m SamplingMode) String() string {
+	if name, exists := samplingModeNames[m]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+//Get sampling mode by its name
+func ParseSamplingMode(name string) (SamplingMode, error) {
+	for mode, modeName := range samplingModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sampling mode %s", name)
+}
+
+//This is an events egress object passing on only a sample of the events:
+//Events left out of the sample are dropped without an error and counted by the given counter.
+//Deterministic sampling hashes the envelope header UUID, or the whole event if it has none.
+//Queries pass through unaffected.
+type SamplingSink struct {
+	SinkInterface
+	rate       float64
+	mode       SamplingMode
+	sink       SinkInterface
+	sampledOut metrics.Counter
+}
+
+//Create sampling sink passing on the given fraction of the events:
+//sampledOut is the counter of the dropped events, nil for not counting them.
+func NewSamplingSink(rate float64, mode SamplingMode, sink SinkInterface, sampledOut metrics.Counter) (SinkInterface, error) {
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("sampling rate should be in [0, 1]")
+	}
+	if sampledOut == nil {
+		sampledOut = metrics.NilCounter{}
+	}
+	return &SamplingSink{
+		rate:       rate,
+		mode:       mode,
+		sink:       sink,
+		sampledOut: sampledOut,
+	}, nil
+}
+
+func (s *SamplingSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return s.RunQueryContext(context.Background(), query)
+}
+
+func (s *SamplingSink) PushEvent(event *proto.Event) error {
+	return s.PushEventContext(context.Background(), event)
+}
+
+func (s *SamplingSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return RunQueryWithContext(ctx, s.sink, query)
+}
+
+func (s *SamplingSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	if !s.sampled(event) {
+		s.sampledOut.Inc(1)
+		return nil
+	}
+	return PushEventWithContext(ctx, s.sink, event)
+}
+
+//Private method for checking whether an event is in the sample
+func (s *SamplingSink) sampled(event *proto.Event) bool {
+	if s.mode != SampleDeterministic {
+		return rand.Float64() < s.rate //nolint - no need for secure randomness
+	}
+	var key string
+	if event.Header != nil && event.Header.UUID != "" {
+		key = event.Header.UUID
+	} else {
+		data, err := event.Marshal()
+		if err != nil {
+			return true
+		}
+		key = string(data)
+	}
+	//Map the hash into [0, 1)
+	return float64(hashString(key)>>11)/(1<<53) < s.rate
+}
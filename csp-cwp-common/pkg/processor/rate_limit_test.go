@@ -0,0 +1,105 @@
+package processor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type RateLimitTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RateLimitTestSuite) SetupTest() {
+}
+
+func (suite *RateLimitTestSuite) TearDownTest() {
+}
+
+func (suite *RateLimitTestSuite) TestRateLimit__TokenBucket() {
+	_, err := NewTokenBucket(0, 1)
+	require.Error(suite.T(), err, "created bucket with no rate")
+	_, err = NewTokenBucket(1, 0)
+	require.Error(suite.T(), err, "created bucket with no burst")
+
+	bucket, err := NewTokenBucket(20, 3)
+	require.NoError(suite.T(), err, "failed to create bucket: %s", err)
+	for i := 0; i < 3; i++ {
+		require.True(suite.T(), bucket.Allow(), "burst call %d not allowed", i)
+	}
+	require.False(suite.T(), bucket.Allow(), "allowed call beyond burst")
+	//A token is added every 50ms
+	time.Sleep(100 * time.Millisecond)
+	require.True(suite.T(), bucket.Allow(), "refilled call not allowed")
+}
+
+func (suite *RateLimitTestSuite) TestRateLimit__Sink() {
+	bucket, err := NewTokenBucket(0.001, 2)
+	require.NoError(suite.T(), err, "failed to create bucket: %s", err)
+	limited := metrics.NewCounter()
+	recording := &recordingSink{}
+	sink := NewRateLimitSink(bucket, recording, limited)
+
+	//Events beyond the limit are dropped silently
+	for _, event := range prepareEvents(3) {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+	}
+	require.Equal(suite.T(), 2, len(recording.received()))
+	require.Equal(suite.T(), int64(1), limited.Count())
+
+	//Queries beyond the limit are rejected
+	queries, _ := prepareQueries(1)
+	_, err = sink.RunQuery(queries[0])
+	require.Equal(suite.T(), ErrRateLimited, err)
+	require.Equal(suite.T(), int64(2), limited.Count())
+}
+
+func (suite *RateLimitTestSuite) TestRateLimit__Sampling() {
+	_, err := NewSamplingSink(1.5, SampleRandom, &recordingSink{}, nil)
+	require.Error(suite.T(), err, "created sink with invalid rate")
+	_, err = ParseSamplingMode("sometimes")
+	require.Error(suite.T(), err, "parsed unknown sampling mode")
+
+	events := prepareEvents(1000)
+	for i, event := range events {
+		event.Header = &pb.EventHeader{UUID: fmt.Sprintf("event-%d", i)}
+	}
+	for _, mode := range []SamplingMode{SampleRandom, SampleDeterministic} {
+		sampledOut := metrics.NewCounter()
+		recording := &recordingSink{}
+		sink, err := NewSamplingSink(0.25, mode, recording, sampledOut)
+		require.NoError(suite.T(), err, "failed to create %s sink: %s", mode, err)
+		for _, event := range events {
+			require.NoError(suite.T(), sink.PushEvent(event), "failed to push event")
+		}
+		received := len(recording.received())
+		require.InDelta(suite.T(), 250, received, 75, "unexpected %s sample size", mode)
+		require.Equal(suite.T(), int64(len(events)-received), sampledOut.Count())
+		//Queries are not sampled
+		queries, _ := prepareQueries(1)
+		_, err = sink.RunQuery(queries[0])
+		require.NoError(suite.T(), err, "failed to run query: %s", err)
+	}
+
+	//Deterministic sampling selects the same events, including ones with no header
+	events = append(events, prepareEvents(1)...)
+	first, second := &recordingSink{}, &recordingSink{}
+	firstSink, _ := NewSamplingSink(0.5, SampleDeterministic, first, nil)
+	secondSink, _ := NewSamplingSink(0.5, SampleDeterministic, second, nil)
+	for _, event := range events {
+		require.NoError(suite.T(), firstSink.PushEvent(event), "failed to push event")
+		require.NoError(suite.T(), secondSink.PushEvent(event), "failed to push event")
+	}
+	require.Equal(suite.T(), first.received(), second.received())
+}
+
+func TestRateLimit__RUN(t *testing.T) {
+	crt := new(RateLimitTestSuite)
+	suite.Run(t, crt)
+}
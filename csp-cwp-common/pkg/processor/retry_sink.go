@@ -0,0 +1,168 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Deadline of pushing a dead letter, which is not bound to the caller context
+const deadLetterTimeout = 5 * time.Second
+
+//Parameters of a retrying sink
+type RetryParams struct {
+	//Number of delivery attempts, including the first one
+	Attempts int
+	//Delay before the first retry
+	Backoff time.Duration
+	//Factor the delay grows by after each retry, 1 for a constant delay (default 2)
+	Multiplier float64
+	//Cap of the delay, zero for no cap
+	MaxBackoff time.Duration
+	//Random fraction in [0, 1] the delay may vary by, so retrying callers do not synchronize
+	Jitter float64
+}
+
+//Check retry params validity and fill in defaults
+func (p *RetryParams) validate() error {
+	if p.Attempts < 1 {
+		return fmt.Errorf("retry attempts should be positive")
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("retry backoff should not be negative")
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = 2
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("retry multiplier should not be less than 1")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry jitter should be in [0, 1]")
+	}
+	return nil
+}
+
+//Destination of the events which exhausted their delivery attempts
+type DeadLetterInterface interface {
+	//Handle undelivered event
+	PushDeadLetter(ctx context.Context, letter *proto.DeadLetter) error
+}
+
+//This is an egress object retrying the failed calls made through the wrapped sink:
+//Calls are retried with exponential backoff until they succeed, the attempts are exhausted
+//or the call context is done. Events which exhausted their attempts are passed to the
+//dead letter destination, if any, along with the last error.
+//Events which timed out are not retried, as a timed out delivery may still complete, so
+//the destination does not get duplicates. They are passed to the dead letter destination
+//right away. Events are dead lettered under their own deadline, so the events which failed
+//as the caller gave up (as on mesh shutdown) are kept as well.
+type RetrySink struct {
+	SinkInterface
+	params     RetryParams
+	relation   string
+	sink       SinkInterface
+	deadLetter DeadLetterInterface
+}
+
+//Create retrying sink:
+//relation is the relation name recorded on the dead letters.
+//deadLetter is the destination of undelivered events, nil to drop them.
+func NewRetrySink(sink SinkInterface, relation string, params RetryParams, deadLetter DeadLetterInterface) (SinkInterface, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &RetrySink{
+		params:     params,
+		relation:   relation,
+		sink:       sink,
+		deadLetter: deadLetter,
+	}, nil
+}
+
+func (r *RetrySink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return r.RunQueryContext(context.Background(), query)
+}
+
+func (r *RetrySink) PushEvent(event *proto.Event) error {
+	return r.PushEventContext(context.Background(), event)
+}
+
+func (r *RetrySink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	var result *proto.QueryResult
+	_, err := r.retry(ctx, func() error {
+		var err error
+		result, err = RunQueryWithContext(ctx, r.sink, query)
+		return err
+	}, func(err error) bool {
+		return true
+	})
+	return result, err
+}
+
+//An event delivered to the dead letter destination is not reported as failed.
+func (r *RetrySink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	attempts, err := r.retry(ctx, func() error {
+		return PushEventWithContext(ctx, r.sink, event)
+	}, func(err error) bool {
+		return !IsTimeoutError(err)
+	})
+	if err == nil || r.deadLetter == nil {
+		return err
+	}
+	letter := &proto.DeadLetter{
+		Event:     event,
+		Relation:  r.relation,
+		Error:     err.Error(),
+		Attempts:  uint32(attempts),
+		Timestamp: time.Now().UnixNano(),
+	}
+	//Carries the caller context values, as the trace context
+	deadLetterCtx, cancel := context.WithTimeout(context.Background(), deadLetterTimeout)
+	defer cancel()
+	deadLetterCtx = &valuesContext{
+		Context: deadLetterCtx,
+		values:  ctx,
+	}
+	if deadLetterErr := r.deadLetter.PushDeadLetter(deadLetterCtx, letter); deadLetterErr != nil {
+		return fmt.Errorf("%s, and failed to push dead letter: %s", err, deadLetterErr)
+	}
+	return nil
+}
+
+//Private method for calling until success, exhaustion or a failure which is not retryable,
+//return the number of attempts made
+func (r *RetrySink) retry(ctx context.Context, call func() error, retryable func(err error) bool) (int, error) {
+	backoff := r.params.Backoff
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= r.params.Attempts || ctx.Err() != nil || !retryable(err) {
+			return attempt, err
+		}
+
+		timer := time.NewTimer(r.jitter(backoff))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		}
+		backoff = time.Duration(float64(backoff) * r.params.Multiplier)
+		if r.params.MaxBackoff > 0 && backoff > r.params.MaxBackoff {
+			backoff = r.params.MaxBackoff
+		}
+	}
+}
+
+//Private method for randomizing a delay by the jitter fraction
+func (r *RetrySink) jitter(delay time.Duration) time.Duration {
+	if r.params.Jitter == 0 {
+		return delay
+	}
+	//Uniform in [1 - jitter, 1 + jitter]
+	factor := 1 + r.params.Jitter*(2*rand.Float64()-1) //nolint - no need for secure randomness
+	return time.Duration(float64(delay) * factor)
+}
@@ -0,0 +1,213 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type RetrySinkTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RetrySinkTestSuite) SetupTest() {
+}
+
+func (suite *RetrySinkTestSuite) TearDownTest() {
+}
+
+func (suite *RetrySinkTestSuite) TestRetrySink__Recover() {
+	flaky := &flakySink{failures: 2}
+	sink, err := NewRetrySink(flaky, "relation", RetryParams{
+		Attempts: 3,
+		Backoff:  10 * time.Millisecond,
+	}, nil)
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	//Retries wait 10ms and then 20ms
+	start := time.Now()
+	require.NoError(suite.T(), sink.PushEvent(prepareEvents(1)[0]), "failed to push event")
+	require.GreaterOrEqual(suite.T(), int64(time.Since(start)), int64(30*time.Millisecond))
+	require.Equal(suite.T(), 3, flaky.calls)
+
+	flaky.failures, flaky.calls = 1, 0
+	queries, _ := prepareQueries(1)
+	_, err = sink.RunQuery(queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.Equal(suite.T(), 2, flaky.calls)
+}
+
+func (suite *RetrySinkTestSuite) TestRetrySink__DeadLetter() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	flaky := &flakySink{failures: 10}
+	sink, err := NewRetrySink(flaky, "relation", RetryParams{
+		Attempts: 2,
+		Backoff:  time.Millisecond,
+		Jitter:   0.5,
+	}, NewSinkDeadLetter(NewSink(collector.GetTap())))
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	//Undelivered event reaches the dead letter processor
+	event := prepareEvents(1)[0]
+	require.NoError(suite.T(), sink.PushEvent(event), "dead lettered event was reported as failed")
+	require.Equal(suite.T(), 2, flaky.calls)
+	require.Equal(suite.T(), 1, len(collector.events))
+	require.Equal(suite.T(), pb.EventType_DeadLetterEventType, collector.events[0].Type)
+	letter := collector.events[0].GetDeadLetter()
+	require.True(suite.T(), letter.Event.Equal(event), "mismatching dead letter event")
+	require.Equal(suite.T(), "relation", letter.Relation)
+	require.Equal(suite.T(), "failure 2", letter.Error)
+	require.Equal(suite.T(), uint32(2), letter.Attempts)
+
+	//Failed queries are returned to the caller
+	queries, _ := prepareQueries(1)
+	_, err = sink.RunQuery(queries[0])
+	require.Error(suite.T(), err, "failed query was not reported")
+}
+
+func (suite *RetrySinkTestSuite) TestRetrySink__FileDeadLetter() {
+	dir, err := ioutil.TempDir("", "dead_letter_")
+	require.NoError(suite.T(), err, "failed to create directory: %s", err)
+	defer os.RemoveAll(dir)
+
+	deadLetter, err := NewFileDeadLetter(filepath.Join(dir, "dead_letters.jsonl"))
+	require.NoError(suite.T(), err, "failed to create dead letter: %s", err)
+	sink, err := NewRetrySink(&flakySink{failures: 10}, "relation", RetryParams{
+		Attempts: 1,
+	}, deadLetter)
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	events := prepareEvents(2)
+	for _, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to dead letter event")
+	}
+	require.NoError(suite.T(), deadLetter.Close(), "failed to close dead letter")
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "dead_letters.jsonl"))
+	require.NoError(suite.T(), err, "failed to read dead letters: %s", err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Equal(suite.T(), len(events), len(lines))
+	for i, line := range lines {
+		letter := &pb.DeadLetter{}
+		require.NoError(suite.T(), jsonpb.UnmarshalString(line, letter), "failed to parse dead letter")
+		require.True(suite.T(), letter.Event.Equal(events[i]), "mismatching dead letter event")
+		require.Equal(suite.T(), uint32(1), letter.Attempts)
+	}
+}
+
+func (suite *RetrySinkTestSuite) TestRetrySink__Canceled() {
+	flaky := &flakySink{failures: 10}
+	sink, err := NewRetrySink(flaky, "relation", RetryParams{
+		Attempts: 10,
+		Backoff:  time.Hour,
+	}, nil)
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	//Retries stop once the caller gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Error(suite.T(), PushEventWithContext(ctx, sink, prepareEvents(1)[0]), "failed event was not reported")
+	require.Equal(suite.T(), 1, flaky.calls)
+}
+
+func (suite *RetrySinkTestSuite) TestRetrySink__Timeout() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	flaky := &flakySink{failures: 10, timeout: true}
+	sink, err := NewRetrySink(flaky, "relation", RetryParams{
+		Attempts: 3,
+		Backoff:  time.Millisecond,
+	}, NewSinkDeadLetter(NewSink(collector.GetTap())))
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	//Timed out events may still be delivered, so they are dead lettered rather than retried
+	require.NoError(suite.T(), sink.PushEvent(prepareEvents(1)[0]), "dead lettered event was reported as failed")
+	require.Equal(suite.T(), 1, flaky.calls)
+	require.Equal(suite.T(), 1, len(collector.events))
+	require.Equal(suite.T(), uint32(1), collector.events[0].GetDeadLetter().Attempts)
+
+	//Timed out queries are retried
+	flaky.calls = 0
+	queries, _ := prepareQueries(1)
+	_, err = sink.RunQuery(queries[0])
+	require.True(suite.T(), IsTimeoutError(err), "unexpected error %v", err)
+	require.Equal(suite.T(), 3, flaky.calls)
+}
+
+func (suite *RetrySinkTestSuite) TestRetrySink__CanceledDeadLetter() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	sink, err := NewRetrySink(&flakySink{failures: 10}, "relation", RetryParams{
+		Attempts: 10,
+		Backoff:  time.Hour,
+	}, NewSinkDeadLetter(NewSink(collector.GetTap())))
+	require.NoError(suite.T(), err, "failed to create sink: %s", err)
+
+	//Events failing as the caller gives up are still dead lettered
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.NoError(suite.T(), PushEventWithContext(ctx, sink, prepareEvents(1)[0]), "dead lettered event was reported as failed")
+	require.Equal(suite.T(), 1, len(collector.events))
+	require.Equal(suite.T(), "failure 1", collector.events[0].GetDeadLetter().Error)
+}
+
+func (suite *RetrySinkTestSuite) TestRetrySink__InvalidParams() {
+	for _, params := range []RetryParams{
+		{Attempts: 0},
+		{Attempts: 1, Backoff: -time.Second},
+		{Attempts: 1, Multiplier: 0.5},
+		{Attempts: 1, Jitter: 2},
+	} {
+		_, err := NewRetrySink(&flakySink{}, "relation", params, nil)
+		require.Error(suite.T(), err, "created sink with params %+v", params)
+	}
+}
+
+func TestRetrySink__RUN(t *testing.T) {
+	crt := new(RetrySinkTestSuite)
+	suite.Run(t, crt)
+}
+
+//Sink stub failing its first calls, with timeouts if set
+type flakySink struct {
+	SinkInterface
+	failures int
+	timeout  bool
+	calls    int
+}
+
+func (f *flakySink) PushEventContext(ctx context.Context, event *pb.Event) error {
+	f.calls++
+	if f.calls <= f.failures && f.timeout {
+		return &TimeoutError{Operation: "push event", Timeout: time.Millisecond}
+	}
+	if f.calls <= f.failures {
+		return fmt.Errorf("failure %d", f.calls)
+	}
+	return nil
+}
+
+func (f *flakySink) RunQueryContext(ctx context.Context, query *pb.Query) (*pb.QueryResult, error) {
+	if err := f.PushEventContext(ctx, nil); err != nil {
+		return nil, err
+	}
+	return &pb.QueryResult{Type: query.Type, UUID: query.UUID}, nil
+}
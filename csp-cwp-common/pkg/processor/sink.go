@@ -1,7 +1,9 @@
 package processor
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
 )
@@ -14,30 +16,162 @@ type SinkInterface interface {
 	PushEvent(event *proto.Event) error
 }
 
-//This is the events and queries egress object for a processor or a service
+//This is the events and queries egress object for a processor or a service:
+//A call under a deadline (the sink timeout or the caller context one) is handed to a separate
+//goroutine, so the caller is released once the deadline passes even if the handler is hung.
+//NOTE: a timed out call is abandoned rather than cancelled, so its delivery may still complete
+//after the caller got the TimeoutError, unless the handler stops once its context is done.
+//Calls under no deadline are made from the caller goroutine.
 type Sink struct {
 	SinkInterface
 	tap TapInterface
+
+	//Base context of all calls, once done all calls are abandoned
+	ctx context.Context
+	//Deadline applied on each call, zero for no deadline
+	timeout time.Duration
 }
 
 //Create sink to a local Tap
 func NewSink(tap TapInterface) SinkInterface {
+	return NewSinkWithContext(context.Background(), tap, 0)
+}
+
+//Create sink to a local Tap with deadline enforcement:
+//ctx is the base context of all calls made through the sink, cancelling it abandons
+//all pending calls (as on mesh shutdown).
+//timeout is the deadline applied on each call, zero for no deadline.
+//A call which is not handled in time returns a TimeoutError to the caller.
+func NewSinkWithContext(ctx context.Context, tap TapInterface, timeout time.Duration) SinkInterface {
 	s := &Sink{
-		tap: tap,
+		tap:     tap,
+		ctx:     ctx,
+		timeout: timeout,
 	}
 	return s
 }
 
 func (s *Sink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
-	if s.tap != nil {
-		return s.tap.RunQuery(query)
-	}
-	return nil, fmt.Errorf("no valid tap")
+	return s.RunQueryContext(context.Background(), query)
 }
 
 func (s *Sink) PushEvent(event *proto.Event) error {
-	if s.tap != nil {
-		return s.tap.PushEvent(event)
+	return s.PushEventContext(context.Background(), event)
+}
+
+func (s *Sink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	if s.tap == nil {
+		return nil, fmt.Errorf("no valid tap")
+	}
+	return s.call(ctx, "run query", func(ctx context.Context) (*proto.QueryResult, error) {
+		return RunQueryWithContext(ctx, s.tap, query)
+	})
+}
+
+func (s *Sink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	if s.tap == nil {
+		return fmt.Errorf("no valid tap")
+	}
+	_, err := s.call(ctx, "push event", func(ctx context.Context) (*proto.QueryResult, error) {
+		return nil, PushEventWithContext(ctx, s.tap, event)
+	})
+	return err
+}
+
+//Streaming queries are run under the sink deadline from the caller goroutine, as the results
+//are sent to the caller stream, so a handler ignoring its context holds the caller.
+func (s *Sink) RunStreamingQuery(ctx context.Context, query *proto.Query, stream ResultStream) error {
+	if s.tap == nil {
+		return fmt.Errorf("no valid tap")
+	}
+	ctx, cancel := s.callContext(ctx)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return contextError(err, "run streaming query", s.timeout)
+	}
+	if err := RunStreamingQuery(ctx, s.tap, query, stream); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return contextError(ctxErr, "run streaming query", s.timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+//Private method for calling the tap under the sink deadline:
+//When a deadline applies, the tap is called from a separate goroutine so the caller can be
+//released once the deadline passes even if the handler is hung. Otherwise the tap is called
+//inline, and the mesh shutdown only reaches the handlers supporting the context.
+func (s *Sink) call(ctx context.Context, operation string, fn func(ctx context.Context) (*proto.QueryResult, error)) (*proto.QueryResult, error) {
+	ctx, cancel := s.callContext(ctx)
+	defer cancel()
+
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err, operation, s.timeout)
+	}
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		return fn(ctx)
+	}
+
+	type reply struct {
+		result *proto.QueryResult
+		err    error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		result, err := fn(ctx)
+		replies <- reply{result, err}
+	}()
+
+	select {
+	case r := <-replies:
+		return r.result, r.err
+	case <-ctx.Done():
+		return nil, contextError(ctx.Err(), operation, s.timeout)
+	}
+}
+
+//Private method for merging the caller context with the sink base context and timeout
+func (s *Sink) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	cancel := func() {}
+	switch {
+	case s.ctx.Done() == nil:
+		//Base context can never be done, simply use the caller context
+	case ctx.Done() == nil:
+		//Caller context can never be done, only the base context can end the call
+		ctx = &valuesContext{
+			Context: s.ctx,
+			values:  ctx,
+		}
+	default:
+		//Both can be done, cancel the call context once the base context is done
+		var mergeCancel context.CancelFunc
+		ctx, mergeCancel = context.WithCancel(ctx)
+		go func(done <-chan struct{}) {
+			select {
+			case <-s.ctx.Done():
+				mergeCancel()
+			case <-done:
+			}
+		}(ctx.Done())
+		cancel = mergeCancel
+	}
+	if s.timeout <= 0 {
+		return ctx, cancel
+	}
+	ctx, timeoutCancel := context.WithTimeout(ctx, s.timeout)
+	return ctx, func() {
+		timeoutCancel()
+		cancel()
 	}
-	return fmt.Errorf("no valid tap")
+}
+
+//Context which is done along with the sink base context but carries the caller context values
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c *valuesContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
 }
@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Receiver of the results of a streaming query:
+//Send is called from a single goroutine, and an error returned by it ends the stream.
+type ResultStream interface {
+	Send(result *proto.QueryResult) error
+}
+
+//Adapter for using a function as a ResultStream
+type ResultStreamFunc func(result *proto.QueryResult) error
+
+func (f ResultStreamFunc) Send(result *proto.QueryResult) error {
+	return f(result)
+}
+
+//Optional extension of ServiceInterface:
+//A service implementing it answers streaming queries with any number of results sent to
+//the stream, returning once all of them were sent. Sending fails once the caller abandoned
+//the query. The results are stamped with the query type, UUID and their sequence number,
+//and the stream is terminated by an end marker once the service returns with no error.
+type StreamingServiceInterface interface {
+	//Handle received streaming query under the given context
+	StreamQuery(ctx context.Context, query *proto.Query, stream ResultStream) error
+}
+
+//Streaming query path of the taps and sinks supporting it:
+//The results are sent to the stream in order, followed by a result with EndOfStream set
+//and no information, unless the query failed.
+type StreamingQueryInterface interface {
+	//Run streaming query, returning once the stream is terminated
+	RunStreamingQuery(ctx context.Context, query *proto.Query, stream ResultStream) error
+}
+
+//Adapter for running a streaming query on any service under a context:
+//Services implementing StreamingServiceInterface stream their results, other services are
+//run once, and again for each following page while they return a NextPageToken, streaming
+//each page as a single result.
+func RunStreamingQueryWithContext(ctx context.Context, handler ServiceInterface, query *proto.Query, stream ResultStream) error {
+	sequenced := &sequencedStream{
+		ctx:    ctx,
+		query:  query,
+		stream: stream,
+	}
+	var err error
+	if streamingHandler, ok := handler.(StreamingServiceInterface); ok {
+		err = streamingHandler.StreamQuery(ctx, query, sequenced)
+	} else {
+		err = streamPages(ctx, func(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+			return RunQueryWithContext(ctx, handler, query)
+		}, query, sequenced)
+	}
+	if err != nil {
+		return err
+	}
+	return sequenced.end()
+}
+
+//Run a streaming query through any tap or sink:
+//Those implementing StreamingQueryInterface stream the results, others are paged through
+//as by RunStreamingQueryWithContext. Of the relation sink wrappers, the tracing and metrics
+//sinks pass the streams through, while the others (as retries or balancing) are paged through.
+func RunStreamingQuery(ctx context.Context, querier QueryRunner, query *proto.Query, stream ResultStream) error {
+	if streamingQuerier, ok := querier.(StreamingQueryInterface); ok {
+		return streamingQuerier.RunStreamingQuery(ctx, query, stream)
+	}
+	sequenced := &sequencedStream{
+		ctx:    ctx,
+		query:  query,
+		stream: stream,
+	}
+	if err := streamPages(ctx, runQueryHandler(querier), query, sequenced); err != nil {
+		return err
+	}
+	return sequenced.end()
+}
+
+//Private function for streaming the pages of a paged query, one result per page
+func streamPages(ctx context.Context, run func(context.Context, *proto.Query) (*proto.QueryResult, error),
+	query *proto.Query, stream ResultStream) error {
+	tokens := make(map[string]struct{})
+	page := query
+	for {
+		result, err := run(ctx, page)
+		if err != nil {
+			return err
+		}
+		if result == nil {
+			return fmt.Errorf("no result for query %s", query.UUID)
+		}
+		token := result.NextPageToken
+		if err := stream.Send(result); err != nil {
+			return err
+		}
+		if token == "" {
+			return nil
+		}
+		//A repeated token would page forever
+		if _, exists := tokens[token]; exists {
+			return fmt.Errorf("query %s repeated page token %s", query.UUID, token)
+		}
+		tokens[token] = struct{}{}
+		next := *page
+		next.PageToken = token
+		page = &next
+	}
+}
+
+//Stream stamping the results of a query and terminating them with an end marker
+type sequencedStream struct {
+	ctx      context.Context
+	query    *proto.Query
+	stream   ResultStream
+	sequence uint64
+}
+
+func (s *sequencedStream) Send(result *proto.QueryResult) error {
+	if err := s.ctx.Err(); err != nil {
+		return contextError(err, "stream query results", 0)
+	}
+	if result == nil {
+		return fmt.Errorf("nil result for query %s", s.query.UUID)
+	}
+	result.Type = s.query.Type
+	result.UUID = s.query.UUID
+	result.Sequence = s.sequence
+	result.EndOfStream = false
+	s.sequence++
+	return s.stream.Send(result)
+}
+
+//Private method for sending the end marker
+func (s *sequencedStream) end() error {
+	if err := s.ctx.Err(); err != nil {
+		return contextError(err, "stream query results", 0)
+	}
+	return s.stream.Send(&proto.QueryResult{
+		Type:        s.query.Type,
+		UUID:        s.query.UUID,
+		Sequence:    s.sequence,
+		EndOfStream: true,
+	})
+}
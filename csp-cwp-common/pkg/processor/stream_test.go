@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type StreamTestSuite struct {
+	suite.Suite
+}
+
+func (suite *StreamTestSuite) SetupTest() {
+}
+
+func (suite *StreamTestSuite) TearDownTest() {
+}
+
+func (suite *StreamTestSuite) TestStream__StreamingService() {
+	service := &chunkService{chunks: 3}
+	registry := metrics.NewRegistry()
+	relationMetrics, err := GetOrRegisterRelationMetrics(registry, "relation")
+	require.NoError(suite.T(), err, "failed to register metrics: %s", err)
+	sink := NewMetricsSink(relationMetrics, NewTracingSink(nil, "relation",
+		NewSink(NewTracingTap(nil, "Instance2", NewServiceTap(service, service)))))
+
+	query := &pb.Query{Type: pb.QueryType_DummyQueryType, UUID: "query-uuid"}
+	results, err := collectStream(sink, query)
+	require.NoError(suite.T(), err, "failed to run streaming query: %s", err)
+	require.Equal(suite.T(), 4, len(results))
+	for i, result := range results {
+		require.Equal(suite.T(), query.UUID, result.UUID)
+		require.Equal(suite.T(), uint64(i), result.Sequence)
+		require.Equal(suite.T(), i == 3, result.EndOfStream)
+	}
+	require.Equal(suite.T(), "Chunk 2", results[2].GetDummy().Info)
+	require.Nil(suite.T(), results[3].Info)
+	require.Equal(suite.T(), int64(1), relationMetrics.Snapshot().Queries)
+
+	//A failing stream stops the service, which is not terminated by an end marker
+	received := 0
+	err = RunStreamingQuery(context.Background(), sink, query, ResultStreamFunc(func(result *pb.QueryResult) error {
+		received++
+		return fmt.Errorf("stream is full")
+	}))
+	require.Error(suite.T(), err, "streamed to failing stream")
+	require.Equal(suite.T(), 1, received)
+	service.fail = true
+	results, err = collectStream(sink, query)
+	require.Error(suite.T(), err, "streaming query did not fail")
+	require.Equal(suite.T(), 3, len(results))
+	require.Equal(suite.T(), int64(2), relationMetrics.Snapshot().QueryErrors)
+}
+
+func (suite *StreamTestSuite) TestStream__Paging() {
+	service := &pagedService{pages: 3}
+	sink := NewSink(NewServiceTap(service, service))
+	query := &pb.Query{Type: pb.QueryType_DummyQueryType, UUID: "query-uuid", PageSize: 10}
+	results, err := collectStream(sink, query)
+	require.NoError(suite.T(), err, "failed to run paged query: %s", err)
+	require.Equal(suite.T(), 4, len(results))
+	for i, result := range results[:3] {
+		require.Equal(suite.T(), "Page "+strconv.Itoa(i), result.GetDummy().Info)
+		require.Equal(suite.T(), uint64(i), result.Sequence)
+	}
+	require.True(suite.T(), results[3].EndOfStream, "missing end marker")
+	require.Empty(suite.T(), query.PageToken, "original query was modified")
+
+	//Paging through a repeating token fails
+	service.repeat = true
+	_, err = collectStream(sink, query)
+	require.Error(suite.T(), err, "paged through repeating token")
+
+	//Sinks not supporting streaming return their single result
+	results, err = collectStream(&recordingSink{}, query)
+	require.NoError(suite.T(), err, "failed to run streaming query: %s", err)
+	require.Equal(suite.T(), 2, len(results))
+	require.True(suite.T(), results[1].EndOfStream, "missing end marker")
+}
+
+func (suite *StreamTestSuite) TestStream__Timeout() {
+	service := &chunkService{chunks: 1000, delay: 10 * time.Millisecond}
+	sink := NewSinkWithContext(context.Background(), NewServiceTap(service, service), 50*time.Millisecond)
+	results, err := collectStream(sink, &pb.Query{})
+	require.True(suite.T(), IsTimeoutError(err), "unexpected error %v", err)
+	require.NotZero(suite.T(), len(results))
+	require.False(suite.T(), results[len(results)-1].EndOfStream, "timed out stream was terminated")
+}
+
+func TestStream__RUN(t *testing.T) {
+	crt := new(StreamTestSuite)
+	suite.Run(t, crt)
+}
+
+//Helper function for collecting the results of a streaming query
+func collectStream(sink SinkInterface, query *pb.Query) ([]*pb.QueryResult, error) {
+	results := []*pb.QueryResult{}
+	err := RunStreamingQuery(context.Background(), sink, query, ResultStreamFunc(func(result *pb.QueryResult) error {
+		results = append(results, result)
+		return nil
+	}))
+	return results, err
+}
+
+//Service streaming its results in chunks
+type chunkService struct {
+	ServiceInterface
+	chunks int
+	delay  time.Duration
+	fail   bool
+}
+
+func (cs *chunkService) RunQuery(query *pb.Query) (*pb.QueryResult, error) {
+	return &pb.QueryResult{}, nil
+}
+
+func (cs *chunkService) StreamQuery(ctx context.Context, query *pb.Query, stream ResultStream) error {
+	for i := 0; i < cs.chunks; i++ {
+		time.Sleep(cs.delay)
+		err := stream.Send(&pb.QueryResult{
+			Info: &pb.QueryResult_Dummy{
+				Dummy: &pb.DummyQueryResult{
+					Info: "Chunk " + strconv.Itoa(i),
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if cs.fail {
+		return fmt.Errorf("service failed")
+	}
+	return nil
+}
+
+//Service returning its results in pages
+type pagedService struct {
+	ServiceInterface
+	pages  int
+	repeat bool
+}
+
+func (ps *pagedService) RunQuery(query *pb.Query) (*pb.QueryResult, error) {
+	page := 0
+	if query.PageToken != "" {
+		page, _ = strconv.Atoi(query.PageToken)
+	}
+	result := &pb.QueryResult{
+		Info: &pb.QueryResult_Dummy{
+			Dummy: &pb.DummyQueryResult{
+				Info: "Page " + strconv.Itoa(page),
+			},
+		},
+	}
+	switch {
+	case ps.repeat:
+		result.NextPageToken = "1"
+	case page+1 < ps.pages:
+		result.NextPageToken = strconv.Itoa(page + 1)
+	}
+	return result, nil
+}
@@ -1,7 +1,9 @@
 package processor
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
 )
@@ -18,11 +20,17 @@ type TapInterface interface {
 	SetEventHandler(eventHandler ProcessorInterface)
 }
 
-//This is the events and queries ingress prototype for a processor or a service
+//This is the events and queries ingress prototype for a processor or a service:
+//A panic of the handlers is recovered and returned to the caller as a PanicError, so it does
+//not bring down the producer goroutine.
 type Tap struct {
 	TapInterface
 	eventHandler ProcessorInterface
 	queryHandler ServiceInterface
+
+	//Guards the panic handler, which may be set while the tap is in use
+	panicLock    sync.RWMutex
+	panicHandler PanicHandler
 }
 
 func NewProcessorTap(eventHandler ProcessorInterface) TapInterface {
@@ -37,20 +45,46 @@ func NewServiceTap(eventHandler ProcessorInterface, queryHandler ServiceInterfac
 	return t
 }
 
-func (t *Tap) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+func (t *Tap) RunQuery(query *proto.Query) (result *proto.QueryResult, err error) {
 	if t.queryHandler == nil {
 		return nil, fmt.Errorf("unitialized query handler")
 	}
+	defer t.recoverPanic("run query", &err)
 	return t.queryHandler.RunQuery(query)
 }
 
-func (t *Tap) PushEvent(event *proto.Event) error {
+func (t *Tap) PushEvent(event *proto.Event) (err error) {
 	if t.eventHandler == nil {
 		return fmt.Errorf("unitialized event handler")
 	}
+	defer t.recoverPanic("push event", &err)
 	return t.eventHandler.PushEvent(event)
 }
 
+func (t *Tap) RunQueryContext(ctx context.Context, query *proto.Query) (result *proto.QueryResult, err error) {
+	if t.queryHandler == nil {
+		return nil, fmt.Errorf("unitialized query handler")
+	}
+	defer t.recoverPanic("run query", &err)
+	return RunQueryWithContext(ctx, t.queryHandler, query)
+}
+
+func (t *Tap) PushEventContext(ctx context.Context, event *proto.Event) (err error) {
+	if t.eventHandler == nil {
+		return fmt.Errorf("unitialized event handler")
+	}
+	defer t.recoverPanic("push event", &err)
+	return PushEventWithContext(ctx, t.eventHandler, event)
+}
+
+func (t *Tap) RunStreamingQuery(ctx context.Context, query *proto.Query, stream ResultStream) (err error) {
+	if t.queryHandler == nil {
+		return fmt.Errorf("unitialized query handler")
+	}
+	defer t.recoverPanic("run streaming query", &err)
+	return RunStreamingQueryWithContext(ctx, t.queryHandler, query, stream)
+}
+
 func (t *Tap) SetQueryHandler(queryHandler ServiceInterface) {
 	t.queryHandler = queryHandler
 }
@@ -58,3 +92,9 @@ func (t *Tap) SetQueryHandler(queryHandler ServiceInterface) {
 func (t *Tap) SetEventHandler(eventHandler ProcessorInterface) {
 	t.eventHandler = eventHandler
 }
+
+func (t *Tap) SetPanicHandler(handler PanicHandler) {
+	t.panicLock.Lock()
+	defer t.panicLock.Unlock()
+	t.panicHandler = handler
+}
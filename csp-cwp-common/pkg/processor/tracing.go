@@ -0,0 +1,214 @@
+package processor
+
+import (
+	"context"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Get the tracer to use, the global tracer when none was given:
+//The global tracer is resolved per call, as it may be set after the mesh was built.
+func resolveTracer(tracer opentracing.Tracer) opentracing.Tracer {
+	if tracer != nil {
+		return tracer
+	}
+	if tracer = opentracing.GlobalTracer(); tracer != nil {
+		return tracer
+	}
+	return opentracing.NoopTracer{}
+}
+
+//Finish call span, marking it as failed on error
+func finishSpan(span opentracing.Span, err error) {
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(log.Error(err))
+	}
+	span.Finish()
+}
+
+//This is an egress object starting a span for each call made through the wrapped sink:
+//The span is a child of the span found on the call context, if any, and its context is
+//injected into the event header or the query, so the receiving tap can continue the trace.
+//The context is injected into a shallow copy of the event or query, as the caller's one may
+//be shared.
+type TracingSink struct {
+	SinkInterface
+	tracer   opentracing.Tracer
+	relation string
+	sink     SinkInterface
+}
+
+//Create sink tracing the calls of a relation:
+//tracer is the tracer to start the spans with, nil for the global tracer.
+//relation is the relation name tagged on the spans.
+func NewTracingSink(tracer opentracing.Tracer, relation string, sink SinkInterface) SinkInterface {
+	return &TracingSink{
+		tracer:   tracer,
+		relation: relation,
+		sink:     sink,
+	}
+}
+
+func (t *TracingSink) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return t.RunQueryContext(context.Background(), query)
+}
+
+func (t *TracingSink) PushEvent(event *proto.Event) error {
+	return t.PushEventContext(context.Background(), event)
+}
+
+func (t *TracingSink) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	span, ctx := t.startSpan(ctx, "run query "+query.Type.String())
+	span.SetTag("query.uuid", query.UUID)
+	ext.SpanKindRPCClient.Set(span)
+
+	traced := *query
+	traced.TraceContext = t.inject(span)
+	result, err := RunQueryWithContext(ctx, t.sink, &traced)
+	finishSpan(span, err)
+	return result, err
+}
+
+func (t *TracingSink) RunStreamingQuery(ctx context.Context, query *proto.Query, stream ResultStream) error {
+	span, ctx := t.startSpan(ctx, "run streaming query "+query.Type.String())
+	span.SetTag("query.uuid", query.UUID)
+	ext.SpanKindRPCClient.Set(span)
+
+	traced := *query
+	traced.TraceContext = t.inject(span)
+	err := RunStreamingQuery(ctx, t.sink, &traced, stream)
+	finishSpan(span, err)
+	return err
+}
+
+//Events with no header are given an empty header for carrying the trace context.
+func (t *TracingSink) PushEventContext(ctx context.Context, event *proto.Event) error {
+	span, ctx := t.startSpan(ctx, "push event "+event.Type.String())
+	ext.SpanKindProducer.Set(span)
+
+	var header proto.EventHeader
+	if event.Header != nil {
+		header = *event.Header
+	}
+	if header.UUID != "" {
+		span.SetTag("event.uuid", header.UUID)
+	}
+	header.TraceContext = t.inject(span)
+	traced := *event
+	traced.Header = &header
+	err := PushEventWithContext(ctx, t.sink, &traced)
+	finishSpan(span, err)
+	return err
+}
+
+//Private method for starting a call span under the context span
+func (t *TracingSink) startSpan(ctx context.Context, operation string) (opentracing.Span, context.Context) {
+	tracer := resolveTracer(t.tracer)
+	options := []opentracing.StartSpanOption{
+		opentracing.Tag{Key: "relation", Value: t.relation},
+	}
+	if parent := opentracing.SpanFromContext(ctx); parent != nil {
+		options = append(options, opentracing.ChildOf(parent.Context()))
+	}
+	span := tracer.StartSpan(operation, options...)
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+//Private method for injecting the span context into a new trace context map:
+//Stale context of a previous hop is replaced.
+func (t *TracingSink) inject(span opentracing.Span) map[string]string {
+	traceContext := make(map[string]string)
+	if err := span.Tracer().Inject(span.Context(), opentracing.TextMap, opentracing.TextMapCarrier(traceContext)); err != nil {
+		span.LogFields(log.Error(err))
+	}
+	return traceContext
+}
+
+//This is an ingress object starting a span for each call handled through the wrapped tap:
+//The span continues the trace context carried by the event header or the query, or else
+//the span of the call context, and is set on the context passed to the handlers.
+type TracingTap struct {
+	//Handlers setters are passed on to the wrapped tap
+	TapInterface
+	tracer   opentracing.Tracer
+	instance string
+}
+
+//Create tap tracing the calls handled by an instance:
+//tracer is the tracer to start the spans with, nil for the global tracer.
+//instance is the handling instance name tagged on the spans.
+func NewTracingTap(tracer opentracing.Tracer, instance string, tap TapInterface) TapInterface {
+	return &TracingTap{
+		TapInterface: tap,
+		tracer:       tracer,
+		instance:     instance,
+	}
+}
+
+func (t *TracingTap) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return t.RunQueryContext(context.Background(), query)
+}
+
+func (t *TracingTap) PushEvent(event *proto.Event) error {
+	return t.PushEventContext(context.Background(), event)
+}
+
+func (t *TracingTap) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	span, ctx := t.startSpan(ctx, "handle query "+query.Type.String(), query.TraceContext, opentracing.ChildOf)
+	span.SetTag("query.uuid", query.UUID)
+	ext.SpanKindRPCServer.Set(span)
+	result, err := RunQueryWithContext(ctx, t.TapInterface, query)
+	finishSpan(span, err)
+	return result, err
+}
+
+func (t *TracingTap) RunStreamingQuery(ctx context.Context, query *proto.Query, stream ResultStream) error {
+	span, ctx := t.startSpan(ctx, "handle streaming query "+query.Type.String(), query.TraceContext, opentracing.ChildOf)
+	span.SetTag("query.uuid", query.UUID)
+	ext.SpanKindRPCServer.Set(span)
+	err := RunStreamingQuery(ctx, t.TapInterface, query, stream)
+	finishSpan(span, err)
+	return err
+}
+
+//Event handling follows from the push span, as the producer does not wait for it.
+func (t *TracingTap) PushEventContext(ctx context.Context, event *proto.Event) error {
+	var traceContext map[string]string
+	if event.Header != nil {
+		traceContext = event.Header.TraceContext
+	}
+	span, ctx := t.startSpan(ctx, "handle event "+event.Type.String(), traceContext, opentracing.FollowsFrom)
+	ext.SpanKindConsumer.Set(span)
+	err := PushEventWithContext(ctx, t.TapInterface, event)
+	finishSpan(span, err)
+	return err
+}
+
+//Private method for starting a handling span continuing the carried trace context
+func (t *TracingTap) startSpan(ctx context.Context, operation string, traceContext map[string]string,
+	reference func(opentracing.SpanContext) opentracing.SpanReference) (opentracing.Span, context.Context) {
+	tracer := resolveTracer(t.tracer)
+	options := []opentracing.StartSpanOption{
+		opentracing.Tag{Key: "instance", Value: t.instance},
+	}
+	var parent opentracing.SpanContext
+	if len(traceContext) > 0 {
+		parent, _ = tracer.Extract(opentracing.TextMap, opentracing.TextMapCarrier(traceContext))
+	}
+	if parent == nil {
+		//No carried trace context, continue the local caller span
+		if span := opentracing.SpanFromContext(ctx); span != nil {
+			parent = span.Context()
+		}
+	}
+	if parent != nil {
+		options = append(options, reference(parent))
+	}
+	span := tracer.StartSpan(operation, options...)
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
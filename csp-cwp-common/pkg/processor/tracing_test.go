@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type TracingTestSuite struct {
+	suite.Suite
+	tracer *mocktracer.MockTracer
+}
+
+func (suite *TracingTestSuite) SetupTest() {
+	suite.tracer = mocktracer.New()
+}
+
+func (suite *TracingTestSuite) TearDownTest() {
+}
+
+func (suite *TracingTestSuite) TestTracing__EventHop() {
+	collector := &eventsCollector{}
+	collector.BaseProcessor = NewBaseProcessor(collector, BaseProcessorParams{
+		LivenessInterval: time.Second,
+	})
+	tap := NewTracingTap(suite.tracer, "Instance2", collector.GetTap())
+	sink := NewTracingSink(suite.tracer, "Instance1->Instance2:DummyEventType", NewSink(tap))
+
+	//The caller span is the root of the trace
+	root := suite.tracer.StartSpan("root")
+	ctx := opentracing.ContextWithSpan(context.Background(), root)
+	require.NoError(suite.T(), PushEventWithContext(ctx, sink, prepareEvents(1)[0]), "failed to push event")
+	root.Finish()
+
+	spans := suite.tracer.FinishedSpans()
+	require.Equal(suite.T(), 3, len(spans))
+	handle, push := spans[0], spans[1]
+	require.Equal(suite.T(), "handle event DummyEventType", handle.OperationName)
+	require.Equal(suite.T(), "Instance2", handle.Tag("instance"))
+	require.Equal(suite.T(), "push event DummyEventType", push.OperationName)
+	require.Equal(suite.T(), "Instance1->Instance2:DummyEventType", push.Tag("relation"))
+	require.Equal(suite.T(), push.SpanContext.SpanID, handle.ParentID)
+	require.Equal(suite.T(), root.(*mocktracer.MockSpan).SpanContext.SpanID, push.ParentID)
+	require.Equal(suite.T(), push.SpanContext.TraceID, handle.SpanContext.TraceID)
+
+	//Trace context is carried by the event header
+	require.NotEmpty(suite.T(), collector.events[0].Header.TraceContext)
+}
+
+func (suite *TracingTestSuite) TestTracing__QueryExtract() {
+	//Capture the query as sent over the relation
+	var sent *pb.Query
+	capture := func(ctx context.Context, query *pb.Query, next QueryHandler) (*pb.QueryResult, error) {
+		sent = query
+		return &pb.QueryResult{Type: query.Type, UUID: query.UUID}, nil
+	}
+	sink := NewTracingSink(suite.tracer, "relation", NewInterceptedSink(NewSink(nil), nil, []QueryInterceptor{capture}))
+	queries, _ := prepareQueries(1)
+	_, err := sink.RunQuery(queries[0])
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+	require.NotEmpty(suite.T(), sent.TraceContext)
+
+	//Receiving side with no local span continues the carried trace
+	service := newHungService()
+	close(service.release)
+	tap := NewTracingTap(suite.tracer, "Instance2", NewServiceTap(service, service))
+	_, err = RunQueryWithContext(context.Background(), tap, sent)
+	require.NoError(suite.T(), err, "failed to run query: %s", err)
+
+	spans := suite.tracer.FinishedSpans()
+	require.Equal(suite.T(), 2, len(spans))
+	run, handle := spans[0], spans[1]
+	require.Equal(suite.T(), "run query DummyQueryType", run.OperationName)
+	require.Equal(suite.T(), "handle query DummyQueryType", handle.OperationName)
+	require.Equal(suite.T(), run.SpanContext.SpanID, handle.ParentID)
+	require.Equal(suite.T(), run.SpanContext.TraceID, handle.SpanContext.TraceID)
+}
+
+func (suite *TracingTestSuite) TestTracing__CallerEventAndQuery() {
+	sink := NewTracingSink(suite.tracer, "relation", NewSink(nil))
+
+	//The trace context is injected into copies, leaving the caller's event and query as they are
+	event := prepareEvents(1)[0]
+	event.Header = &pb.EventHeader{
+		UUID:         "uuid",
+		TraceContext: map[string]string{"tenant": "acme"},
+	}
+	_ = sink.PushEvent(event)
+	require.Equal(suite.T(), map[string]string{"tenant": "acme"}, event.Header.TraceContext)
+	unstamped := prepareEvents(1)[0]
+	_ = sink.PushEvent(unstamped)
+	require.Nil(suite.T(), unstamped.Header)
+	queries, _ := prepareQueries(1)
+	_, _ = sink.RunQuery(queries[0])
+	require.Nil(suite.T(), queries[0].TraceContext)
+}
+
+func (suite *TracingTestSuite) TestTracing__Error() {
+	sink := NewTracingSink(suite.tracer, "relation", NewSink(nil))
+	require.Error(suite.T(), sink.PushEvent(prepareEvents(1)[0]), "pushed event with no tap")
+
+	spans := suite.tracer.FinishedSpans()
+	require.Equal(suite.T(), 1, len(spans))
+	require.Equal(suite.T(), true, spans[0].Tag("error"))
+}
+
+func TestTracing__RUN(t *testing.T) {
+	crt := new(TracingTestSuite)
+	suite.Run(t, crt)
+}
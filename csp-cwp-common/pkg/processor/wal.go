@@ -0,0 +1,413 @@
+package processor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Returned when appending to a write-ahead log which reached its size limit
+var ErrLogFull = errors.New("write-ahead log is full")
+
+const (
+	walSegmentSuffix = ".wal"
+	walCursorFile    = "cursor"
+	//Record header: payload length (4), checksum of timestamp and payload (4), timestamp (8)
+	walHeaderSize = 16
+)
+
+//Record read from a write-ahead log
+type walRecord struct {
+	sequence  uint64
+	timestamp int64
+	payload   []byte
+}
+
+//Segment file of a write-ahead log, named by the sequence number of its first record
+type walSegment struct {
+	base  uint64
+	path  string
+	size  int64
+	count uint64
+	//Size of the acknowledged records
+	acknowledged int64
+}
+
+//Write-ahead log of records kept in segment files under a directory:
+//Records are numbered by a sequence and acknowledged in order. The sequence number of the
+//first unacknowledged record is kept in a cursor file, so the unacknowledged records can be
+//replayed after a restart. Segments whose records are all acknowledged are removed.
+//The size limit applies to the unacknowledged records only, so the log may take up to an
+//extra segment on disk, as the acknowledged records are removed a segment at a time.
+type writeAheadLog struct {
+	dir         string
+	segmentSize int64
+	maxBytes    int64
+	syncWrites  bool
+
+	lock     sync.Mutex
+	segments []*walSegment
+	active   *os.File
+	//Sequence number of the first unacknowledged record
+	cursor uint64
+	//Sequence number of the next appended record
+	next uint64
+	//Total size of the segments, and of their acknowledged records
+	size         int64
+	acknowledged int64
+	//Signaled on each append
+	appended chan struct{}
+}
+
+//Open write-ahead log in a directory, created if missing:
+//Existing segments are scanned and a torn record at the end of a segment, left by a crash
+//during a write, is truncated. A corrupted record before the end of a segment fails the
+//opening, so the records following it are not lost.
+func openWriteAheadLog(dir string, segmentSize int64, maxBytes int64, syncWrites bool) (*writeAheadLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	l := &writeAheadLog{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxBytes:    maxBytes,
+		syncWrites:  syncWrites,
+		appended:    make(chan struct{}, 1),
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	if err := l.removeAcknowledged(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+//Private method for loading the cursor and the segments of the log directory
+func (l *writeAheadLog) load() error {
+	content, err := ioutil.ReadFile(filepath.Join(l.dir, walCursorFile))
+	if err == nil {
+		if l.cursor, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64); err != nil {
+			return fmt.Errorf("invalid write-ahead log cursor: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(l.dir, "*"+walSegmentSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		base, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), walSegmentSuffix), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid write-ahead log segment name %s", path)
+		}
+		segment := &walSegment{
+			base: base,
+			path: path,
+		}
+		if err := scanSegment(segment, l.cursor); err != nil {
+			return err
+		}
+		l.segments = append(l.segments, segment)
+		l.size += segment.size
+		l.acknowledged += segment.acknowledged
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].base < l.segments[j].base })
+
+	l.next = l.cursor
+	if len(l.segments) > 0 {
+		last := l.segments[len(l.segments)-1]
+		if end := last.base + last.count; end > l.next {
+			l.next = end
+		}
+	}
+	return nil
+}
+
+//Count the records of a segment, and the size of those before the cursor, truncating a torn
+//record at the end of the segment
+func scanSegment(segment *walSegment, cursor uint64) error {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		record, err := readRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			_ = file.Close()
+			return fmt.Errorf("corrupted write-ahead log segment %s at offset %d: %s", segment.path, segment.size, err)
+		}
+		size := walHeaderSize + int64(len(record.payload))
+		if segment.base+segment.count < cursor {
+			segment.acknowledged += size
+		}
+		segment.count++
+		segment.size += size
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(segment.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > segment.size {
+		return os.Truncate(segment.path, segment.size)
+	}
+	return nil
+}
+
+//Read the next record from a reader, return an error on a torn or corrupted record
+func readRecord(reader io.Reader) (*walRecord, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	hash := crc32.NewIEEE()
+	_, _ = hash.Write(header[8:])
+	_, _ = hash.Write(payload)
+	if hash.Sum32() != checksum {
+		return nil, fmt.Errorf("write-ahead log record checksum mismatch")
+	}
+	return &walRecord{
+		timestamp: int64(binary.BigEndian.Uint64(header[8:16])),
+		payload:   payload,
+	}, nil
+}
+
+//Append record to the log
+func (l *writeAheadLog) append(payload []byte) error {
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[8:16], uint64(time.Now().UnixNano()))
+	copy(record[walHeaderSize:], payload)
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxBytes > 0 && l.size-l.acknowledged+int64(len(record)) > l.maxBytes {
+		return ErrLogFull
+	}
+	if err := l.prepareActive(); err != nil {
+		return err
+	}
+	segment := l.segments[len(l.segments)-1]
+	if _, err := l.active.Write(record); err != nil {
+		//Drop the partial record so the following records stay readable
+		_ = l.active.Truncate(segment.size)
+		return err
+	}
+	if l.syncWrites {
+		if err := l.active.Sync(); err != nil {
+			return err
+		}
+	}
+	segment.size += int64(len(record))
+	segment.count++
+	l.size += int64(len(record))
+	l.next++
+
+	select {
+	case l.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//Private method for opening the segment to append to, rotating a full segment:
+//Should be called under the log lock.
+func (l *writeAheadLog) prepareActive() error {
+	if l.active != nil {
+		if l.segments[len(l.segments)-1].size < l.segmentSize {
+			return nil
+		}
+		if err := l.active.Close(); err != nil {
+			return err
+		}
+		l.active = nil
+	}
+
+	//Segments loaded from the directory are not appended to, unless empty
+	var segment *walSegment
+	if len(l.segments) > 0 && l.segments[len(l.segments)-1].count == 0 {
+		segment = l.segments[len(l.segments)-1]
+	} else {
+		segment = &walSegment{
+			base: l.next,
+			path: filepath.Join(l.dir, fmt.Sprintf("%020d%s", l.next, walSegmentSuffix)),
+		}
+		l.segments = append(l.segments, segment)
+	}
+	file, err := os.OpenFile(segment.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	l.active = file
+	return nil
+}
+
+//Acknowledge the records up to the given read record, inclusive
+func (l *writeAheadLog) acknowledge(record *walRecord) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if record.sequence < l.cursor {
+		return nil
+	}
+	l.cursor = record.sequence + 1
+	for _, segment := range l.segments {
+		if record.sequence >= segment.base && record.sequence < segment.base+segment.count {
+			segment.acknowledged += walHeaderSize + int64(len(record.payload))
+			l.acknowledged += walHeaderSize + int64(len(record.payload))
+			break
+		}
+	}
+
+	//Replace the cursor file atomically
+	path := filepath.Join(l.dir, walCursorFile)
+	if err := ioutil.WriteFile(path+".tmp", []byte(strconv.FormatUint(l.cursor, 10)), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return l.removeAcknowledged()
+}
+
+//Private method for removing the segments whose records are all acknowledged, except the active one:
+//Should be called under the log lock.
+func (l *writeAheadLog) removeAcknowledged() error {
+	for len(l.segments) > 0 {
+		segment := l.segments[0]
+		if segment.base+segment.count > l.cursor || (l.active != nil && len(l.segments) == 1) {
+			return nil
+		}
+		if err := os.Remove(segment.path); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+		l.size -= segment.size
+		l.acknowledged -= segment.acknowledged
+	}
+	return nil
+}
+
+//Get the number of unacknowledged records
+func (l *writeAheadLog) pending() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.next - l.cursor
+}
+
+//Close the log, the records remain in the directory
+func (l *writeAheadLog) close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.active == nil {
+		return nil
+	}
+	err := l.active.Close()
+	l.active = nil
+	return err
+}
+
+//Reader of the log records in order, starting at the log cursor
+type walReader struct {
+	log      *writeAheadLog
+	segment  *walSegment
+	file     *os.File
+	offset   int64
+	sequence uint64
+}
+
+//Create log reader, should be used by a single goroutine
+func (l *writeAheadLog) newReader() *walReader {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return &walReader{
+		log:      l,
+		sequence: l.cursor,
+	}
+}
+
+//Read the next record, return nil if no record was appended yet
+func (r *walReader) next() (*walRecord, error) {
+	r.log.lock.Lock()
+	var segment *walSegment
+	var size int64
+	for _, current := range r.log.segments {
+		if r.sequence >= current.base && r.sequence < current.base+current.count {
+			segment, size = current, current.size
+			break
+		}
+	}
+	r.log.lock.Unlock()
+	if segment == nil {
+		return nil, nil
+	}
+
+	if segment != r.segment {
+		if err := r.open(segment); err != nil {
+			return nil, err
+		}
+	}
+	//The record is complete, as it was counted after being written
+	record, err := readRecord(io.NewSectionReader(r.file, r.offset, size-r.offset))
+	if err != nil {
+		return nil, err
+	}
+	record.sequence = r.sequence
+	r.offset += walHeaderSize + int64(len(record.payload))
+	r.sequence++
+	return record, nil
+}
+
+//Private method for opening a segment for reading at the reader sequence number
+func (r *walReader) open(segment *walSegment) error {
+	r.close()
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return err
+	}
+	r.segment, r.file, r.offset = segment, file, 0
+
+	//Skip the records before the reader sequence number
+	header := make([]byte, walHeaderSize)
+	for skipped := segment.base; skipped < r.sequence; skipped++ {
+		if _, err := r.file.ReadAt(header, r.offset); err != nil {
+			return err
+		}
+		r.offset += walHeaderSize + int64(binary.BigEndian.Uint32(header[0:4]))
+	}
+	return nil
+}
+
+//Close the reader current segment file
+func (r *walReader) close() {
+	if r.file != nil {
+		_ = r.file.Close()
+	}
+	r.segment, r.file = nil, nil
+}
@@ -0,0 +1,353 @@
+package supervisor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rapid7/csp-cwp-common/pkg/agent_libraries/logger"
+	"github.com/rapid7/csp-cwp-common/pkg/builder"
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+)
+
+const (
+	defaultPollInterval    = time.Second
+	defaultShutdownTimeout = 5 * time.Second
+	//Bounds the backoff doubling, far beyond any practical backoff
+	maxBackoffDoublings = 30
+)
+
+//Restart mode of an instance
+type RestartMode int
+
+const (
+	//Leave failed instances as they are
+	RestartNever RestartMode = iota
+	//Restart instances which failed to run, whose run loop failed, or which failed the liveness check
+	RestartOnFailure
+	//Restart failed instances, as well as those whose run loop returned with no error
+	RestartAlways
+)
+
+var restartModeNames = map[RestartMode]string{
+	RestartNever:     "never",
+	RestartOnFailure: "on-failure",
+	RestartAlways:    "always",
+}
+
+func (m RestartMode) String() string {
+	if name, exists := restartModeNames[m]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+//Get restart mode by its name
+func ParseRestartMode(name string) (RestartMode, error) {
+	for mode, modeName := range restartModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return RestartNever, fmt.Errorf("unknown restart mode %s", name)
+}
+
+//Restart policy of an instance
+type RestartPolicy struct {
+	Mode RestartMode
+	//Number of restarts allowed within Window, beyond which the instance is left failed, zero for no limit
+	MaxRestarts int
+	//Period the restarts are counted over, zero for the supervisor lifetime
+	Window time.Duration
+	//Delay of the first restart within Window, doubled on each further restart, zero for restarting right away
+	Backoff time.Duration
+	//Limit of the doubled restart delay, zero for no limit
+	MaxBackoff time.Duration
+}
+
+//Check restart policy validity
+func (p *RestartPolicy) validate() error {
+	if p.MaxRestarts < 0 || p.Window < 0 || p.Backoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("restart policy limits should not be negative")
+	}
+	if _, exists := restartModeNames[p.Mode]; !exists {
+		return fmt.Errorf("unknown restart mode %d", p.Mode)
+	}
+	return nil
+}
+
+//Private method for getting the delay of a restart following the given number of restarts
+func (p *RestartPolicy) backoff(restarts int) time.Duration {
+	delay := p.Backoff
+	for i := 0; i < restarts && i < maxBackoffDoublings; i++ {
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			break
+		}
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+//Parameters of a supervisor
+type SupervisorParams struct {
+	//Interval between the instances checks (default 1s)
+	PollInterval time.Duration
+	//Passed as is to the liveness check of the instances
+	GracePeriod time.Duration
+	//Time a restart waits for the failed instance to shut down before abandoning it (default 5s)
+	ShutdownTimeout time.Duration
+	//Policy of the instances with no policy of their own
+	DefaultPolicy RestartPolicy
+	//Mapping from an instance name to its restart policy
+	Policies map[string]RestartPolicy
+	//Logger of the failures and restarts, which reports them to Sentry if configured to, nil for no logging
+	Logger logger.Logger
+}
+
+//Check supervisor params validity and fill in defaults
+func (p *SupervisorParams) validate() error {
+	if p.PollInterval < 0 || p.GracePeriod < 0 || p.ShutdownTimeout < 0 {
+		return fmt.Errorf("supervisor params should not be negative")
+	}
+	if p.PollInterval == 0 {
+		p.PollInterval = defaultPollInterval
+	}
+	if p.ShutdownTimeout == 0 {
+		p.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if err := p.DefaultPolicy.validate(); err != nil {
+		return err
+	}
+	for name, policy := range p.Policies {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("invalid restart policy of instance %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+//Supervision record of an instance
+type instanceRecord struct {
+	//Times of the restarts within the policy window
+	restarts []time.Time
+	//Total number of restarts
+	total int
+	//Time of the pending restart, zero for none
+	due time.Time
+	//Set once a failed instance is left failed, so it is reported once
+	abandoned bool
+}
+
+//Supervisor of the instances of a running Builder mesh:
+//Polls the instances and restarts those which failed according to their restart policies.
+//An instance is failed once it failed to run or shut down, its run loop returned (for processors
+//implementing ExitReporter), or it failed its liveness check. Instances which were not run or
+//were shut down on purpose are not supervised.
+//A restart replaces the instance with a new one through Builder.RestartProcessor, which re-wires
+//its relations. The supervisor should be shut down before the Builder mesh.
+type Supervisor struct {
+	builder *builder.Builder
+	params  SupervisorParams
+
+	//Guards the instances records, and serializes the checks
+	lock      sync.Mutex
+	instances map[string]*instanceRecord
+
+	//For signaling the poll goroutine to stop and waiting for it to finish
+	runLock sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+//Create supervisor of the instances of a Builder
+func NewSupervisor(b *builder.Builder, params SupervisorParams) (*Supervisor, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &Supervisor{
+		builder:   b,
+		params:    params,
+		instances: make(map[string]*instanceRecord),
+	}, nil
+}
+
+//Start polling the instances from a new goroutine
+func (s *Supervisor) Run() error {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	if s.stop != nil {
+		return fmt.Errorf("supervisor is already running")
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.poll(s.stop, s.done)
+	return nil
+}
+
+//Stop polling the instances, waiting for a running check to finish
+func (s *Supervisor) Shutdown() {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+//Check all the instances once, restarting the failed ones which are due for restart
+func (s *Supervisor) Check() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for iter := s.builder.GetProcessorsIterator(); iter != nil; iter = iter.Next() {
+		info, err := iter.Current()
+		if err != nil || info == nil {
+			continue
+		}
+		s.check(info, time.Now())
+	}
+}
+
+//Get the number of restarts of an instance
+func (s *Supervisor) Restarts(name string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if record, exists := s.instances[name]; exists {
+		return record.total
+	}
+	return 0
+}
+
+//Private poll goroutine
+func (s *Supervisor) poll(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(s.params.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+//Private method for checking an instance, called with the lock held
+func (s *Supervisor) check(info *builder.ProcessorInfo, now time.Time) {
+	name := info.Name()
+	record, exists := s.instances[name]
+	if !exists {
+		record = &instanceRecord{}
+		s.instances[name] = record
+	}
+	healthy, failure, reason := s.diagnose(info)
+	if healthy {
+		record.due = time.Time{}
+		record.abandoned = false
+		return
+	}
+	if record.abandoned {
+		return
+	}
+
+	policy := s.policy(name)
+	if policy.Mode == RestartNever || (policy.Mode == RestartOnFailure && !failure) {
+		record.abandoned = true
+		s.warnf("instance %s %s, not restarted by restart policy %s", name, reason, policy.Mode)
+		return
+	}
+	if record.due.IsZero() {
+		if policy.Window > 0 {
+			recent := record.restarts[:0]
+			for _, restart := range record.restarts {
+				if now.Sub(restart) < policy.Window {
+					recent = append(recent, restart)
+				}
+			}
+			record.restarts = recent
+		}
+		if policy.MaxRestarts > 0 && len(record.restarts) >= policy.MaxRestarts {
+			record.abandoned = true
+			s.errorf("instance %s %s, giving up after %d restarts", name, reason, len(record.restarts))
+			return
+		}
+		delay := policy.backoff(len(record.restarts))
+		record.due = now.Add(delay)
+		s.errorf("instance %s %s, restarting in %s", name, reason, delay)
+	}
+	if now.Before(record.due) {
+		return
+	}
+
+	//Failed restarts are counted as well, so a failing restart is retried with backoff
+	record.due = time.Time{}
+	record.restarts = append(record.restarts, now)
+	record.total++
+	if err := s.builder.RestartProcessor(name, s.params.ShutdownTimeout); err != nil {
+		s.errorf("failed to restart instance %s: %s", name, err)
+		return
+	}
+	s.infof("restarted instance %s, %d restarts so far", name, record.total)
+}
+
+//Private method for diagnosing an instance:
+//Return whether it is healthy, otherwise whether it failed along with the reason.
+func (s *Supervisor) diagnose(info *builder.ProcessorInfo) (bool, bool, string) {
+	switch info.State() {
+	case processor.LifecycleFailed:
+		return false, true, "failed to run or shut down"
+	case processor.LifecycleRunning:
+	default:
+		//Not run yet, in transition or shut down on purpose
+		return true, false, ""
+	}
+	instance := info.Instance()
+	if reporter, ok := instance.(processor.ExitReporter); ok {
+		if exited, err := reporter.Exited(); exited {
+			if err != nil {
+				return false, true, fmt.Sprintf("run loop failed: %s", err)
+			}
+			return false, false, "run loop returned"
+		}
+	}
+	if !instance.IsAlive(s.params.GracePeriod) {
+		return false, true, "failed liveness check"
+	}
+	return true, false, ""
+}
+
+//Private method for getting the restart policy of an instance
+func (s *Supervisor) policy(name string) RestartPolicy {
+	if policy, exists := s.params.Policies[name]; exists {
+		return policy
+	}
+	return s.params.DefaultPolicy
+}
+
+func (s *Supervisor) infof(format string, args ...interface{}) {
+	if s.params.Logger != nil {
+		s.params.Logger.Infof(format, args...)
+	}
+}
+
+func (s *Supervisor) warnf(format string, args ...interface{}) {
+	if s.params.Logger != nil {
+		s.params.Logger.Warnf(format, args...)
+	}
+}
+
+func (s *Supervisor) errorf(format string, args ...interface{}) {
+	if s.params.Logger != nil {
+		s.params.Logger.Errorf(format, args...)
+	}
+}
@@ -0,0 +1,248 @@
+package supervisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/atomic"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/rapid7/csp-cwp-common/pkg/builder"
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+const layout = `
+localInstances:
+- name: Instance1
+  type: Flaky
+- name: Instance2
+  type: Flaky
+`
+
+type SupervisorTestSuite struct {
+	suite.Suite
+	file    *os.File
+	builder *builder.Builder
+	created *atomic.Int32
+}
+
+func (suite *SupervisorTestSuite) SetupTest() {
+	var err error
+	suite.file, err = ioutil.TempFile("", "blueprint")
+	require.NoError(suite.T(), err, "failed to create layout file: %s", err)
+	_, err = suite.file.Write([]byte(layout))
+	require.NoError(suite.T(), err, "failed to write layout file: %s", err)
+
+	suite.builder, err = builder.NewBuilder(suite.file.Name())
+	require.NoError(suite.T(), err, "failed to create builder: %s", err)
+	suite.created = atomic.NewInt32(0)
+	err = suite.builder.AddConstructor("Flaky", newFlakyProcessor, suite.created)
+	require.NoError(suite.T(), err, "failed to add constructor: %s", err)
+	errors := suite.builder.Run()
+	require.Zero(suite.T(), len(errors), "builder run failed: %v", errors)
+}
+
+func (suite *SupervisorTestSuite) TearDownTest() {
+	suite.builder.Shutdown()
+	os.Remove(suite.file.Name())
+}
+
+func (suite *SupervisorTestSuite) TestSupervisor__RestartPolicies() {
+	supervisor, err := NewSupervisor(suite.builder, SupervisorParams{
+		GracePeriod:   10,
+		DefaultPolicy: RestartPolicy{Mode: RestartOnFailure},
+		Policies: map[string]RestartPolicy{
+			"Instance2": {Mode: RestartNever},
+		},
+	})
+	require.NoError(suite.T(), err, "failed to create supervisor: %s", err)
+
+	//Healthy instances are left running
+	supervisor.Check()
+	require.Zero(suite.T(), supervisor.Restarts("Instance1"))
+
+	//A failed run loop is restarted, a returned one is not restarted on failure only
+	suite.instance("Instance1").crash <- fmt.Errorf("crashed")
+	suite.waitRestarts(supervisor, "Instance1", 1)
+	require.Equal(suite.T(), int32(3), suite.created.Load())
+	require.Equal(suite.T(), processor.LifecycleRunning, suite.info("Instance1").State())
+	suite.instance("Instance1").crash <- nil
+	suite.waitExited("Instance1")
+	supervisor.Check()
+	require.Equal(suite.T(), 1, supervisor.Restarts("Instance1"))
+
+	//Instances with no restarts policy are left failed
+	suite.instance("Instance2").crash <- fmt.Errorf("crashed")
+	suite.waitExited("Instance2")
+	supervisor.Check()
+	require.Zero(suite.T(), supervisor.Restarts("Instance2"))
+	require.Equal(suite.T(), int32(3), suite.created.Load())
+
+	//Instances shut down on purpose are not supervised
+	require.NoError(suite.T(), suite.builder.ShutdownProcessor("Instance1"))
+	supervisor.Check()
+	require.Equal(suite.T(), 1, supervisor.Restarts("Instance1"))
+
+	_, err = NewSupervisor(suite.builder, SupervisorParams{DefaultPolicy: RestartPolicy{MaxRestarts: -1}})
+	require.Error(suite.T(), err, "created supervisor with invalid policy")
+	mode, err := ParseRestartMode("on-failure")
+	require.NoError(suite.T(), err, "failed to parse restart mode: %s", err)
+	require.Equal(suite.T(), RestartOnFailure, mode)
+}
+
+func (suite *SupervisorTestSuite) TestSupervisor__BackoffAndLimit() {
+	supervisor, err := NewSupervisor(suite.builder, SupervisorParams{
+		GracePeriod: 10,
+		DefaultPolicy: RestartPolicy{
+			Mode:        RestartAlways,
+			MaxRestarts: 2,
+			Window:      time.Minute,
+			Backoff:     50 * time.Millisecond,
+		},
+	})
+	require.NoError(suite.T(), err, "failed to create supervisor: %s", err)
+
+	//Restarts are delayed by the backoff, and even returned run loops are restarted
+	suite.instance("Instance1").crash <- nil
+	suite.waitExited("Instance1")
+	start := time.Now()
+	supervisor.Check()
+	require.Zero(suite.T(), supervisor.Restarts("Instance1"), "restarted before backoff")
+	suite.waitRestarts(supervisor, "Instance1", 1)
+	require.True(suite.T(), time.Since(start) >= 50*time.Millisecond, "restarted before backoff")
+
+	//The backoff is doubled on the next restart
+	suite.instance("Instance1").crash <- fmt.Errorf("crashed")
+	suite.waitExited("Instance1")
+	start = time.Now()
+	suite.waitRestarts(supervisor, "Instance1", 2)
+	require.True(suite.T(), time.Since(start) >= 100*time.Millisecond, "restarted before doubled backoff")
+
+	//Further restarts within the window are given up on
+	suite.instance("Instance1").crash <- fmt.Errorf("crashed")
+	suite.waitExited("Instance1")
+	time.Sleep(250 * time.Millisecond)
+	supervisor.Check()
+	require.Equal(suite.T(), 2, supervisor.Restarts("Instance1"))
+	exited, _ := suite.instance("Instance1").Exited()
+	require.True(suite.T(), exited, "instance given up on was restarted")
+}
+
+func (suite *SupervisorTestSuite) TestSupervisor__WedgedInstance() {
+	supervisor, err := NewSupervisor(suite.builder, SupervisorParams{
+		PollInterval:    10 * time.Millisecond,
+		GracePeriod:     10,
+		ShutdownTimeout: 20 * time.Millisecond,
+		DefaultPolicy:   RestartPolicy{Mode: RestartOnFailure},
+	})
+	require.NoError(suite.T(), err, "failed to create supervisor: %s", err)
+	require.NoError(suite.T(), supervisor.Run(), "failed to run supervisor")
+	defer supervisor.Shutdown()
+	require.Error(suite.T(), supervisor.Run(), "supervisor was run twice")
+
+	//An instance failing its liveness check is replaced even though its shutdown never returns
+	wedged := suite.instance("Instance2")
+	wedged.wedge()
+	defer close(wedged.release)
+	err = wait.Poll(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		return suite.instance("Instance2") != wedged, nil
+	})
+	require.NoError(suite.T(), err, "wedged instance was not replaced: %s", err)
+	suite.waitRestarts(supervisor, "Instance2", 1)
+	require.Equal(suite.T(), processor.LifecycleRunning, suite.info("Instance2").State())
+}
+
+func TestSupervisor__RUN(t *testing.T) {
+	crt := new(SupervisorTestSuite)
+	suite.Run(t, crt)
+}
+
+//Helper method for getting the processor info of an instance
+func (suite *SupervisorTestSuite) info(name string) *builder.ProcessorInfo {
+	for iter := suite.builder.GetProcessorsIterator(); iter != nil; iter = iter.Next() {
+		info, err := iter.Current()
+		require.NoError(suite.T(), err, "failed to get processor info: %s", err)
+		if info.Name() == name {
+			return info
+		}
+	}
+	require.Fail(suite.T(), "missing instance "+name)
+	return nil
+}
+
+//Helper method for getting the current instance of a flaky processor
+func (suite *SupervisorTestSuite) instance(name string) *flakyProcessor {
+	return suite.info(name).Instance().(*flakyProcessor)
+}
+
+//Helper method for waiting for the run loop of an instance to return
+func (suite *SupervisorTestSuite) waitExited(name string) {
+	err := wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) {
+		exited, _ := suite.instance(name).Exited()
+		return exited, nil
+	})
+	require.NoError(suite.T(), err, "run loop of %s did not return: %s", name, err)
+}
+
+//Helper method for checking the instances until an instance was restarted the given number of times
+func (suite *SupervisorTestSuite) waitRestarts(supervisor *Supervisor, name string, restarts int) {
+	err := wait.Poll(5*time.Millisecond, 5*time.Second, func() (bool, error) {
+		supervisor.Check()
+		return supervisor.Restarts(name) == restarts, nil
+	})
+	require.NoError(suite.T(), err, "instance %s was not restarted: %s", name, err)
+}
+
+//Processor whose run loop returns on demand, and which may wedge failing its liveness check
+//with a shutdown blocking until released
+type flakyProcessor struct {
+	*processor.BaseProcessor
+	crash   chan error
+	wedged  atomic.Bool
+	release chan struct{}
+}
+
+func newFlakyProcessor(created *atomic.Int32) processor.ProcessorInterface {
+	created.Inc()
+	p := &flakyProcessor{
+		crash:   make(chan error, 1),
+		release: make(chan struct{}),
+	}
+	p.BaseProcessor = processor.NewBaseProcessor(p, processor.BaseProcessorParams{
+		LivenessInterval: time.Second,
+		RunLoop: func(stop <-chan struct{}) error {
+			select {
+			case err := <-p.crash:
+				return err
+			case <-stop:
+				return nil
+			}
+		},
+	})
+	return p
+}
+
+func (p *flakyProcessor) PushEvent(event *pb.Event) error {
+	return nil
+}
+
+func (p *flakyProcessor) wedge() {
+	p.wedged.Store(true)
+}
+
+func (p *flakyProcessor) IsAlive(gracePeriod time.Duration) bool {
+	return !p.wedged.Load() && p.BaseProcessor.IsAlive(gracePeriod)
+}
+
+func (p *flakyProcessor) Shutdown() error {
+	if p.wedged.Load() {
+		<-p.release
+	}
+	return p.BaseProcessor.Shutdown()
+}
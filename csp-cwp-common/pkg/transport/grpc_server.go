@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Metadata key of the destination tap name on transport calls
+const DestinationMetadataKey = "destination"
+
+//This is the gRPC transport server exposing local processors taps to other processes:
+//Each call is routed to the tap named by the call destination metadata.
+type GrpcServer struct {
+	lock sync.RWMutex
+	taps map[string]processor.TapInterface
+}
+
+//Create gRPC transport server with no taps
+func NewGrpcServer() *GrpcServer {
+	return &GrpcServer{
+		taps: make(map[string]processor.TapInterface),
+	}
+}
+
+//Expose a local tap under the given destination name
+func (s *GrpcServer) AddTap(name string, tap processor.TapInterface) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.taps[name]; exists {
+		return fmt.Errorf("tap %s already exists", name)
+	}
+	s.taps[name] = tap
+	return nil
+}
+
+//Register the transport service on a gRPC server
+func (s *GrpcServer) Register(server *grpc.Server) {
+	proto.RegisterTransportServer(server, s)
+}
+
+func (s *GrpcServer) PushEvent(ctx context.Context, event *proto.Event) (*proto.Empty, error) {
+	tap, err := s.getTap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := processor.PushEventWithContext(ctx, tap, event); err != nil {
+		return nil, statusError(err)
+	}
+	return &proto.Empty{}, nil
+}
+
+func (s *GrpcServer) RunQuery(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	tap, err := s.getTap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := processor.RunQueryWithContext(ctx, tap, query)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if result == nil {
+		return nil, status.Errorf(codes.Internal, "no result for query %s", query.UUID)
+	}
+	return result, nil
+}
+
+//Results are streamed as sent by the tap, including the end marker.
+func (s *GrpcServer) RunStreamingQuery(query *proto.Query, stream proto.Transport_RunStreamingQueryServer) error {
+	tap, err := s.getTap(stream.Context())
+	if err != nil {
+		return err
+	}
+	if err := processor.RunStreamingQuery(stream.Context(), tap, query, stream); err != nil {
+		return statusError(err)
+	}
+	return nil
+}
+
+//Private method for getting the destination tap of a call
+func (s *GrpcServer) getTap(ctx context.Context) (processor.TapInterface, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	names := md.Get(DestinationMetadataKey)
+	if len(names) != 1 {
+		return nil, status.Errorf(codes.InvalidArgument, "missing call destination")
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	tap, exists := s.taps[names[0]]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "unknown destination %s", names[0])
+	}
+	return tap, nil
+}
+
+//Convert a tap error into the status returned to the remote caller
+func statusError(err error) error {
+	switch {
+	case processor.IsTimeoutError(err):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+	proto "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+//Create sink to a remote processor tap exposed by a GrpcServer:
+//conn is the client connection to the remote server, owned by the caller.
+//destination is the name the remote tap is exposed under.
+func NewGrpcSink(conn *grpc.ClientConn, destination string) processor.SinkInterface {
+	return NewGrpcSinkWithContext(context.Background(), conn, destination, 0)
+}
+
+//Create sink to a remote processor tap with deadline enforcement:
+//Same as processor.NewSinkWithContext, the deadline is also passed to the remote side.
+func NewGrpcSinkWithContext(ctx context.Context, conn *grpc.ClientConn, destination string, timeout time.Duration) processor.SinkInterface {
+	return processor.NewSinkWithContext(ctx, newGrpcTap(conn, destination), timeout)
+}
+
+//Client side proxy of a remote tap
+type grpcTap struct {
+	processor.TapInterface
+	client      proto.TransportClient
+	destination string
+}
+
+func newGrpcTap(conn *grpc.ClientConn, destination string) *grpcTap {
+	return &grpcTap{
+		client:      proto.NewTransportClient(conn),
+		destination: destination,
+	}
+}
+
+func (t *grpcTap) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return t.RunQueryContext(context.Background(), query)
+}
+
+func (t *grpcTap) PushEvent(event *proto.Event) error {
+	return t.PushEventContext(context.Background(), event)
+}
+
+func (t *grpcTap) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	result, err := t.client.RunQuery(t.callContext(ctx), query)
+	if err != nil {
+		return nil, callError(err, "remote run query")
+	}
+	return result, nil
+}
+
+//Servers not supporting streaming queries are paged through by plain queries instead.
+func (t *grpcTap) RunStreamingQuery(ctx context.Context, query *proto.Query, stream processor.ResultStream) error {
+	//Cancelled on return, so the remote side stops streaming once the caller stream fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client, err := t.client.RunStreamingQuery(t.callContext(ctx), query)
+	if err != nil {
+		return callError(err, "remote run streaming query")
+	}
+	received := false
+	for {
+		result, err := client.Recv()
+		if err == io.EOF {
+			return fmt.Errorf("remote stream of query %s ended with no end marker", query.UUID)
+		}
+		if status.Code(err) == codes.Unimplemented && !received {
+			return processor.RunStreamingQuery(ctx, &pagingTap{tap: t}, query, stream)
+		}
+		if err != nil {
+			return callError(err, "remote run streaming query")
+		}
+		received = true
+		if err := stream.Send(result); err != nil {
+			return err
+		}
+		if result.EndOfStream {
+			return nil
+		}
+	}
+}
+
+func (t *grpcTap) PushEventContext(ctx context.Context, event *proto.Event) error {
+	_, err := t.client.PushEvent(t.callContext(ctx), event)
+	if err != nil {
+		return callError(err, "remote push event")
+	}
+	return nil
+}
+
+//Remote tap proxy exposing only the plain queries path, for paging through it
+type pagingTap struct {
+	tap *grpcTap
+}
+
+func (p *pagingTap) RunQuery(query *proto.Query) (*proto.QueryResult, error) {
+	return p.tap.RunQuery(query)
+}
+
+func (p *pagingTap) RunQueryContext(ctx context.Context, query *proto.Query) (*proto.QueryResult, error) {
+	return p.tap.RunQueryContext(ctx, query)
+}
+
+//Private method for addressing a call to the destination tap
+func (t *grpcTap) callContext(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, DestinationMetadataKey, t.destination)
+}
+
+//Convert a remote call status into the error returned to the caller
+func callError(err error, operation string) error {
+	if status.Code(err) == codes.DeadlineExceeded {
+		return &processor.TimeoutError{
+			Operation: operation,
+		}
+	}
+	return err
+}
@@ -0,0 +1,253 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/rapid7/csp-cwp-common/pkg/processor"
+	pb "github.com/rapid7/csp-cwp-common/pkg/proto/processor"
+)
+
+type GrpcTestSuite struct {
+	suite.Suite
+	listener  *bufconn.Listener
+	server    *grpc.Server
+	transport *GrpcServer
+	conn      *grpc.ClientConn
+}
+
+func (suite *GrpcTestSuite) SetupTest() {
+	suite.listener = bufconn.Listen(1024 * 1024)
+	suite.server = grpc.NewServer()
+	suite.transport = NewGrpcServer()
+	suite.transport.Register(suite.server)
+	go func() {
+		_ = suite.server.Serve(suite.listener)
+	}()
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return suite.listener.Dial()
+		}),
+		grpc.WithInsecure())
+	require.NoError(suite.T(), err, "failed to dial server: %s", err)
+	suite.conn = conn
+}
+
+func (suite *GrpcTestSuite) TearDownTest() {
+	_ = suite.conn.Close()
+	suite.server.Stop()
+}
+
+func (suite *GrpcTestSuite) TestGrpc__PushEvent() {
+	params := &processor.TestServiceParams{
+		LivenessInterval: time.Second,
+	}
+	service := processor.NewTestService(params)
+	require.NoError(suite.T(), suite.transport.AddTap("Instance1", service.GetTap()), "failed to add tap")
+	require.Error(suite.T(), suite.transport.AddTap("Instance1", service.GetTap()), "added same tap twice")
+	require.NoError(suite.T(), service.Run(), "failed to run service")
+	defer service.Shutdown()
+
+	sink := NewGrpcSink(suite.conn, "Instance1")
+	events := prepareEvents(3)
+	for _, event := range events {
+		require.NoError(suite.T(), sink.PushEvent(event), "failed to push remote event")
+	}
+	err := wait.Poll(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(params.Processed()) == len(events), nil
+	})
+	require.NoError(suite.T(), err, "remote events were not processed")
+	for i, event := range params.Processed() {
+		require.True(suite.T(), event.Equal(events[i]), "mismatching events")
+	}
+}
+
+func (suite *GrpcTestSuite) TestGrpc__RunQuery() {
+	service := processor.NewTestService(&processor.TestServiceParams{
+		LivenessInterval: time.Second,
+	})
+	require.NoError(suite.T(), suite.transport.AddTap("Instance1", service.GetTap()), "failed to add tap")
+
+	sink := NewGrpcSink(suite.conn, "Instance1")
+	query := &pb.Query{
+		Type: pb.QueryType_DummyQueryType,
+		UUID: "query-uuid",
+		Info: &pb.Query_Dummy{
+			Dummy: &pb.DummyQuery{
+				Info: "Query",
+			},
+		},
+	}
+	result, err := sink.RunQuery(query)
+	require.NoError(suite.T(), err, "failed to run remote query: %s", err)
+	require.Equal(suite.T(), query.UUID, result.UUID)
+	require.Equal(suite.T(), "Query", result.GetDummy().Info)
+
+	//Unknown destination is reported to the caller
+	_, err = NewGrpcSink(suite.conn, "Instance2").RunQuery(query)
+	require.Error(suite.T(), err, "query ran on unknown destination")
+}
+
+func (suite *GrpcTestSuite) TestGrpc__Timeout() {
+	release := make(chan struct{})
+	defer close(release)
+	require.NoError(suite.T(), suite.transport.AddTap("Instance1", processor.NewProcessorTap(&hungProcessor{release: release})), "failed to add tap")
+
+	sink := NewGrpcSinkWithContext(context.Background(), suite.conn, "Instance1", 50*time.Millisecond)
+	err := sink.PushEvent(prepareEvents(1)[0])
+	require.True(suite.T(), processor.IsTimeoutError(err), "unexpected error %v", err)
+}
+
+func (suite *GrpcTestSuite) TestGrpc__RunStreamingQuery() {
+	service := &chunkService{chunks: 3}
+	require.NoError(suite.T(), suite.transport.AddTap("Instance1", processor.NewServiceTap(service, service)), "failed to add tap")
+
+	sink := NewGrpcSink(suite.conn, "Instance1")
+	query := &pb.Query{Type: pb.QueryType_DummyQueryType, UUID: "query-uuid"}
+	results, err := collectStream(sink, query)
+	require.NoError(suite.T(), err, "failed to run remote streaming query: %s", err)
+	require.Equal(suite.T(), 4, len(results))
+	for i, result := range results[:3] {
+		require.Equal(suite.T(), "Chunk "+strconv.Itoa(i), result.GetDummy().Info)
+		require.Equal(suite.T(), query.UUID, result.UUID)
+		require.Equal(suite.T(), uint64(i), result.Sequence)
+	}
+	require.True(suite.T(), results[3].EndOfStream, "missing end marker")
+
+	//Service failure is reported to the caller
+	service.fail = true
+	_, err = collectStream(sink, query)
+	require.Error(suite.T(), err, "remote streaming query did not fail")
+}
+
+func (suite *GrpcTestSuite) TestGrpc__StreamingFallback() {
+	//Server with no streaming support is paged through by plain queries
+	server := grpc.NewServer()
+	defer server.Stop()
+	listener := bufconn.Listen(1024 * 1024)
+	legacy := &legacyServer{server: NewGrpcServer()}
+	pb.RegisterTransportServer(server, legacy)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure())
+	require.NoError(suite.T(), err, "failed to dial server: %s", err)
+	defer conn.Close()
+
+	service := &chunkService{chunks: 3}
+	require.NoError(suite.T(), legacy.server.AddTap("Instance1", processor.NewServiceTap(service, service)), "failed to add tap")
+	results, err := collectStream(NewGrpcSink(conn, "Instance1"), &pb.Query{UUID: "query-uuid"})
+	require.NoError(suite.T(), err, "failed to run remote streaming query: %s", err)
+	require.Equal(suite.T(), 2, len(results))
+	require.Equal(suite.T(), "Single", results[0].GetDummy().Info)
+	require.True(suite.T(), results[1].EndOfStream, "missing end marker")
+}
+
+func TestGrpc__RUN(t *testing.T) {
+	crt := new(GrpcTestSuite)
+	suite.Run(t, crt)
+}
+
+//Processor stub which never handles its events until released
+type hungProcessor struct {
+	processor.ProcessorInterface
+	release chan struct{}
+}
+
+func (hp *hungProcessor) PushEvent(event *pb.Event) error {
+	<-hp.release
+	return nil
+}
+
+//Helper function for creating dummy events
+func prepareEvents(num int) []*pb.Event {
+	events := make([]*pb.Event, 0)
+	for i := 0; i < num; i++ {
+		events = append(events, &pb.Event{
+			Type: pb.EventType_DummyEventType,
+			Info: &pb.Event_Dummy{
+				Dummy: &pb.DummyEvent{
+					Info: "Event " + strconv.Itoa(i),
+				},
+			},
+		})
+	}
+	return events
+}
+
+//Helper function for collecting the results of a streaming query
+func collectStream(sink processor.SinkInterface, query *pb.Query) ([]*pb.QueryResult, error) {
+	results := []*pb.QueryResult{}
+	err := processor.RunStreamingQuery(context.Background(), sink, query, processor.ResultStreamFunc(func(result *pb.QueryResult) error {
+		results = append(results, result)
+		return nil
+	}))
+	return results, err
+}
+
+//Service streaming its results in chunks, or returning a single result for plain queries
+type chunkService struct {
+	processor.ServiceInterface
+	chunks int
+	fail   bool
+}
+
+func (cs *chunkService) RunQuery(query *pb.Query) (*pb.QueryResult, error) {
+	return &pb.QueryResult{
+		Type: query.Type,
+		UUID: query.UUID,
+		Info: &pb.QueryResult_Dummy{
+			Dummy: &pb.DummyQueryResult{
+				Info: "Single",
+			},
+		},
+	}, nil
+}
+
+func (cs *chunkService) StreamQuery(ctx context.Context, query *pb.Query, stream processor.ResultStream) error {
+	for i := 0; i < cs.chunks; i++ {
+		err := stream.Send(&pb.QueryResult{
+			Info: &pb.QueryResult_Dummy{
+				Dummy: &pb.DummyQueryResult{
+					Info: "Chunk " + strconv.Itoa(i),
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if cs.fail {
+		return fmt.Errorf("service failed")
+	}
+	return nil
+}
+
+//Transport server of a version with no streaming queries support
+type legacyServer struct {
+	*pb.UnimplementedTransportServer
+	server *GrpcServer
+}
+
+func (ls *legacyServer) PushEvent(ctx context.Context, event *pb.Event) (*pb.Empty, error) {
+	return ls.server.PushEvent(ctx, event)
+}
+
+func (ls *legacyServer) RunQuery(ctx context.Context, query *pb.Query) (*pb.QueryResult, error) {
+	return ls.server.RunQuery(ctx, query)
+}